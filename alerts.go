@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mention spike detection: every alert rule keeps per-minute mention counts
+// for each key (the total, each mentioned account, or each hashtag) along
+// with an exponentially weighted moving average (EWMA) and variance of those
+// counts. When a minute's count gets Threshold standard deviations above the
+// average (and is at least MinCount) we have a spike. A spike fires the
+// rule's actions once; the alert then stays active while following minutes
+// are still spiking. The alert config file looks like:
+//
+//     {"Rules": [
+//         {"Name": "acct-spike", "Kind": "acct", "Threshold": 4, "MinCount": 20,
+//          "Actions": [{"Type": "log"}, {"Type": "file", "Path": "alerts.json"}]},
+//         {"Name": "vote", "Kind": "hashtag", "Names": ["#vote"],
+//          "Actions": [{"Type": "webhook", "URL": "http://localhost:9000/alert"},
+//                      {"Type": "command", "Command": ["./notify.sh", "vote"]}]}
+//     ]}
+
+// Alert rule defaults
+const (
+	defaultAlertThreshold = 3.0
+	defaultAlertMinCount  = 10
+	defaultAlertAlpha     = 0.1
+	defaultAlertWarmup    = 10
+	maxRecentAlerts       = 100
+	maxAlertFold          = 200 // Most idle minutes we fold into the average
+)
+
+// AlertActionConfig configures a single action to take when an alert fires
+type AlertActionConfig struct {
+	Type    string   // log, file, command, or webhook
+	Path    string   // File to append JSON lines to (file)
+	Command []string // Program and arguments, the alert JSON is on stdin (command)
+	URL     string   // URL to POST the alert JSON to (webhook)
+	Timeout Duration // Timeout for command and webhook (default 10s)
+}
+
+// AlertRule configures spike detection for one kind of key
+type AlertRule struct {
+	Name      string
+	Kind      string   // total, acct (mentioned account), or hashtag
+	Names     []string // Only watch these accounts or hashtags (default all)
+	Threshold float64  // Standard deviations above average for a spike (default 3)
+	MinCount  int      // Fewest mentions in a minute for a spike (default 10)
+	Alpha     float64  // EWMA weight of the newest minute (default 0.1)
+	Warmup    int      // Minutes of history before we alert (default 10)
+	Actions   []AlertActionConfig
+}
+
+// AlertsConfig is the top level of an alert config file
+type AlertsConfig struct {
+	Rules []AlertRule
+}
+
+// ReadAlertsConfig reads the alert config file. An empty filename is no
+// rules at all
+func ReadAlertsConfig(filename string) (AlertsConfig, error) {
+	config := AlertsConfig{}
+	if filename == "" {
+		return config, nil
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return config, fmt.Errorf("Invalid alert config %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+// Alert is a single detected spike
+type Alert struct {
+	ID      int64
+	Rule    string
+	Kind    string
+	Name    string    // Account or hashtag ("" for total)
+	Started time.Time // Start of the first spiking minute
+	Last    time.Time // Start of the latest spiking minute
+	Count   int       // Mentions in the latest spiking minute
+	Peak    int       // Most mentions in any spiking minute
+	Mean    float64   // Average mentions per minute when the alert started
+	StdDev  float64   // Standard deviation when the alert started
+	ZScore  float64   // Standard deviations above average when the alert started
+	Active  bool
+}
+
+// AlertsResult is what we return for the alerts API
+type AlertsResult struct {
+	Rules  []string
+	Active []Alert // Currently active alerts
+	Recent []Alert // Most recent alerts (active or not), newest first
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Actions
+
+// AlertAction is something we do when an alert fires. line is the alert as
+// a line of JSON
+type AlertAction interface {
+	Fire(alert Alert, line []byte) error
+}
+
+// NewAlertAction creates the action described by the config
+func NewAlertAction(config AlertActionConfig) (AlertAction, error) {
+	timeout := config.Timeout.Duration
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	switch strings.ToLower(config.Type) {
+	case "log":
+		return logAction{}, nil
+	case "file":
+		if config.Path == "" {
+			return nil, errors.New("file alert action requires a Path")
+		}
+		return &fileAction{path: config.Path}, nil
+	case "command":
+		if len(config.Command) < 1 || config.Command[0] == "" {
+			return nil, errors.New("command alert action requires a Command")
+		}
+		return commandAction{command: config.Command, timeout: timeout}, nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, errors.New("webhook alert action requires a URL")
+		}
+		return webhookAction{url: config.URL, client: &http.Client{Timeout: timeout}}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown alert action type '%s'", config.Type)
+}
+
+// logAction writes the alert to the log
+type logAction struct{}
+
+func (la logAction) Fire(alert Alert, line []byte) error {
+	name := alert.Name
+	if name == "" {
+		name = "all mentions"
+	}
+	log.Printf("ALERT %s: %d mentions/min for %s (average %.1f, z-score %.1f)\n",
+		alert.Rule, alert.Count, name, alert.Mean, alert.ZScore)
+	return nil
+}
+
+// fileAction appends the alert JSON to a file
+type fileAction struct {
+	path string
+	mtx  sync.Mutex
+}
+
+func (fa *fileAction) Fire(alert Alert, line []byte) error {
+	fa.mtx.Lock()
+	defer fa.mtx.Unlock()
+
+	f, err := os.OpenFile(fa.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	defer SafeClose(f)
+	_, err = f.Write(line)
+	return err
+}
+
+// commandAction runs a local command with the alert JSON on stdin
+type commandAction struct {
+	command []string
+	timeout time.Duration
+}
+
+func (ca commandAction) Fire(alert Alert, line []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ca.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, ca.command[0], ca.command[1:]...)
+	cmd.Stdin = bytes.NewReader(line)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v %s", ca.command[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// webhookAction POSTs the alert JSON to a URL
+type webhookAction struct {
+	url    string
+	client *http.Client
+}
+
+func (wa webhookAction) Fire(alert Alert, line []byte) error {
+	return postJSON(wa.client, wa.url, line)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Detection
+
+// spikeState is the per-minute history for a single key
+type spikeState struct {
+	minute   int64 // Start of the current minute (unix secs)
+	count    int   // Mentions so far in the current minute
+	mean     float64
+	variance float64
+	history  int // Minutes folded into mean and variance
+}
+
+// fold adds a finished minute's count to the EWMA
+func (st *spikeState) fold(count int, alpha float64) {
+	if st.history == 0 {
+		st.mean = float64(count)
+	} else {
+		diff := float64(count) - st.mean
+		incr := alpha * diff
+		st.mean += incr
+		st.variance = (1 - alpha) * (st.variance + diff*incr)
+	}
+	st.history++
+}
+
+// roll moves the state to the given minute, folding in the current minute
+// and any idle minutes in between
+func (st *spikeState) roll(minute int64, alpha float64) {
+	if st.minute == 0 {
+		st.minute = minute
+		return
+	}
+	if minute <= st.minute {
+		return
+	}
+
+	st.fold(st.count, alpha)
+	idle := (minute-st.minute)/60 - 1
+	if idle > maxAlertFold {
+		idle = maxAlertFold
+	}
+	for i := int64(0); i < idle; i++ {
+		st.fold(0, alpha)
+	}
+
+	st.minute = minute
+	st.count = 0
+}
+
+// stdDev is the standard deviation we compare against: never less than 1 so
+// that a perfectly steady history doesn't make every change a spike
+func (st *spikeState) stdDev() float64 {
+	return math.Max(math.Sqrt(st.variance), 1.0)
+}
+
+// alertRule is a compiled AlertRule and its detection state
+type alertRule struct {
+	AlertRule
+	names   map[string]bool // Normalized Names
+	actions []AlertAction
+	states  map[string]*spikeState
+}
+
+// keys returns the (normalized) keys in the tweet watched by this rule
+func (ar *alertRule) keys(tweet TweetRecord) []string {
+	found := NewUniqueStrings()
+	switch ar.Kind {
+	case SeriesTotal:
+		return []string{""}
+	case SeriesAcct:
+		for _, mention := range tweet.Mentions {
+			found.Add(graphNodeID(mention))
+		}
+	case SeriesHashtag:
+		for _, tag := range tweet.Hashtags {
+			found.Add(normHashtag(tag))
+		}
+	}
+
+	keys := found.Strings()
+	if len(ar.names) < 1 {
+		return keys
+	}
+	watched := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if ar.names[key] {
+			watched = append(watched, key)
+		}
+	}
+	return watched
+}
+
+// alertKey identifies the alert for a rule and key
+type alertKey struct {
+	rule int
+	name string
+}
+
+// AlertMonitor watches streamed mentions for spikes. It is safe for
+// concurrent use
+type AlertMonitor struct {
+	rules     []*alertRule
+	active    map[alertKey]*Alert // Latest alert for each rule/key
+	recent    []*Alert            // Oldest first
+	nextID    int64
+	lastPrune time.Time
+	now       func() time.Time
+	mtx       sync.RWMutex
+}
+
+// NewAlertMonitor compiles the rules (and their actions) in the config
+func NewAlertMonitor(config AlertsConfig) (*AlertMonitor, error) {
+	am := &AlertMonitor{
+		rules:  make([]*alertRule, 0, len(config.Rules)),
+		active: make(map[alertKey]*Alert),
+		recent: make([]*Alert, 0, maxRecentAlerts),
+		nextID: 1,
+		now:    time.Now,
+	}
+
+	for i, rule := range config.Rules {
+		ar := &alertRule{
+			AlertRule: rule,
+			names:     make(map[string]bool),
+			actions:   make([]AlertAction, 0, len(rule.Actions)),
+			states:    make(map[string]*spikeState),
+		}
+
+		if ar.Name == "" {
+			ar.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		ar.Kind = strings.ToLower(strings.TrimSpace(ar.Kind))
+		if ar.Kind == "" {
+			ar.Kind = SeriesTotal
+		}
+		for _, name := range ar.Names {
+			switch ar.Kind {
+			case SeriesAcct:
+				ar.names[graphNodeID(name)] = true
+			case SeriesHashtag:
+				ar.names[normHashtag(name)] = true
+			}
+		}
+		if ar.Kind != SeriesTotal && ar.Kind != SeriesAcct && ar.Kind != SeriesHashtag {
+			return nil, fmt.Errorf("Alert rule %s: Kind must be total, acct, or hashtag", ar.Name)
+		}
+
+		if ar.Threshold <= 0 {
+			ar.Threshold = defaultAlertThreshold
+		}
+		if ar.MinCount <= 0 {
+			ar.MinCount = defaultAlertMinCount
+		}
+		if ar.Alpha <= 0 || ar.Alpha > 1 {
+			ar.Alpha = defaultAlertAlpha
+		}
+		if ar.Warmup <= 0 {
+			ar.Warmup = defaultAlertWarmup
+		}
+
+		for _, actionConfig := range rule.Actions {
+			action, err := NewAlertAction(actionConfig)
+			if err != nil {
+				return nil, fmt.Errorf("Alert rule %s: %v", ar.Name, err)
+			}
+			ar.actions = append(ar.actions, action)
+		}
+
+		am.rules = append(am.rules, ar)
+	}
+
+	return am, nil
+}
+
+// isActive is true if the alert spiked in this minute or the last one
+func isActive(alert *Alert, minute time.Time) bool {
+	return !alert.Last.Before(minute.Add(-time.Minute))
+}
+
+// Add counts a streamed mention (at the time we received it) and fires any
+// alerts for new spikes
+func (am *AlertMonitor) Add(tweet TweetRecord) {
+	am.mtx.Lock()
+	defer am.mtx.Unlock()
+
+	now := am.now().UTC()
+	minute := now.Truncate(time.Minute)
+
+	for ruleIdx, rule := range am.rules {
+		for _, key := range rule.keys(tweet) {
+			st, inMap := rule.states[key]
+			if !inMap {
+				st = &spikeState{}
+				rule.states[key] = st
+			}
+			st.roll(minute.Unix(), rule.Alpha)
+			st.count++
+
+			if st.history < rule.Warmup || st.count < rule.MinCount {
+				continue
+			}
+			stdDev := st.stdDev()
+			zscore := (float64(st.count) - st.mean) / stdDev
+			if zscore < rule.Threshold {
+				continue
+			}
+
+			akey := alertKey{rule: ruleIdx, name: key}
+			alert, inMap := am.active[akey]
+			if inMap && isActive(alert, minute) {
+				// Still spiking: just update the existing alert
+				alert.Last = minute
+				alert.Count = st.count
+				if st.count > alert.Peak {
+					alert.Peak = st.count
+				}
+				continue
+			}
+
+			alert = &Alert{
+				ID:      am.nextID,
+				Rule:    rule.Name,
+				Kind:    rule.Kind,
+				Name:    key,
+				Started: minute,
+				Last:    minute,
+				Count:   st.count,
+				Peak:    st.count,
+				Mean:    st.mean,
+				StdDev:  stdDev,
+				ZScore:  zscore,
+				Active:  true,
+			}
+			am.nextID++
+			am.active[akey] = alert
+			am.recent = append(am.recent, alert)
+			if len(am.recent) > maxRecentAlerts {
+				am.recent = am.recent[len(am.recent)-maxRecentAlerts:]
+			}
+			go fireAlert(rule.actions, *alert)
+		}
+	}
+
+	am.prune(now)
+}
+
+// prune drops state for keys we haven't seen in a day and alerts that are
+// no longer active (checked at most once an hour). Caller must hold the write
+// lock
+func (am *AlertMonitor) prune(now time.Time) {
+	if now.Sub(am.lastPrune) < time.Hour {
+		return
+	}
+	am.lastPrune = now
+
+	oldest := now.Add(-24 * time.Hour).Unix()
+	for _, rule := range am.rules {
+		for key, st := range rule.states {
+			if st.minute < oldest {
+				delete(rule.states, key)
+			}
+		}
+	}
+	minute := now.Truncate(time.Minute)
+	for key, alert := range am.active {
+		if !isActive(alert, minute) {
+			delete(am.active, key)
+		}
+	}
+}
+
+// fireAlert runs all the actions for an alert, logging any failures
+func fireAlert(actions []AlertAction, alert Alert) {
+	buf, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("Alerts: could not encode alert %d: %v\n", alert.ID, err)
+		return
+	}
+	line := append(buf, '\n')
+
+	for _, action := range actions {
+		if err := action.Fire(alert, line); err != nil {
+			log.Printf("Alerts: action for %s failed: %v\n", alert.Rule, err)
+		}
+	}
+}
+
+// Alerts returns the rule names, active alerts, and recent alerts
+func (am *AlertMonitor) Alerts() AlertsResult {
+	am.mtx.RLock()
+	defer am.mtx.RUnlock()
+
+	minute := am.now().UTC().Truncate(time.Minute)
+	result := AlertsResult{
+		Rules:  make([]string, 0, len(am.rules)),
+		Active: make([]Alert, 0),
+		Recent: make([]Alert, 0, len(am.recent)),
+	}
+	for _, rule := range am.rules {
+		result.Rules = append(result.Rules, rule.Name)
+	}
+	for i := len(am.recent) - 1; i >= 0; i-- {
+		alert := *am.recent[i]
+		alert.Active = isActive(am.recent[i], minute)
+		if alert.Active {
+			result.Active = append(result.Active, alert)
+		}
+		result.Recent = append(result.Recent, alert)
+	}
+	return result
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chanAction sends every fired alert to a channel
+type chanAction chan Alert
+
+func (ca chanAction) Fire(alert Alert, line []byte) error {
+	ca <- alert
+	return nil
+}
+
+// waitAlert returns the next fired alert (or fails the test)
+func waitAlert(t *testing.T, fired chanAction) Alert {
+	select {
+	case alert := <-fired:
+		return alert
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for alert")
+	}
+	return Alert{}
+}
+
+func TestAlertConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := ReadAlertsConfig("")
+	assert.NoError(err)
+	assert.Len(config.Rules, 0)
+	_, err = ReadAlertsConfig("/this/file/should/not/exist")
+	assert.Error(err)
+
+	monitor, err := NewAlertMonitor(AlertsConfig{Rules: []AlertRule{
+		{Kind: "ACCT", Names: []string{"Alice"}, Actions: []AlertActionConfig{{Type: "log"}}},
+	}})
+	assert.NoError(err)
+	rule := monitor.rules[0]
+	assert.Equal("rule-1", rule.Name)
+	assert.Equal(SeriesAcct, rule.Kind)
+	assert.Equal(map[string]bool{"@alice": true}, rule.names)
+	assert.Equal(defaultAlertThreshold, rule.Threshold)
+	assert.Equal(defaultAlertMinCount, rule.MinCount)
+	assert.Equal(defaultAlertAlpha, rule.Alpha)
+	assert.Equal(defaultAlertWarmup, rule.Warmup)
+	assert.Equal([]string{"rule-1"}, monitor.Alerts().Rules)
+
+	bad := []AlertRule{
+		{Kind: "weekday"},
+		{Actions: []AlertActionConfig{{Type: "pager"}}},
+		{Actions: []AlertActionConfig{{Type: "file"}}},
+		{Actions: []AlertActionConfig{{Type: "command"}}},
+		{Actions: []AlertActionConfig{{Type: "webhook"}}},
+	}
+	for _, rule := range bad {
+		_, err := NewAlertMonitor(AlertsConfig{Rules: []AlertRule{rule}})
+		assert.Error(err)
+	}
+}
+
+func TestAlertMonitor(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 10, 9, 12, 0, 30, 0, time.UTC)
+	monitor, err := NewAlertMonitor(AlertsConfig{Rules: []AlertRule{
+		{Name: "accts", Kind: "acct", MinCount: 5, Warmup: 5},
+		{Name: "vote", Kind: "hashtag", Names: []string{"vote"}, MinCount: 5, Warmup: 5},
+	}})
+	assert.NoError(err)
+	monitor.now = func() time.Time { return now }
+	fired := make(chanAction, 10)
+	for _, rule := range monitor.rules {
+		rule.actions = append(rule.actions, fired)
+	}
+
+	mention := func(count int, mentions []string, hashtags []string) {
+		for i := 0; i < count; i++ {
+			monitor.Add(TweetRecord{Mentions: mentions, Hashtags: hashtags})
+		}
+	}
+
+	// A steady 2 a minute for 10 minutes is never a spike
+	for i := 0; i < 10; i++ {
+		mention(2, []string{"@Alice"}, []string{"#vote", "#debate"})
+		now = now.Add(time.Minute)
+	}
+	assert.Len(monitor.Alerts().Recent, 0)
+
+	// Jump to 12 a minute: one alert per rule, even as the count keeps going
+	mention(12, []string{"@alice", "@alice"}, []string{"#Vote", "#debate"})
+	first := waitAlert(t, fired)
+	second := waitAlert(t, fired)
+	if first.Rule != "accts" {
+		first, second = second, first
+	}
+	assert.Equal("accts", first.Rule)
+	assert.Equal("@alice", first.Name)
+	assert.Equal(SeriesAcct, first.Kind)
+	assert.True(first.ZScore >= defaultAlertThreshold)
+	assert.InDelta(2.0, first.Mean, 0.01)
+	assert.Equal("vote", second.Rule)
+	assert.Equal("#vote", second.Name)
+
+	result := monitor.Alerts()
+	assert.Len(result.Active, 2)
+	assert.Len(result.Recent, 2)
+	assert.Equal(12, result.Active[0].Count)
+	assert.Equal(12, result.Active[0].Peak)
+
+	// Still spiking the next minute updates the alert without firing
+	now = now.Add(time.Minute)
+	mention(20, []string{"@alice"}, nil)
+	result = monitor.Alerts()
+	assert.Len(result.Recent, 2)
+	var alice Alert
+	for _, alert := range result.Active {
+		if alert.Rule == "accts" {
+			alice = alert
+		}
+	}
+	assert.Equal(20, alice.Peak)
+	assert.Equal(now.Truncate(time.Minute), alice.Last)
+	assert.Equal(first.Started, alice.Started)
+
+	// Quiet for a while, and nothing is active
+	now = now.Add(10 * time.Minute)
+	mention(1, []string{"@bob"}, nil)
+	result = monitor.Alerts()
+	assert.Len(result.Active, 0)
+	assert.Len(result.Recent, 2)
+	assert.False(result.Recent[0].Active)
+	select {
+	case alert := <-fired:
+		t.Errorf("Unexpected alert %v", alert)
+	default:
+	}
+}
+
+func TestSpikeState(t *testing.T) {
+	assert := assert.New(t)
+
+	st := &spikeState{}
+	st.roll(60, 0.5)
+	st.count = 4
+	st.roll(120, 0.5)
+	assert.Equal(1, st.history)
+	assert.Equal(4.0, st.mean)
+	assert.Equal(0, st.count)
+
+	// Idle minutes are folded in as zeros
+	st.roll(240, 0.5)
+	assert.Equal(3, st.history)
+	assert.Equal(1.0, st.mean)
+	assert.InDelta(1.732, st.stdDev(), 0.001)
+
+	// Going back in time doesn't change anything
+	st.roll(60, 0.5)
+	assert.Equal(3, st.history)
+	assert.Equal(int64(240), st.minute)
+
+	// A perfectly steady history still has a standard deviation of 1
+	steady := &spikeState{}
+	for i := 0; i < 5; i++ {
+		steady.fold(3, 0.5)
+	}
+	assert.Equal(3.0, steady.mean)
+	assert.Equal(1.0, steady.stdDev())
+}
+
+func TestAlertActions(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twivility-alerts")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+
+	alert := Alert{ID: 42, Rule: "test", Kind: SeriesHashtag, Name: "#vote", Count: 100}
+	buf, err := json.Marshal(alert)
+	pcheck(err)
+	line := append(buf, '\n')
+
+	check := func(config AlertActionConfig) {
+		action, err := NewAlertAction(config)
+		assert.NoError(err)
+		assert.NoError(action.Fire(alert, line))
+	}
+	check(AlertActionConfig{Type: "log"})
+
+	// File appends
+	alertFile := filepath.Join(dir, "alerts.json")
+	check(AlertActionConfig{Type: "file", Path: alertFile})
+	check(AlertActionConfig{Type: "file", Path: alertFile})
+	written, err := ioutil.ReadFile(alertFile)
+	assert.NoError(err)
+	assert.Equal(string(line)+string(line), string(written))
+
+	// Command gets the JSON on stdin
+	cmdFile := filepath.Join(dir, "cmd.json")
+	check(AlertActionConfig{Type: "command", Command: []string{"sh", "-c", "cat > " + cmdFile}})
+	written, err = ioutil.ReadFile(cmdFile)
+	assert.NoError(err)
+	assert.Equal(string(line), string(written))
+
+	action, err := NewAlertAction(AlertActionConfig{Type: "command", Command: []string{"sh", "-c", "exit 3"}})
+	assert.NoError(err)
+	assert.Error(action.Fire(alert, line))
+
+	// Webhook
+	var posted Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&posted)
+	}))
+	defer server.Close()
+	check(AlertActionConfig{Type: "webhook", URL: server.URL})
+	assert.Equal(alert, posted)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Our versioned API router. Routes are registered with a method and a path
+// pattern (relative to the API root) where path parameters are segments like
+// {acct}. The same router is mounted at /api/v1 and (for compatibility) at
+// /api. Errors are returned as JSON (see APIError), and the route list is
+// used to generate the OpenAPI document
+
+// APIVersion is the current API version (and the path prefix /api/v1)
+const APIVersion = "v1"
+
+// API error codes
+const (
+	ErrCodeBadRequest       = "bad_request"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeInternal         = "internal_error"
+)
+
+// errorCodes are all of the API error codes (for the OpenAPI document)
+var errorCodes = []string{
+	ErrCodeBadRequest, ErrCodeUnauthorized, ErrCodeForbidden,
+	ErrCodeNotFound, ErrCodeMethodNotAllowed, ErrCodeInternal,
+}
+
+// APIError is the body of every API error response (wrapped in an object with
+// the single field Error)
+type APIError struct {
+	Status  int    // HTTP status code
+	Code    string // One of the ErrCode constants
+	Message string // Human readable description
+}
+
+// apiErrorResult is the JSON body for errors
+type apiErrorResult struct {
+	Error APIError
+}
+
+// writeAPIError writes a JSON error response
+func writeAPIError(w http.ResponseWriter, status int, code string, message string) {
+	js, err := json.Marshal(apiErrorResult{Error: APIError{Status: status, Code: code, Message: message}})
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// jsonResponse writes the object as a JSON response
+func jsonResponse(w http.ResponseWriter, req *http.Request, jsonSrc interface{}) {
+	js, err := json.Marshal(jsonSrc)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// badRequest writes a 400 error for the given error (usually from parsing the
+// query parameters)
+func badRequest(w http.ResponseWriter, err error) {
+	writeAPIError(w, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+}
+
+// notFound writes a 404 error
+func notFound(w http.ResponseWriter, message string) {
+	writeAPIError(w, http.StatusNotFound, ErrCodeNotFound, message)
+}
+
+// PathParams are the path parameters matched for a route (without braces)
+type PathParams map[string]string
+
+// APIHandler handles a request for a route
+type APIHandler func(w http.ResponseWriter, req *http.Request, params PathParams)
+
+// APIParam documents a query parameter for the OpenAPI document
+type APIParam struct {
+	Name        string
+	Description string
+}
+
+// APIRoute is a single API endpoint
+type APIRoute struct {
+	Method  string     // HTTP method (GET routes also answer HEAD)
+	Path    string     // Pattern like /tweets/{acct}
+	Summary string     // One line description for the OpenAPI document
+	Query   []APIParam // Optional query parameters for the OpenAPI document
+	Cache   bool       // Response only depends on the data (see ResponseCache)
+	Admin   bool       // Only for the admin role (see Authenticator)
+	Handler APIHandler
+
+	segments []string
+}
+
+// match returns the path parameters if the given path segments match the
+// route's pattern
+func (route *APIRoute) match(segments []string) (PathParams, bool) {
+	if len(segments) != len(route.segments) {
+		return nil, false
+	}
+	params := make(PathParams)
+	for i, seg := range route.segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[seg[1:len(seg)-1]] = segments[i]
+		} else if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// allows returns true if the route handles the given method
+func (route *APIRoute) allows(method string) bool {
+	return method == route.Method || (method == http.MethodHead && route.Method == http.MethodGet)
+}
+
+// APIRouter dispatches requests to routes. Routes must all be added before
+// the router starts serving. Responses are compressed, and if Cache is set,
+// responses for routes with Cache set are cached. Requests are counted and
+// timed in Metrics (if set), labeled with Prefix (where the router is
+// served) and the route pattern
+type APIRouter struct {
+	Prefix  string
+	Cache   *ResponseCache
+	Metrics *Metrics
+	routes  []*APIRoute
+}
+
+// statusWriter remembers the status code written
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// NewAPIRouter returns a router with no routes
+func NewAPIRouter() *APIRouter {
+	return &APIRouter{routes: make([]*APIRoute, 0, 32)}
+}
+
+// splitAPIPath returns the segments of an API path ("/a/b/" => [a b])
+func splitAPIPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// Add registers a route
+func (router *APIRouter) Add(route APIRoute) {
+	route.segments = splitAPIPath(route.Path)
+	router.routes = append(router.routes, &route)
+}
+
+// Handles returns true if any route (for any method) matches the path, which
+// must be relative to the API root
+func (router *APIRouter) Handles(path string) bool {
+	segments := splitAPIPath(path)
+	for _, route := range router.routes {
+		if _, ok := route.match(segments); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP dispatches to the matching route. The request path must already
+// be relative to the API root (see http.StripPrefix). Unknown paths are 404
+// and known paths with the wrong method are 405
+func (router *APIRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	started := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	route := router.serve(sw, req)
+	if route != unmatchedRoute {
+		route = router.Prefix + route
+	}
+	router.Metrics.ObserveRequest(route, req.Method, sw.status, time.Since(started))
+}
+
+// serve handles the request, returning the route pattern matched (or
+// unmatchedRoute)
+func (router *APIRouter) serve(w http.ResponseWriter, req *http.Request) string {
+	segments := splitAPIPath(req.URL.Path)
+	allowed := NewUniqueStrings()
+	for _, route := range router.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.allows(req.Method) {
+			if route.Admin && !requestAuthenticated(req) {
+				log.Printf("%s %s - forbidden without authentication\n", req.Method, req.URL.Path)
+				writeAPIError(w, http.StatusForbidden, ErrCodeForbidden, "Admin routes need authentication (see -auth): "+req.URL.Path)
+				return route.Path
+			}
+			if route.Admin && !requestAllowed(req, RoleAdmin) {
+				log.Printf("%s %s - forbidden for %s\n", req.Method, req.URL.Path, requestUser(req).Name)
+				writeAPIError(w, http.StatusForbidden, ErrCodeForbidden, "Admin role required for "+req.URL.Path)
+				return route.Path
+			}
+			if route.Admin && !crossSiteSafe(req) {
+				log.Printf("%s %s - possible cross-site request from %s\n", req.Method, req.URL.Path, requestUser(req).Name)
+				writeAPIError(w, http.StatusForbidden, ErrCodeForbidden,
+					"Admin POSTs need an X-API-Key header or Content-Type: application/json: "+req.URL.Path)
+				return route.Path
+			}
+			router.Cache.serveAPI(w, req, route.Cache, func(w http.ResponseWriter) {
+				route.Handler(w, req, params)
+			})
+			return route.Path
+		}
+		allowed.Add(route.Method)
+		if route.Method == http.MethodGet {
+			allowed.Add(http.MethodHead)
+		}
+	}
+
+	if len(allowed.Seen) > 0 {
+		log.Printf("%s %s - method not allowed\n", req.Method, req.URL.Path)
+		w.Header().Set("Allow", strings.Join(allowed.Strings(), ", "))
+		writeAPIError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed,
+			"Method "+req.Method+" not allowed for "+req.URL.Path)
+		return unmatchedRoute
+	}
+	notFound(w, "Unknown API path "+req.URL.Path)
+	return unmatchedRoute
+}
+
+// OpenAPI returns an OpenAPI 3 document describing the routes, for an API
+// served at basePath
+func (router *APIRouter) OpenAPI(title string, basePath string) map[string]interface{} {
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+			},
+		},
+	}
+
+	paths := make(map[string]interface{})
+	for _, route := range router.routes {
+		params := make([]interface{}, 0, len(route.segments)+len(route.Query))
+		for _, seg := range route.segments {
+			if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+				params = append(params, map[string]interface{}{
+					"name":     seg[1 : len(seg)-1],
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]string{"type": "string"},
+				})
+			}
+		}
+		for _, param := range route.Query {
+			params = append(params, map[string]interface{}{
+				"name":        param.Name,
+				"in":          "query",
+				"description": param.Description,
+				"schema":      map[string]string{"type": "string"},
+			})
+		}
+
+		ops, ok := paths[route.Path].(map[string]interface{})
+		if !ok {
+			ops = make(map[string]interface{})
+			paths[route.Path] = ops
+		}
+		role := RoleRead
+		if route.Admin {
+			role = RoleAdmin
+		}
+		ops[strings.ToLower(route.Method)] = map[string]interface{}{
+			"summary":    route.Summary,
+			"parameters": params,
+			"x-role":     role,
+			"responses": map[string]interface{}{
+				"200":     map[string]interface{}{"description": "OK"},
+				"default": errorResponse,
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   title,
+			"version": APIVersion,
+		},
+		"servers": []interface{}{map[string]string{"url": basePath}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"apiKey":    map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"basicAuth": map[string]string{"type": "http", "scheme": "basic"},
+			},
+			"schemas": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"Error": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"Status":  map[string]string{"type": "integer"},
+								"Code":    map[string]interface{}{"type": "string", "enum": errorCodes},
+								"Message": map[string]string{"type": "string"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testAPIRouter() *APIRouter {
+	api := NewAPIRouter()
+	echo := func(w http.ResponseWriter, req *http.Request, params PathParams) {
+		jsonResponse(w, req, params)
+	}
+	api.Add(APIRoute{Method: http.MethodGet, Path: "/accts", Summary: "Accounts", Handler: echo})
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/accts/{acct}/profile",
+		Summary: "Profile",
+		Query:   []APIParam{{"tz", "Time zone"}},
+		Handler: echo,
+	})
+	api.Add(APIRoute{Method: http.MethodPost, Path: "/accts/{acct}/profile", Summary: "Update", Handler: echo})
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/broken",
+		Summary: "Always fails",
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			badRequest(w, errors.New("Broken"))
+		},
+	})
+	return api
+}
+
+func TestAPIRouter(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.StripPrefix("/api/v1", testAPIRouter()))
+	defer server.Close()
+
+	call := func(method string, path string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		pcheck(err)
+		resp, err := http.DefaultClient.Do(req)
+		pcheck(err)
+		defer resp.Body.Close()
+		body := make(map[string]interface{})
+		if method != http.MethodHead {
+			pcheck(json.NewDecoder(resp.Body).Decode(&body))
+		}
+		return resp, body
+	}
+	apiError := func(body map[string]interface{}) map[string]interface{} {
+		errBody, ok := body["Error"].(map[string]interface{})
+		assert.True(ok)
+		return errBody
+	}
+
+	resp, body := call(http.MethodGet, "/api/v1/accts")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Len(body, 0)
+	resp, _ = call(http.MethodGet, "/api/v1/accts/")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// Path parameters
+	resp, body = call(http.MethodGet, "/api/v1/accts/TimKaine/profile")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(map[string]interface{}{"acct": "TimKaine"}, body)
+	resp, _ = call(http.MethodHead, "/api/v1/accts/TimKaine/profile")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp, _ = call(http.MethodPost, "/api/v1/accts/TimKaine/profile")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// Method checks
+	resp, body = call(http.MethodDelete, "/api/v1/accts/TimKaine/profile")
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal("GET, HEAD, POST", resp.Header.Get("Allow"))
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(ErrCodeMethodNotAllowed, apiError(body)["Code"])
+	assert.Equal(float64(http.StatusMethodNotAllowed), apiError(body)["Status"])
+
+	// Unknown paths
+	for _, path := range []string{"/api/v1/nope", "/api/v1/accts/x", "/api/v1/accts//profile", "/api/v1/accts/x/profile/more"} {
+		resp, body = call(http.MethodGet, path)
+		assert.Equal(http.StatusNotFound, resp.StatusCode, path)
+		assert.Equal(ErrCodeNotFound, apiError(body)["Code"], path)
+	}
+
+	// Handler errors
+	resp, body = call(http.MethodGet, "/api/v1/broken")
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(ErrCodeBadRequest, apiError(body)["Code"])
+	assert.Equal("Broken", apiError(body)["Message"])
+
+	// Path matching without serving
+	router := testAPIRouter()
+	assert.True(router.Handles("/accts/TimKaine/profile"))
+	assert.True(router.Handles("/accts/"))
+	assert.False(router.Handles("/accts/x"))
+	assert.False(router.Handles("/nope"))
+}
+
+func TestAPIRouterOpenAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := testAPIRouter().OpenAPI("Test API", "/api/v1")
+	js, err := json.Marshal(doc)
+	assert.NoError(err)
+
+	parsed := make(map[string]interface{})
+	assert.NoError(json.Unmarshal(js, &parsed))
+	assert.Equal("3.0.0", parsed["openapi"])
+	assert.Equal("Test API", parsed["info"].(map[string]interface{})["title"])
+
+	paths := parsed["paths"].(map[string]interface{})
+	assert.Len(paths, 3)
+
+	profile := paths["/accts/{acct}/profile"].(map[string]interface{})
+	assert.Len(profile, 2)
+	get := profile["get"].(map[string]interface{})
+	assert.Equal("Profile", get["summary"])
+	params := get["parameters"].([]interface{})
+	assert.Len(params, 2)
+	assert.Equal("acct", params[0].(map[string]interface{})["name"])
+	assert.Equal("path", params[0].(map[string]interface{})["in"])
+	assert.Equal(true, params[0].(map[string]interface{})["required"])
+	assert.Equal("tz", params[1].(map[string]interface{})["name"])
+	assert.Equal("query", params[1].(map[string]interface{})["in"])
+	assert.Contains(profile, "post")
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Authentication for the web service. Requests are authenticated with a
+// static API key (in the X-API-Key header or as "Authorization: Bearer
+// <key>") or with HTTP basic auth checked against an htpasswd file. Every
+// identity has a role: read (everything but admin routes) or admin. The auth
+// config file looks like:
+//
+//     {"Keys": [
+//         {"Name": "dashboard", "Key": "long-random-string", "Role": "read"},
+//         {"Name": "ops", "Key": "another-long-random-string", "Role": "admin"}
+//      ],
+//      "Htpasswd": "users.htpasswd",
+//      "Admins": ["craig"]}
+//
+// htpasswd users have the read role unless they're in Admins. We support
+// the SHA1 ({SHA}, htpasswd -s) and Apache MD5 ($apr1$, htpasswd -m)
+// password formats.
+//
+// With no keys or htpasswd file, authentication is off and every request
+// has the read role: the admin routes can't be used without authentication.
+//
+// Admin routes that change things must also be safe from cross-site
+// requests, since a browser sends basic auth (and reaches localhost) for
+// any page. We require a header that needs a CORS preflight (which we never
+// allow): an X-API-Key or a JSON Content-Type.
+
+// Roles
+const (
+	RoleRead  = "read"
+	RoleAdmin = "admin"
+)
+
+// defaultAuthRealm is the basic auth realm if the config doesn't give one
+const defaultAuthRealm = "twivility"
+
+// APIKeyConfig is a single static API key
+type APIKeyConfig struct {
+	Name string // Who the key is for (used in logs)
+	Key  string
+	Role string // read or admin
+}
+
+// AuthConfig is the top level of an auth config file
+type AuthConfig struct {
+	Keys     []APIKeyConfig
+	Htpasswd string   // htpasswd file for basic auth
+	Admins   []string // htpasswd users with the admin role
+	Realm    string   // Basic auth realm (default twivility)
+}
+
+// ReadAuthConfig reads the auth config file. An empty filename is no auth
+// at all
+func ReadAuthConfig(filename string) (AuthConfig, error) {
+	config := AuthConfig{}
+	if filename == "" {
+		return config, nil
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return config, fmt.Errorf("Invalid auth config %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+// AuthUser is the authenticated identity for a request
+type AuthUser struct {
+	Name string
+	Role string
+}
+
+// authContextKey is the request context key for the AuthUser
+type authContextKey struct{}
+
+// requestUser returns the authenticated user for the request. If auth is
+// off there's no user, and the request has the read role
+func requestUser(req *http.Request) AuthUser {
+	if user, ok := req.Context().Value(authContextKey{}).(AuthUser); ok {
+		return user
+	}
+	return AuthUser{Role: RoleRead}
+}
+
+// requestAuthenticated returns true if the request passed an Authenticator
+func requestAuthenticated(req *http.Request) bool {
+	_, ok := req.Context().Value(authContextKey{}).(AuthUser)
+	return ok
+}
+
+// crossSiteSafe returns true if a browser can't send the request from
+// another site without a CORS preflight: GET and HEAD (which don't change
+// anything), other methods than POST, and POSTs with an X-API-Key header or
+// a JSON Content-Type
+func crossSiteSafe(req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		return true
+	}
+	if req.Header.Get("X-API-Key") != "" {
+		return true
+	}
+	mediaType := strings.TrimSpace(strings.Split(req.Header.Get("Content-Type"), ";")[0])
+	return strings.EqualFold(mediaType, "application/json")
+}
+
+// requestAllowed returns true if the request's user has the given role
+// (admin has every role)
+func requestAllowed(req *http.Request, role string) bool {
+	have := requestUser(req).Role
+	return have == RoleAdmin || have == role
+}
+
+// Authenticator checks requests against API keys and htpasswd users
+type Authenticator struct {
+	keys   []APIKeyConfig
+	users  map[string]string // name => password hash
+	admins map[string]bool
+	realm  string
+}
+
+// validRole returns an error if the role is unknown
+func validRole(role string) error {
+	if role != RoleRead && role != RoleAdmin {
+		return errors.New("Unknown role '" + role + "': use " + RoleRead + " or " + RoleAdmin)
+	}
+	return nil
+}
+
+// NewAuthenticator returns an authenticator for the config, or nil if the
+// config has no keys or users (auth is off)
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	if len(config.Keys) < 1 && config.Htpasswd == "" {
+		return nil, nil
+	}
+
+	auth := &Authenticator{
+		keys:   make([]APIKeyConfig, 0, len(config.Keys)),
+		users:  make(map[string]string),
+		admins: make(map[string]bool),
+		realm:  config.Realm,
+	}
+	if auth.realm == "" {
+		auth.realm = defaultAuthRealm
+	}
+
+	for i, key := range config.Keys {
+		if key.Name == "" {
+			key.Name = fmt.Sprintf("key-%d", i+1)
+		}
+		if len(key.Key) < 16 {
+			return nil, errors.New("API key " + key.Name + " must be at least 16 characters")
+		}
+		if err := validRole(key.Role); err != nil {
+			return nil, fmt.Errorf("API key %s: %v", key.Name, err)
+		}
+		auth.keys = append(auth.keys, key)
+	}
+
+	if config.Htpasswd != "" {
+		users, err := readHtpasswd(config.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		auth.users = users
+	}
+	for _, name := range config.Admins {
+		if _, ok := auth.users[name]; !ok {
+			return nil, errors.New("Admin " + name + " is not in the htpasswd file")
+		}
+		auth.admins[name] = true
+	}
+
+	return auth, nil
+}
+
+// readHtpasswd reads the user => hash entries of an htpasswd file
+func readHtpasswd(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer SafeClose(file)
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", filename, lineNum)
+		}
+		hash := parts[1]
+		if !strings.HasPrefix(hash, "{SHA}") && !strings.HasPrefix(hash, "$apr1$") {
+			return nil, fmt.Errorf("%s:%d: unsupported password format for %s (use htpasswd -m or -s)", filename, lineNum, parts[0])
+		}
+		users[parts[0]] = hash
+	}
+	return users, scanner.Err()
+}
+
+// apr1Alphabet is the crypt base64 alphabet
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Hash returns the Apache MD5 ($apr1$salt$hash) hash of the password
+func apr1Hash(password string, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte("$apr1$" + salt))
+	for left := len(pw); left > 0; left -= 16 {
+		if left > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:left])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	encoded := make([]byte, 0, 22)
+	encode := func(val uint, chars int) {
+		for ; chars > 0; chars-- {
+			encoded = append(encoded, apr1Alphabet[val&0x3f])
+			val >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[idx[0]])<<16|uint(sum[idx[1]])<<8|uint(sum[idx[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+
+	return "$apr1$" + salt + "$" + string(encoded)
+}
+
+// checkPassword returns true if the password matches the htpasswd hash
+func checkPassword(hash string, password string) bool {
+	var expected string
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	} else if strings.HasPrefix(hash, "$apr1$") {
+		parts := strings.Split(hash, "$")
+		if len(parts) != 4 {
+			return false
+		}
+		expected = apr1Hash(password, parts[2])
+	} else {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+}
+
+// requestKey returns the API key sent with the request (or "")
+func requestKey(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	authz := req.Header.Get("Authorization")
+	if len(authz) > 7 && strings.EqualFold(authz[:7], "bearer ") {
+		return strings.TrimSpace(authz[7:])
+	}
+	return ""
+}
+
+// Authenticate returns the user for the request, or false if the request
+// has no valid credentials
+func (auth *Authenticator) Authenticate(req *http.Request) (AuthUser, bool) {
+	if key := requestKey(req); key != "" {
+		for _, one := range auth.keys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(one.Key)) == 1 {
+				return AuthUser{Name: one.Name, Role: one.Role}, true
+			}
+		}
+		return AuthUser{}, false
+	}
+
+	if name, password, ok := req.BasicAuth(); ok {
+		hash, known := auth.users[name]
+		if known && checkPassword(hash, password) {
+			role := RoleRead
+			if auth.admins[name] {
+				role = RoleAdmin
+			}
+			return AuthUser{Name: name, Role: role}, true
+		}
+	}
+	return AuthUser{}, false
+}
+
+// Wrap returns a handler that only passes authenticated requests to next
+// (with the user in the request context). If auth is nil (off), every
+// request is passed as-is
+func (auth *Authenticator) Wrap(next http.Handler) http.Handler {
+	if auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, ok := auth.Authenticate(req)
+		if !ok {
+			log.Printf("%s %s - unauthorized request from %s\n", req.Method, req.URL.Path, req.RemoteAddr)
+			if len(auth.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+auth.realm+`"`)
+			}
+			writeAPIError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Authentication required")
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), authContextKey{}, user)))
+	})
+}
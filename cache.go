@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP caching and compression for API responses. Most of our data only
+// changes when the timeline is updated or a mention arrives, so we keep a
+// store generation (bumped on every change) and the highest tweet ID seen.
+// Those make the ETag for cacheable routes: a client sending a matching
+// If-None-Match gets a 304, and we keep recent response bodies (keyed on the
+// request) until the generation changes. Responses are gzipped when the
+// client accepts it.
+//
+// Requests with times relative to now (like from=24h or window=7d) change
+// as time passes even if the data doesn't, so they're never cached
+
+// Cache settings
+const (
+	defaultCacheEntries = 256
+	gzipMinSize         = 1024 // Smaller responses aren't worth compressing
+)
+
+// StoreVersion is the thread-safe generation of our tweet data
+type StoreVersion struct {
+	gen     uint64
+	maxID   int64
+	changed time.Time // When the generation last changed
+	now     func() time.Time
+	mtx     sync.RWMutex
+}
+
+// NewStoreVersion returns generation 0 with no tweets
+func NewStoreVersion() *StoreVersion {
+	return &StoreVersion{changed: time.Now(), now: time.Now}
+}
+
+// Bump starts a new generation, noting the IDs of the given tweets (which
+// may be empty)
+func (sv *StoreVersion) Bump(tweets ...TweetRecord) {
+	sv.mtx.Lock()
+	defer sv.mtx.Unlock()
+	sv.gen++
+	sv.changed = sv.now()
+	for _, tweet := range tweets {
+		if tweet.TweetID > sv.maxID {
+			sv.maxID = tweet.TweetID
+		}
+	}
+}
+
+// Current returns the current generation and the highest tweet ID seen
+func (sv *StoreVersion) Current() (gen uint64, maxID int64) {
+	sv.mtx.RLock()
+	defer sv.mtx.RUnlock()
+	return sv.gen, sv.maxID
+}
+
+// Changed returns when the generation last changed (when we started if it
+// never has). Unlike the highest tweet ID, this moves when older tweets are
+// added
+func (sv *StoreVersion) Changed() time.Time {
+	sv.mtx.RLock()
+	defer sv.mtx.RUnlock()
+	return sv.changed
+}
+
+// storeETag returns the (weak) ETag for the given generation and highest tweet ID
+func storeETag(gen uint64, maxID int64) string {
+	return `W/"` + strconv.FormatUint(gen, 10) + "-" + strconv.FormatInt(maxID, 10) + `"`
+}
+
+// etagMatch returns true if the If-None-Match header value matches the ETag
+// (using the weak comparison, since all our ETags are weak)
+func etagMatch(ifNoneMatch string, etag string) bool {
+	for _, one := range strings.Split(ifNoneMatch, ",") {
+		one = strings.TrimSpace(one)
+		if one == "*" || strings.TrimPrefix(one, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// timeRelative returns true if the query parameters have a time relative to
+// now (see ParseTimeParam), including since: and until: in a search query
+func timeRelative(values url.Values) bool {
+	if len(values.Get("window")) > 0 {
+		return true
+	}
+	for _, name := range []string{"from", "to"} {
+		if txt := values.Get(name); len(txt) > 0 && relativeTime(txt) {
+			return true
+		}
+	}
+	if q := values.Get("q"); len(q) > 0 && searchTimeRelative(q) {
+		return true
+	}
+	return false
+}
+
+// acceptsGzip returns true if the request accepts gzip encoding
+func acceptsGzip(req *http.Request) bool {
+	for _, one := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(one, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// notModifiedSince returns true if the request has an If-Modified-Since no
+// older than lastModified (and no If-None-Match, which takes precedence)
+func notModifiedSince(req *http.Request, lastModified string) bool {
+	ims := req.Header.Get("If-Modified-Since")
+	if lastModified == "" || ims == "" || req.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	return err == nil && !modified.After(since)
+}
+
+// cachedResponse is a response body ready to send
+type cachedResponse struct {
+	gen     uint64
+	status  int
+	header  http.Header // From the handler (Content-Type, Last-Modified, ...)
+	body    []byte
+	gzipped []byte // nil if not compressed
+}
+
+// newCachedResponse builds a response, compressing the body if it's big
+// enough to bother
+func newCachedResponse(gen uint64, status int, header http.Header, body []byte) *cachedResponse {
+	resp := &cachedResponse{gen: gen, status: status, header: header, body: body}
+	if len(body) >= gzipMinSize {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err == nil && zw.Close() == nil {
+			resp.gzipped = buf.Bytes()
+		}
+	}
+	return resp
+}
+
+// write sends the response (gzipped if we can). A response with
+// Last-Modified is Not Modified for a matching If-Modified-Since
+func (resp *cachedResponse) write(w http.ResponseWriter, req *http.Request) {
+	hdr := w.Header()
+	for name, vals := range resp.header {
+		hdr[name] = append([]string(nil), vals...) // Ours to change (cached responses are shared)
+	}
+	hdr.Add("Vary", "Accept-Encoding")
+	if resp.status == http.StatusOK && notModifiedSince(req, resp.header.Get("Last-Modified")) {
+		hdr.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	body := resp.body
+	if resp.gzipped != nil && acceptsGzip(req) {
+		hdr.Set("Content-Encoding", "gzip")
+		body = resp.gzipped
+	}
+	hdr.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(resp.status)
+	w.Write(body)
+}
+
+// bufferedResponse is an http.ResponseWriter that keeps the response so we
+// can compress and cache it
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// newBufferedResponse returns an empty response
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+// Header returns the response headers
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+// WriteHeader sets the status code
+func (br *bufferedResponse) WriteHeader(status int) {
+	br.status = status
+}
+
+// Write adds to the body
+func (br *bufferedResponse) Write(b []byte) (int, error) {
+	return br.body.Write(b)
+}
+
+// ResponseCache is a thread-safe cache of API responses for the current
+// store generation
+type ResponseCache struct {
+	Version    *StoreVersion
+	maxEntries int
+	entries    map[string]*cachedResponse
+	hits       int64
+	misses     int64
+	mtx        sync.Mutex
+}
+
+// NewResponseCache returns an empty cache for the given store version holding
+// up to maxEntries responses (0 for the default)
+func NewResponseCache(version *StoreVersion, maxEntries int) *ResponseCache {
+	if maxEntries < 1 {
+		maxEntries = defaultCacheEntries
+	}
+	return &ResponseCache{
+		Version:    version,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*cachedResponse),
+	}
+}
+
+// get returns the response for the key if we have one for the generation
+func (rc *ResponseCache) get(key string, gen uint64) *cachedResponse {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	resp, ok := rc.entries[key]
+	if !ok || resp.gen != gen {
+		rc.misses++
+		return nil
+	}
+	rc.hits++
+	return resp
+}
+
+// put keeps the response, dropping responses from older generations (or
+// random responses if we're full)
+func (rc *ResponseCache) put(key string, resp *cachedResponse) {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	if len(rc.entries) >= rc.maxEntries {
+		for other, old := range rc.entries {
+			if old.gen != resp.gen {
+				delete(rc.entries, other)
+			}
+		}
+		for other := range rc.entries {
+			if len(rc.entries) < rc.maxEntries {
+				break
+			}
+			delete(rc.entries, other)
+		}
+	}
+	rc.entries[key] = resp
+}
+
+// CacheStats are the current counts for a ResponseCache
+type CacheStats struct {
+	Entries int   // Responses currently cached
+	Hits    int64 // Requests answered from the cache
+	Misses  int64 // Cacheable requests we had to build a response for
+}
+
+// Stats returns the current counts
+func (rc *ResponseCache) Stats() CacheStats {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return CacheStats{Entries: len(rc.entries), Hits: rc.hits, Misses: rc.misses}
+}
+
+// serveAPI calls the handler for the request, compressing the response and
+// (if cacheable and rc isn't nil) handling ETags and caching it. Only OK
+// responses get an ETag
+func (rc *ResponseCache) serveAPI(w http.ResponseWriter, req *http.Request, cacheable bool, handler func(http.ResponseWriter)) {
+	cacheable = cacheable && rc != nil && !timeRelative(req.URL.Query())
+
+	var gen uint64
+	var key, etag string
+	if cacheable {
+		var maxID int64
+		gen, maxID = rc.Version.Current()
+		etag = storeETag(gen, maxID)
+		if inm := req.Header.Get("If-None-Match"); inm != "" && etagMatch(inm, etag) {
+			hdr := w.Header()
+			hdr.Set("ETag", etag)
+			hdr.Set("Cache-Control", "no-cache")
+			hdr.Add("Vary", "Accept-Encoding")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		key = req.Host + req.URL.Path + "?" + req.URL.RawQuery // Feeds link to the host
+		if resp := rc.get(key, gen); resp != nil {
+			resp.write(w, req)
+			return
+		}
+	}
+
+	buf := newBufferedResponse()
+	handler(buf)
+	if cacheable && buf.status == http.StatusOK {
+		buf.header.Set("ETag", etag)
+		buf.header.Set("Cache-Control", "no-cache")
+	}
+	resp := newCachedResponse(gen, buf.status, buf.header, buf.body.Bytes())
+	if cacheable && buf.status == http.StatusOK {
+		rc.put(key, resp)
+	}
+	resp.write(w, req)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	version := NewStoreVersion()
+	gen, maxID := version.Current()
+	assert.Equal(uint64(0), gen)
+	assert.Equal(int64(0), maxID)
+	assert.False(version.Changed().IsZero())
+
+	now := time.Date(2016, 10, 9, 15, 0, 0, 0, time.UTC)
+	version.now = func() time.Time { return now }
+	version.Bump(TweetRecord{TweetID: 5}, TweetRecord{TweetID: 3})
+	assert.Equal(now, version.Changed())
+	now = now.Add(time.Minute)
+	version.Bump(TweetRecord{TweetID: 4}) // Older tweets still change the data
+	gen, maxID = version.Current()
+	assert.Equal(uint64(2), gen)
+	assert.Equal(int64(5), maxID)
+	assert.Equal(now, version.Changed())
+	assert.Equal(`W/"2-5"`, storeETag(gen, maxID))
+
+	assert.True(etagMatch(`W/"2-5"`, `W/"2-5"`))
+	assert.True(etagMatch(`"2-5"`, `W/"2-5"`))
+	assert.True(etagMatch(`W/"1-4", W/"2-5"`, `W/"2-5"`))
+	assert.True(etagMatch("*", `W/"2-5"`))
+	assert.False(etagMatch(`W/"1-5"`, `W/"2-5"`))
+}
+
+func TestCacheHelpers(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(timeRelative(url.Values{}))
+	assert.False(timeRelative(url.Values{"from": {"2016-10-09"}, "to": {"1476000000"}}))
+	assert.True(timeRelative(url.Values{"from": {"24h"}}))
+	assert.True(timeRelative(url.Values{"to": {"7d"}}))
+	assert.True(timeRelative(url.Values{"window": {"1h"}}))
+	assert.True(timeRelative(url.Values{"q": {"vote since:24h"}}))
+	assert.True(timeRelative(url.Values{"q": {"(vote OR until:7d)"}}))
+	assert.False(timeRelative(url.Values{"q": {"vote since:2016-10-09 24h"}}))
+
+	accepts := func(enc string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", enc)
+		return acceptsGzip(req)
+	}
+	assert.True(accepts("gzip"))
+	assert.True(accepts("deflate, gzip;q=0.5"))
+	assert.False(accepts(""))
+	assert.False(accepts("deflate"))
+	assert.False(accepts("gzip;q=0"))
+}
+
+func TestResponseCache(t *testing.T) {
+	assert := assert.New(t)
+
+	version := NewStoreVersion()
+	version.Bump(TweetRecord{TweetID: 10})
+	big := strings.Repeat("tweet ", gzipMinSize)
+	calls := 0
+
+	api := NewAPIRouter()
+	api.Cache = NewResponseCache(version, 2)
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/cached",
+		Cache:   true,
+		Summary: "Cached",
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			calls++
+			if req.URL.Query().Get("missing") != "" {
+				notFound(w, "Missing")
+				return
+			}
+			jsonResponse(w, req, big)
+		},
+	})
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/uncached",
+		Summary: "Not cached",
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			calls++
+			jsonResponse(w, req, "small")
+		},
+	})
+
+	call := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, val := range headers {
+			req.Header.Set(name, val)
+		}
+		resp := httptest.NewRecorder()
+		api.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Compressed when asked for
+	resp := call("/cached", map[string]string{"Accept-Encoding": "gzip"})
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal(1, calls)
+	assert.Equal(`W/"1-10"`, resp.Header().Get("ETag"))
+	assert.Equal("gzip", resp.Header().Get("Content-Encoding"))
+	assert.Equal("application/json", resp.Header().Get("Content-Type"))
+	assert.True(resp.Body.Len() < len(big))
+	zr, err := gzip.NewReader(bytes.NewReader(resp.Body.Bytes()))
+	assert.NoError(err)
+	unzipped, err := ioutil.ReadAll(zr)
+	assert.NoError(err)
+	assert.Equal(`"`+big+`"`, string(unzipped))
+
+	// Served from the cache (uncompressed when not asked for)
+	resp = call("/cached", nil)
+	assert.Equal(1, calls)
+	assert.Equal("", resp.Header().Get("Content-Encoding"))
+	assert.Equal(`"`+big+`"`, resp.Body.String())
+	assert.Equal(CacheStats{Entries: 1, Hits: 1, Misses: 1}, api.Cache.Stats())
+
+	// Not modified
+	resp = call("/cached", map[string]string{"If-None-Match": `W/"1-10"`})
+	assert.Equal(http.StatusNotModified, resp.Code)
+	assert.Equal(0, resp.Body.Len())
+	assert.Equal(1, calls)
+
+	// New data means a new ETag and a new response
+	version.Bump(TweetRecord{TweetID: 11})
+	resp = call("/cached", map[string]string{"If-None-Match": `W/"1-10"`})
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal(`W/"2-11"`, resp.Header().Get("ETag"))
+	assert.Equal(2, calls)
+
+	// Different queries are cached separately, but relative times aren't cached
+	call("/cached?a=1", nil)
+	call("/cached?a=1", nil)
+	assert.Equal(3, calls)
+	resp = call("/cached?from=24h", nil)
+	assert.Equal("", resp.Header().Get("ETag"))
+	call("/cached?from=24h", nil)
+	assert.Equal(5, calls)
+	call("/cached?b=1", nil)
+	assert.Equal(2, api.Cache.Stats().Entries)
+
+	// Errors don't get an ETag (and aren't cached)
+	resp = call("/cached?missing=1", nil)
+	assert.Equal(http.StatusNotFound, resp.Code)
+	assert.Equal("", resp.Header().Get("ETag"))
+	call("/cached?missing=1", nil)
+	assert.Equal(8, calls)
+
+	// Routes without Cache are never cached (and small responses are never compressed)
+	resp = call("/uncached", map[string]string{"Accept-Encoding": "gzip"})
+	call("/uncached", nil)
+	assert.Equal(10, calls)
+	assert.Equal("", resp.Header().Get("ETag"))
+	assert.Equal("", resp.Header().Get("Content-Encoding"))
+	assert.Equal(`"small"`, resp.Body.String())
+
+	// Responses get their own copy of the cached headers to add to
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/vary",
+		Cache:   true,
+		Summary: "Varies",
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Add("Vary", "Cookie")
+			w.Header().Add("Vary", "Authorization") // Leaves room to append in place
+			jsonResponse(w, req, "vary")
+		},
+	})
+	call("/vary", nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			call("/vary", nil)
+		}()
+	}
+	wg.Wait()
+	resp = call("/vary", nil)
+	assert.Equal([]string{"Origin", "Cookie", "Authorization", "Accept-Encoding"}, resp.Header()["Vary"])
+	assert.Equal([]string{"Origin", "Cookie", "Authorization"}, api.Cache.entries["example.com/vary?"].header["Vary"])
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The classifier labels tweets with named categories from a JSON config file
+// like:
+//
+//     {"Categories": [
+//         {"Name": "lefty", "Regex": ["(?i)clinton", "(?i)kaine"]},
+//         {"Name": "righty", "Keywords": ["trump", "pence"], "Hashtags": ["#maga"],
+//          "Accounts": ["@realDonaldTrump", "@mike_pence"]}
+//     ]}
+//
+// A tweet is in a category if ANY of the category's rules match:
+//
+// - Regex: the regular expression matches the text (use (?i) for case
+//   insensitive matching)
+// - Keywords: the keyword (or all words of a phrase) appear in the text,
+//   using the same rules as the stream's track matching
+// - Hashtags: the tweet uses the hashtag (ignoring case)
+// - Accounts: the tweet is by or mentions the account (ignoring case)
+//
+// An account itself is in a category if it's one of the category's Accounts
+// or one of the Regex rules matches the account name (so the example config
+// in categories.example.json labels @timkaine lefty).
+
+// CategoryConfig is the configuration for a single category
+type CategoryConfig struct {
+	Name     string
+	Regex    []string
+	Keywords []string
+	Hashtags []string
+	Accounts []string
+}
+
+// ClassifierConfig is the top level of a classifier config file
+type ClassifierConfig struct {
+	Categories []CategoryConfig
+}
+
+// category is a single compiled category
+type category struct {
+	name     string
+	regex    []*regexp.Regexp
+	keywords *TrackMatcher
+	hashtags map[string]bool // normHashtag form
+	accounts map[string]bool // graphNodeID form
+}
+
+// Classifier labels tweet records with categories. It is safe for
+// concurrent use since it's never changed after creation
+type Classifier struct {
+	categories []category
+}
+
+// ReadClassifierConfig reads the classifier config file. An empty file name
+// is a config with no categories
+func ReadClassifierConfig(filename string) (ClassifierConfig, error) {
+	config := ClassifierConfig{}
+	if filename == "" {
+		return config, nil
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return config, fmt.Errorf("Invalid classifier config %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+// NewClassifier compiles the categories in the config
+func NewClassifier(config ClassifierConfig) (*Classifier, error) {
+	cl := &Classifier{categories: make([]category, 0, len(config.Categories))}
+	seen := NewUniqueStrings()
+
+	for _, cc := range config.Categories {
+		name := strings.TrimSpace(cc.Name)
+		if name == "" {
+			return nil, fmt.Errorf("Every category needs a name")
+		}
+		if seen.Seen[name] {
+			return nil, fmt.Errorf("Duplicate category %s", name)
+		}
+		seen.Add(name)
+
+		cat := category{
+			name:     name,
+			regex:    make([]*regexp.Regexp, 0, len(cc.Regex)),
+			keywords: NewTrackMatcher(cc.Keywords),
+			hashtags: make(map[string]bool),
+			accounts: make(map[string]bool),
+		}
+		for _, expr := range cc.Regex {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("Category %s: invalid regex %s: %v", name, expr, err)
+			}
+			cat.regex = append(cat.regex, re)
+		}
+		for _, tag := range cc.Hashtags {
+			cat.hashtags[normHashtag(tag)] = true
+		}
+		for _, acct := range cc.Accounts {
+			cat.accounts[graphNodeID(acct)] = true
+		}
+
+		cl.categories = append(cl.categories, cat)
+	}
+
+	return cl, nil
+}
+
+// Names returns the category names in config order
+func (cl *Classifier) Names() []string {
+	names := make([]string, 0, len(cl.categories))
+	for _, cat := range cl.categories {
+		names = append(names, cat.name)
+	}
+	return names
+}
+
+// matches returns true if any rule in the category matches the record
+func (cat category) matches(rec TweetRecord, tokens map[string]bool) bool {
+	if cat.accounts[graphNodeID(rec.UserScreenName)] {
+		return true
+	}
+	for _, mention := range rec.Mentions {
+		if cat.accounts[graphNodeID(mention)] {
+			return true
+		}
+	}
+	for _, tag := range rec.Hashtags {
+		if cat.hashtags[normHashtag(tag)] {
+			return true
+		}
+	}
+	for _, re := range cat.regex {
+		if re.MatchString(rec.Text) {
+			return true
+		}
+	}
+	return len(cat.keywords.matchTokens(tokens)) > 0
+}
+
+// Classify returns the (sorted) categories for the record. A nil
+// classifier has no categories
+func (cl *Classifier) Classify(rec TweetRecord) []string {
+	if cl == nil || len(cl.categories) < 1 {
+		return nil
+	}
+
+	tokens := make(map[string]bool)
+	addTokens(tokens, rec.Text)
+
+	found := make([]string, 0, 2)
+	for _, cat := range cl.categories {
+		if cat.matches(rec, tokens) {
+			found = append(found, cat.name)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// Label sets the categories for every record in the list (in place)
+func (cl *Classifier) Label(tweets TweetRecordList) {
+	if cl == nil {
+		return
+	}
+	for i := range tweets {
+		tweets[i].Categories = cl.Classify(tweets[i])
+	}
+}
+
+// ClassifyAcct returns the (sorted) categories whose Accounts rules include
+// the given account or whose Regex rules match the account name
+func (cl *Classifier) ClassifyAcct(acct string) []string {
+	found := make([]string, 0, 1)
+	if cl == nil {
+		return found
+	}
+	id := graphNodeID(acct)
+	name := strings.TrimPrefix(strings.TrimSpace(acct), "@")
+	for _, cat := range cl.categories {
+		matched := cat.accounts[id]
+		for _, re := range cat.regex {
+			matched = matched || re.MatchString(name)
+		}
+		if matched {
+			found = append(found, cat.name)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// CountCategories returns the number of records in each category
+func CountCategories(tweets TweetRecordList) map[string]int {
+	counts := make(map[string]int)
+	for _, tweet := range tweets {
+		for _, cat := range tweet.Categories {
+			counts[cat]++
+		}
+	}
+	return counts
+}
+
+// CategoryCounter keeps thread-safe category counts (for streamed mentions)
+type CategoryCounter struct {
+	counts map[string]int
+	mtx    sync.RWMutex
+}
+
+// NewCategoryCounter returns a counter with no counts
+func NewCategoryCounter() *CategoryCounter {
+	return &CategoryCounter{counts: make(map[string]int)}
+}
+
+// Add counts the categories of the record
+func (cc *CategoryCounter) Add(rec TweetRecord) {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	for _, cat := range rec.Categories {
+		cc.counts[cat]++
+	}
+}
+
+// Counts returns a copy of the current counts
+func (cc *CategoryCounter) Counts() map[string]int {
+	cc.mtx.RLock()
+	defer cc.mtx.RUnlock()
+	counts := make(map[string]int)
+	for cat, cnt := range cc.counts {
+		counts[cat] = cnt
+	}
+	return counts
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testClassifier(t *testing.T) *Classifier {
+	cl, err := NewClassifier(ClassifierConfig{Categories: []CategoryConfig{
+		{Name: "lefty", Regex: []string{"(?i)clinton", "(?i)kaine"}, Accounts: []string{"HillaryClinton"}},
+		{Name: "righty", Keywords: []string{"trump", "mike pence"}, Hashtags: []string{"#MAGA"}, Accounts: []string{"@realDonaldTrump"}},
+	}})
+	assert.NoError(t, err)
+	return cl
+}
+
+func TestClassifierConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := ReadClassifierConfig("")
+	assert.NoError(err)
+	assert.Len(config.Categories, 0)
+
+	config, err = ReadClassifierConfig("categories.example.json")
+	assert.NoError(err)
+	cl, err := NewClassifier(config)
+	assert.NoError(err)
+	assert.Equal([]string{"lefty", "righty"}, cl.Names())
+
+	_, err = ReadClassifierConfig("does-not-exist.json")
+	assert.Error(err)
+
+	tmp, err := ioutil.TempFile("", "twivility-classifier")
+	assert.NoError(err)
+	defer os.Remove(tmp.Name())
+	tmp.WriteString("{not json")
+	tmp.Close()
+	_, err = ReadClassifierConfig(tmp.Name())
+	assert.Error(err)
+
+	_, err = NewClassifier(ClassifierConfig{Categories: []CategoryConfig{{Name: " "}}})
+	assert.Error(err)
+	_, err = NewClassifier(ClassifierConfig{Categories: []CategoryConfig{{Name: "a"}, {Name: "a"}}})
+	assert.Error(err)
+	_, err = NewClassifier(ClassifierConfig{Categories: []CategoryConfig{{Name: "a", Regex: []string{"("}}}})
+	assert.Error(err)
+}
+
+func TestClassify(t *testing.T) {
+	assert := assert.New(t)
+	cl := testClassifier(t)
+
+	assert.Equal([]string{"lefty"}, cl.Classify(TweetRecord{Text: "Go CLINTON"}))
+	assert.Equal([]string{"lefty"}, cl.Classify(TweetRecord{Text: "hi", UserScreenName: "hillaryclinton"}))
+	assert.Equal([]string{"righty"}, cl.Classify(TweetRecord{Text: "Trump!"}))
+	assert.Equal([]string{"righty"}, cl.Classify(TweetRecord{Text: "hi", Hashtags: []string{"maga"}}))
+	assert.Equal([]string{"righty"}, cl.Classify(TweetRecord{Text: "hi", Mentions: []string{"RealDonaldTrump"}}))
+	assert.Equal([]string{"righty"}, cl.Classify(TweetRecord{Text: "Pence, Mike said"}))
+	assert.Equal([]string{"lefty", "righty"}, cl.Classify(TweetRecord{Text: "Kaine vs trump"}))
+
+	// Keywords are words, not substrings
+	assert.Len(cl.Classify(TweetRecord{Text: "trumpet solo"}), 0)
+	assert.Len(cl.Classify(TweetRecord{Text: "nothing here"}), 0)
+
+	// No classifier means no categories
+	var none *Classifier
+	assert.Nil(none.Classify(TweetRecord{Text: "clinton"}))
+	assert.Equal([]string{}, none.ClassifyAcct("HillaryClinton"))
+
+	assert.Equal([]string{"lefty"}, cl.ClassifyAcct("@hillaryclinton"))
+	assert.Equal([]string{"righty"}, cl.ClassifyAcct("realDonaldTrump"))
+	assert.Equal([]string{"lefty"}, cl.ClassifyAcct("timkaine")) // Regex on the name
+	assert.Equal([]string{}, cl.ClassifyAcct("mike_pence"))      // Keywords are only for text
+}
+
+func TestCategoryCounts(t *testing.T) {
+	assert := assert.New(t)
+	cl := testClassifier(t)
+
+	tweets := TweetRecordList{
+		{TweetID: 1, Text: "clinton"},
+		{TweetID: 2, Text: "trump"},
+		{TweetID: 3, Text: "clinton and trump"},
+		{TweetID: 4, Text: "neither"},
+	}
+	cl.Label(tweets)
+	assert.Equal([]string{"lefty", "righty"}, tweets[2].Categories)
+	assert.Len(tweets[3].Categories, 0)
+	assert.Equal(map[string]int{"lefty": 2, "righty": 2}, CountCategories(tweets))
+
+	counter := NewCategoryCounter()
+	for _, tweet := range tweets[:2] {
+		counter.Add(tweet)
+	}
+	counts := counter.Counts()
+	assert.Equal(map[string]int{"lefty": 1, "righty": 1}, counts)
+	counts["lefty"] = 100
+	assert.Equal(1, counter.Counts()["lefty"])
+}
@@ -43,6 +43,7 @@
         return false;
     }
 
+    // Our original account coloring, for when the server has no categories
     var leftChecks = [
         /clinton/i,
         /kaine/i
@@ -71,10 +72,13 @@
 
 // Actual twivility work
 (function(t){
-    // Get all tweets and call callback with them. Return the Future used for
-    // the server query
-    function getSingleAcct(acct, callback) {
-        $.get("/api/tweets/" + acct)
+    // Get a page of tweets and call callback with the server's result: the
+    // tweets (in Tweets, newest first), the paging info (Total and NextMaxID),
+    // and the categories assigned by the server's classifier (AcctCategories
+    // for the account, Categories for counts per category). params are the
+    // optional query parameters (like limit and max_id)
+    function getSingleAcct(acct, callback, params) {
+        $.get("/api/v1/tweets/" + acct, params || {})
             .done(function(data) {
                 if (!!callback) {
                     callback(data);
@@ -86,24 +90,24 @@
             });
     }
 
-    // Get all accts, get a all tweets per acct, and then call acctCallback
-    // with acct, tweetlist
-    function getAllAccts(acctCallback, finishedCallback) {
+    // Get all accts, get a page of tweets per acct, and then call acctCallback
+    // with acct, result (see getSingleAcct)
+    function getAllAccts(acctCallback, finishedCallback, params) {
         var count = 0;
 
-        return $.get("/api/accts")
+        return $.get("/api/v1/accts")
             .done(function(data) {
                 _.each(data, function(acct){
                     count += 1;
-                    getSingleAcct(acct, function(tweets){
+                    getSingleAcct(acct, function(result){
                         if (!!acctCallback) {
-                            acctCallback(acct, tweets);
+                            acctCallback(acct, result);
                         }
                         count -= 1;
                         if (count < 1 && !!finishedCallback) {
                             finishedCallback();
                         }
-                    });
+                    }, params);
                 });
             })
             .fail(function(e) {
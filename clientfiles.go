@@ -0,0 +1,53 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// The HTML5 client in ./client is compiled into the binary, so the service
+// works from any directory. Front-end developers can serve the files from
+// disk instead (see the -client-dir flag) and see changes without a rebuild
+
+//go:embed client
+var embeddedClient embed.FS
+
+// ClientFiles returns the client assets: the files in dir if it's given,
+// otherwise the copy compiled into the binary
+func ClientFiles(dir string) (http.FileSystem, error) {
+	if dir == "" {
+		files, err := fs.Sub(embeddedClient, "client")
+		if err != nil {
+			return nil, err
+		}
+		return http.FS(files), nil
+	}
+
+	// Catch a bad directory now rather than on the first request
+	if _, err := os.Stat(filepath.Join(dir, "main.html")); err != nil {
+		return nil, errors.New("Client directory " + dir + " has no main.html")
+	}
+	return http.Dir(dir), nil
+}
+
+// serveClientFile writes the named client file (like http.ServeFile, but
+// from our client files)
+func serveClientFile(w http.ResponseWriter, req *http.Request, files http.FileSystem, name string) {
+	file, err := files.Open(name)
+	if err != nil {
+		http.Error(w, "Missing client file "+name, http.StatusNotFound)
+		return
+	}
+	defer SafeClose(file)
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, req, info.Name(), info.ModTime(), file)
+}
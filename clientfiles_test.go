@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	serve := func(files http.FileSystem, name string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		serveClientFile(resp, httptest.NewRequest(http.MethodGet, "/", nil), files, name)
+		return resp
+	}
+
+	// Embedded: the same files as on disk
+	embedded, err := ClientFiles("")
+	assert.NoError(err)
+	for _, name := range []string{"main.html", "api-default.html", "twivility.js"} {
+		onDisk, err := ioutil.ReadFile(filepath.Join("client", name))
+		pcheck(err)
+		resp := serve(embedded, name)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal(string(onDisk), resp.Body.String())
+	}
+	assert.Equal("text/html; charset=utf-8", serve(embedded, "main.html").Header().Get("Content-Type"))
+	assert.Equal(http.StatusNotFound, serve(embedded, "nope.html").Code)
+
+	// From a directory
+	dir, err := ioutil.TempDir("", "twivility-client")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+
+	_, err = ClientFiles(dir)
+	assert.Error(err)
+	_, err = ClientFiles(filepath.Join(dir, "missing"))
+	assert.Error(err)
+
+	pcheck(ioutil.WriteFile(filepath.Join(dir, "main.html"), []byte("<p>live</p>"), 0600))
+	live, err := ClientFiles(dir)
+	assert.NoError(err)
+	assert.Equal("<p>live</p>", serve(live, "main.html").Body.String())
+
+	// The file server works with both
+	for _, files := range []http.FileSystem{embedded, live} {
+		resp := httptest.NewRecorder()
+		http.StripPrefix("/client/", http.FileServer(files)).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/client/main.html", nil))
+		assert.NotEqual(http.StatusNotFound, resp.Code)
+	}
+}
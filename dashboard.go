@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The dashboard is a set of server-rendered HTML pages (served at /dash/)
+// built from the same data as the API. They need no JavaScript: filters are
+// plain GET forms, paging is links, and the live mentions page refreshes
+// itself. The templates are in client/templates (so -client-dir works for
+// them too)
+
+// dashboardTemplates are the template files we parse. layout.html defines
+// the "header" and "footer" templates used by the pages
+var dashboardTemplates = []string{"layout.html", "overview.html", "acct.html", "hashtag.html", "mentions.html"}
+
+// Page sizes and refresh time for the dashboard
+const (
+	dashTweetsLimit   = 50
+	dashSearchLimit   = 100
+	dashRecentLimit   = 50
+	dashRefreshSecs   = 30
+	dashOverviewItems = 10
+)
+
+// Dashboard serves the HTML pages. Every field must be set before serving
+type Dashboard struct {
+	Service    *TwivilityService
+	Mentions   *TwitterMentions
+	Recent     *RecentMentions
+	Trends     *HashtagTrends
+	Search     *SearchIndex
+	LastUpdate func() time.Time
+	Metrics    *Metrics // Requests are counted and timed here (if set)
+
+	files     http.FileSystem
+	live      bool // Reparse the templates for every page
+	templates *template.Template
+}
+
+// NewDashboard returns a dashboard using the templates in the client files.
+// If live is true the templates are reparsed for every page (for working on
+// them with -client-dir)
+func NewDashboard(files http.FileSystem, live bool) (*Dashboard, error) {
+	dash := &Dashboard{files: files, live: live}
+	templates, err := dash.parseTemplates()
+	if err != nil {
+		return nil, err
+	}
+	dash.templates = templates
+	return dash, nil
+}
+
+// dashboardFuncs are the functions available to our templates
+var dashboardFuncs = template.FuncMap{
+	"linkify":    linkifyTweet,
+	"acctName":   dashAcctName,
+	"acctURL":    dashAcctURL,
+	"hashtagURL": dashHashtagURL,
+	"tweetURL":   tweetURL,
+	"when":       tweetWhen,
+	"percent":    dashPercent,
+}
+
+// parseTemplates reads and parses all of our templates
+func (dash *Dashboard) parseTemplates() (*template.Template, error) {
+	templates := template.New("dashboard").Funcs(dashboardFuncs)
+	for _, name := range dashboardTemplates {
+		file, err := dash.files.Open("templates/" + name)
+		if err != nil {
+			return nil, errors.New("Missing dashboard template " + name)
+		}
+		buf, err := ioutil.ReadAll(file)
+		SafeClose(file)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := templates.New(name).Parse(string(buf)); err != nil {
+			return nil, err
+		}
+	}
+	return templates, nil
+}
+
+// linkMatch finds the things we link in tweet text: URL's, hashtags, and
+// mentions
+var linkMatch = regexp.MustCompile(`https?://[^\s<>"]+|[#@]\w+`)
+
+// linkifyTweet returns the tweet text as HTML with URL's, hashtags, and
+// mentions turned into links. Hashtags and mentions link to our own pages.
+// Twitter sends text with &, <, and > escaped, so we unescape it first:
+// everything is escaped again here
+func linkifyTweet(txt string) template.HTML {
+	return linkifyTweetAt(txt, "")
+}
+
+// linkifyTweetAt is linkifyTweet with our own pages under base (like
+// "https://example.com"), for HTML shown somewhere else (like a feed reader)
+func linkifyTweetAt(txt string, base string) template.HTML {
+	txt = html.UnescapeString(txt)
+
+	var buf bytes.Buffer
+	last := 0
+	for _, loc := range linkMatch.FindAllStringIndex(txt, -1) {
+		start, end := loc[0], loc[1]
+		word := txt[start:end]
+
+		// Something like an email address isn't a mention
+		if start > 0 && word[0] != 'h' {
+			prev, _ := utf8.DecodeLastRuneInString(txt[:start])
+			if prev == '_' || unicode.IsLetter(prev) || unicode.IsDigit(prev) {
+				continue
+			}
+		}
+
+		buf.WriteString(html.EscapeString(txt[last:start]))
+		var href string
+		switch word[0] {
+		case '#':
+			href = base + dashHashtagURL(word)
+		case '@':
+			href = base + dashAcctURL(word)
+		default:
+			// Trailing punctuation is almost always the sentence, not the URL
+			trimmed := strings.TrimRight(word, ".,;:!?)'")
+			end -= len(word) - len(trimmed)
+			word = trimmed
+			href = word
+		}
+		buf.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(word) + `</a>`)
+		last = end
+	}
+	buf.WriteString(html.EscapeString(txt[last:]))
+
+	return template.HTML(buf.String())
+}
+
+// dashAcctName is the account for display (always with the @)
+func dashAcctName(acct string) string {
+	return "@" + strings.TrimPrefix(acct, "@")
+}
+
+// dashAcctURL is the dashboard page for an account
+func dashAcctURL(acct string) string {
+	return "/dash/acct/" + url.PathEscape(strings.TrimPrefix(acct, "@"))
+}
+
+// dashHashtagURL is the dashboard page for a hashtag
+func dashHashtagURL(tag string) string {
+	return "/dash/hashtag/" + url.PathEscape(strings.TrimPrefix(tag, "#"))
+}
+
+// tweetURL is the tweet on Twitter
+func tweetURL(tweet TweetRecord) string {
+	return "https://twitter.com/" + url.PathEscape(strings.TrimPrefix(tweet.UserScreenName, "@")) +
+		"/status/" + strconv.FormatInt(tweet.TweetID, 10)
+}
+
+// tweetWhen is when the tweet was created, for display
+func tweetWhen(tweet TweetRecord) string {
+	created := tweet.Created()
+	if created.IsZero() {
+		return tweet.Timestamp
+	}
+	return created.Format("2006-01-02 15:04 MST")
+}
+
+// dashPercent formats a fraction as a percentage
+func dashPercent(frac float64) string {
+	return strconv.FormatFloat(frac*100, 'f', 0, 64) + "%"
+}
+
+// render writes the named template with the given data. The page is built
+// in full first, so a template error is a clean 500
+func (dash *Dashboard) render(w http.ResponseWriter, req *http.Request, name string, data interface{}) {
+	templates := dash.templates
+	if dash.live {
+		var err error
+		if templates, err = dash.parseTemplates(); err != nil {
+			log.Printf("GET %s - could not parse dashboard templates: %v\n", req.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("GET %s - could not render %s: %v\n", req.URL.Path, name, err)
+		http.Error(w, "Could not render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// ServeHTTP serves the dashboard pages. The request path must already be
+// relative to the dashboard root (see http.StripPrefix)
+func (dash *Dashboard) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	started := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	route := dash.serve(sw, req)
+	dash.Metrics.ObserveRequest(route, req.Method, sw.status, time.Since(started))
+}
+
+// serve renders the page, returning the route pattern matched (or
+// unmatchedRoute)
+func (dash *Dashboard) serve(w http.ResponseWriter, req *http.Request) string {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method "+req.Method+" not allowed", http.StatusMethodNotAllowed)
+		return unmatchedRoute
+	}
+
+	segments := splitAPIPath(req.URL.Path)
+	switch {
+	case len(segments) == 0:
+		dash.overview(w, req)
+		return "/dash/"
+	case len(segments) == 2 && segments[0] == "acct":
+		dash.acct(w, req, segments[1])
+		return "/dash/acct/{acct}"
+	case len(segments) == 2 && segments[0] == "hashtag":
+		dash.hashtag(w, req, segments[1])
+		return "/dash/hashtag/{tag}"
+	case len(segments) == 1 && segments[0] == "mentions":
+		dash.mentions(w, req)
+		return "/dash/mentions"
+	}
+	http.Error(w, "Unknown page "+req.URL.Path, http.StatusNotFound)
+	return unmatchedRoute
+}
+
+// dashPage is what every page has (for the layout)
+type dashPage struct {
+	Title   string
+	Refresh int // Seconds before the page reloads itself (0 for never)
+}
+
+// overviewPage is the data for the overview page
+type overviewPage struct {
+	dashPage
+	LastUpdate   string
+	MentionCount int64
+	Health       HealthStats
+	Accts        []NameCount // Stored tweets per account, most first
+	Trends       []TrendWindow
+	Recent       TweetRecordList
+}
+
+func (dash *Dashboard) overview(w http.ResponseWriter, req *http.Request) {
+	page := overviewPage{
+		dashPage:     dashPage{Title: "Overview"},
+		LastUpdate:   fmtTime(dash.LastUpdate()),
+		MentionCount: dash.Mentions.Count(),
+		Health:       dash.Mentions.Health.Stats(),
+		Recent:       dash.Recent.Query(RecentQuery{Limit: dashOverviewItems}),
+	}
+
+	counts := make(map[string]int)
+	for _, acct := range dash.Service.GetAccounts() {
+		counts[acct] = dash.Service.GetTweets(acct).Len()
+	}
+	page.Accts = topCounts(counts, len(counts))
+
+	trends, err := dash.Trends.Top(TrendQuery{Limit: dashOverviewItems})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Trends = trends
+
+	log.Printf("GET %s - dashboard overview\n", req.URL.Path)
+	dash.render(w, req, "overview.html", page)
+}
+
+// acctPage is the data for an account page
+type acctPage struct {
+	dashPage
+	Acct     string
+	Profile  AcctProfile
+	Hours    []int // Heatmap column labels
+	Timeline TweetsPage
+	Query    url.Values // The current filters (for the form)
+	NextURL  string     // The next (older) page of the timeline ("" if none)
+}
+
+func (dash *Dashboard) acct(w http.ResponseWriter, req *http.Request, name string) {
+	acct := ""
+	for _, known := range dash.Service.GetAccounts() {
+		if strings.EqualFold(strings.TrimPrefix(known, "@"), strings.TrimPrefix(name, "@")) {
+			acct = known
+		}
+	}
+	if acct == "" {
+		http.Error(w, "Unknown account "+name, http.StatusNotFound)
+		return
+	}
+
+	values := req.URL.Query()
+	now := time.Now()
+	profileQuery, err := ParseProfileQuery(url.Values{"tz": values["tz"]}, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tweetsQuery, err := ParseTweetsQuery(values, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if values.Get("limit") == "" {
+		tweetsQuery.Limit = dashTweetsLimit
+	}
+
+	tweets := dash.Service.GetTweets(acct)
+	page := acctPage{
+		dashPage: dashPage{Title: acct},
+		Acct:     acct,
+		Profile:  BuildAcctProfile(acct, tweets, profileQuery),
+		Hours:    make([]int, 24),
+		Timeline: tweetsQuery.Page(tweets),
+		Query:    values,
+	}
+	for hour := range page.Hours {
+		page.Hours[hour] = hour
+	}
+	if page.Timeline.NextMaxID > 0 {
+		next := url.Values{}
+		for key, vals := range values {
+			next[key] = vals
+		}
+		next.Set("max_id", strconv.FormatInt(page.Timeline.NextMaxID, 10))
+		page.NextURL = dashAcctURL(acct) + "?" + next.Encode()
+	}
+
+	log.Printf("GET %s - dashboard for acct %s with %d of %d tweets\n", req.URL.Path, acct, len(page.Timeline.Tweets), page.Timeline.Total)
+	dash.render(w, req, "acct.html", page)
+}
+
+// hashtagWindow is a hashtag's use in a single trend window
+type hashtagWindow struct {
+	Window    string
+	Count     int
+	PrevCount int
+}
+
+// hashtagPage is the data for a hashtag page
+type hashtagPage struct {
+	dashPage
+	Hashtag string
+	Windows []hashtagWindow
+	Total   int // Stored tweets and mentions using the hashtag
+	Hits    []SearchHit
+}
+
+func (dash *Dashboard) hashtag(w http.ResponseWriter, req *http.Request, name string) {
+	tag := "#" + strings.TrimPrefix(strings.TrimSpace(name), "#")
+	if fieldValue(tag) == "" || strings.ContainsAny(tag, " \t\n") {
+		http.Error(w, "Invalid hashtag "+name, http.StatusBadRequest)
+		return
+	}
+
+	result, err := dash.Search.Search(SearchQuery{Query: "tag:" + tag, Limit: dashSearchLimit})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Every hit scores the same: newest first
+	sort.SliceStable(result.Hits, func(i, j int) bool {
+		return result.Hits[i].Tweet.TweetID > result.Hits[j].Tweet.TweetID
+	})
+
+	trends, err := dash.Trends.Top(TrendQuery{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := hashtagPage{
+		dashPage: dashPage{Title: tag},
+		Hashtag:  tag,
+		Windows:  make([]hashtagWindow, 0, len(trends)),
+		Total:    result.Total,
+		Hits:     result.Hits,
+	}
+	for _, trend := range trends {
+		one := hashtagWindow{Window: trend.Window}
+		for _, counted := range trend.Hashtags {
+			if counted.Hashtag == strings.ToLower(tag) {
+				one.Count = counted.Count
+				one.PrevCount = counted.PrevCount
+			}
+		}
+		page.Windows = append(page.Windows, one)
+	}
+
+	log.Printf("GET %s - dashboard for hashtag %s with %d tweets\n", req.URL.Path, tag, result.Total)
+	dash.render(w, req, "hashtag.html", page)
+}
+
+// mentionsPage is the data for the live mentions page
+type mentionsPage struct {
+	dashPage
+	Acct     string
+	Hashtag  string
+	Health   HealthStats
+	Mentions TweetRecordList
+}
+
+func (dash *Dashboard) mentions(w http.ResponseWriter, req *http.Request) {
+	query, err := ParseRecentQuery(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Limit < 1 {
+		query.Limit = dashRecentLimit
+	}
+
+	page := mentionsPage{
+		dashPage: dashPage{Title: "Live mentions", Refresh: dashRefreshSecs},
+		Acct:     query.Acct,
+		Hashtag:  query.Hashtag,
+		Health:   dash.Mentions.Health.Stats(),
+		Mentions: dash.Recent.Query(query),
+	}
+
+	log.Printf("GET %s - dashboard with %d recent mentions\n", req.URL.Path, len(page.Mentions))
+	dash.render(w, req, "mentions.html", page)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkifyTweet(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(
+		`Vote <a href="/dash/hashtag/vote">#vote</a> with <a href="/dash/acct/TimKaine">@TimKaine</a>: `+
+			`<a href="https://example.com/a?b=1&amp;c=2">https://example.com/a?b=1&amp;c=2</a>.`,
+		string(linkifyTweet("Vote #vote with @TimKaine: https://example.com/a?b=1&amp;c=2.")))
+
+	// Everything is escaped (including what Twitter already escaped)
+	assert.Equal(`&lt;script&gt;alert(&#34;hi&#34;)&lt;/script&gt; &amp; more`,
+		string(linkifyTweet(`<script>alert("hi")</script> &amp; more`)))
+	assert.Equal(`<a href="/dash/hashtag/x">#x</a>&#34;&gt;`, string(linkifyTweet(`#x">`)))
+	assert.Equal(`javascript:alert(1)`, string(linkifyTweet(`javascript:alert(1)`)))
+
+	// Not mentions
+	assert.Equal(`craig@example.com and a#b`, string(linkifyTweet("craig@example.com and a#b")))
+}
+
+func TestDashboard(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpfile, err := ioutil.TempFile("", "twivility")
+	pcheck(err)
+	defer os.Remove(tmpfile.Name())
+
+	service := NewTwivilityService(&TestTwitterClient{}, tmpfile.Name())
+	service.UpdateTwitterFile(false)
+
+	now := time.Now().UTC()
+	mention := TweetRecord{
+		TweetID:        100,
+		UserScreenName: "fan",
+		Text:           `Go @User2 #ht1 <b>bold</b>`,
+		CreatedAt:      now,
+		Timestamp:      now.Format(time.RubyDate),
+		Hashtags:       []string{"#ht1"},
+		Mentions:       []string{"@User2"},
+	}
+	recent := NewRecentMentions(10)
+	recent.Add(mention)
+	trends := NewHashtagTrends()
+	trends.Add(SourceMentions, mention)
+	search := NewSearchIndex()
+	search.Add(SourceTimeline, service.GetAllTweets()...)
+	search.Add(SourceMentions, mention)
+
+	files, err := ClientFiles("")
+	pcheck(err)
+	dash, err := NewDashboard(files, false)
+	assert.NoError(err)
+	dash.Service = service
+	dash.Mentions = NewTwitterMentions(nil, "", "", "", "")
+	dash.Recent = recent
+	dash.Trends = trends
+	dash.Search = search
+	dash.LastUpdate = func() time.Time { return now }
+	dash.Metrics = NewMetrics()
+	handler := http.StripPrefix("/dash", dash)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+		return resp
+	}
+	page := func(path string, expected ...string) {
+		resp := get(path)
+		assert.Equal(http.StatusOK, resp.Code, path)
+		assert.Equal("text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+		body := resp.Body.String()
+		assert.NotContains(body, "<b>bold</b>", path)
+		assert.NotContains(body, "<script", path)
+		for _, one := range expected {
+			assert.Contains(body, one, path)
+		}
+	}
+
+	page("/dash/",
+		`<a href="/dash/acct/User2">@User2</a></td><td>2</td>`,
+		`<a href="/dash/hashtag/ht1">#ht1</a> <span class="tweet-flag">new</span>`,
+		`&lt;b&gt;bold&lt;/b&gt;`)
+	page("/dash/acct/user2",
+		"<h1>@User2</h1>",
+		"Timeline (2 tweets)",
+		`<a href="/dash/hashtag/ht2">#ht2</a>`)
+	page("/dash/acct/User2?hashtag=ht2", "Timeline (1 tweets)")
+	page("/dash/acct/User2?limit=1", "Older tweets", "max_id=2")
+	page("/dash/hashtag/ht1",
+		"<h1>#ht1</h1>",
+		"Tweets and mentions (3)",
+		"<td>Last 1h</td><td>1</td>")
+	page("/dash/mentions",
+		`<meta http-equiv="refresh" content="30">`,
+		`<a href="/dash/acct/User2">@User2</a>`)
+	page("/dash/mentions?hashtag=nope", "No mentions yet")
+
+	assert.Equal(http.StatusNotFound, get("/dash/acct/nobody").Code)
+	assert.Equal(http.StatusNotFound, get("/dash/nope").Code)
+	assert.Equal(http.StatusBadRequest, get("/dash/acct/User2?limit=x").Code)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/dash/", nil))
+	assert.Equal(http.StatusMethodNotAllowed, resp.Code)
+
+	// Pages are timed by route
+	pw := NewPromWriter()
+	dash.Metrics.Write(pw)
+	txt := string(pw.Bytes())
+	for _, line := range []string{
+		`twivility_http_requests_total{route="/dash/acct/{acct}",method="GET",code="200"} 3`,
+		`twivility_http_requests_total{route="/dash/acct/{acct}",method="GET",code="404"} 1`,
+		`twivility_http_requests_total{route="/dash/mentions",method="GET",code="200"} 2`,
+		`twivility_http_requests_total{route="unmatched",method="POST",code="405"} 1`,
+	} {
+		assert.Contains(txt, line+"\n")
+	}
+}
+
+func TestDashboardTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twivility-dash")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+
+	// Missing templates are an error
+	_, err = NewDashboard(http.Dir(dir), true)
+	assert.Error(err)
+
+	// Live templates are reparsed for every page
+	pcheck(os.Mkdir(filepath.Join(dir, "templates"), 0700))
+	write := func(body string) {
+		for _, name := range dashboardTemplates {
+			content := `{{define "x"}}{{end}}`
+			if name == "mentions.html" {
+				content = body
+			}
+			pcheck(ioutil.WriteFile(filepath.Join(dir, "templates", name), []byte(content), 0600))
+		}
+	}
+	write("first")
+	dash, err := NewDashboard(http.Dir(dir), true)
+	assert.NoError(err)
+	dash.Mentions = NewTwitterMentions(nil, "", "", "", "")
+	dash.Recent = NewRecentMentions(1)
+
+	get := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		dash.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/mentions", nil))
+		return resp
+	}
+	assert.Equal("first", get().Body.String())
+	write("second {{.Title}}")
+	assert.Equal("second Live mentions", get().Body.String())
+	write("{{.NoSuchField}}")
+	assert.Equal(http.StatusInternalServerError, get().Code)
+}
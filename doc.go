@@ -20,25 +20,201 @@ Commands
 
 service
     Run the Twivility service (by default serving at Orwellian port 8484).
-    Includes the HTML client/site (served at "/"). The service will
-    occasionally query Twitter for new tweets.
+    Includes the HTML client/site (served at "/") and a dashboard (at
+    "/dash/") with an overview, a page per account and hashtag, and live
+    mentions. Atom feeds of the newest 50 tweets are served at
+    "/feeds/acct/<acct>.atom", "/feeds/hashtag/<tag>.atom",
+    "/feeds/mentions/<acct>.atom", and "/feeds/search.atom?q=<search>"
+    (with -auth, feed readers need an htpasswd user or a key). The service
+    will occasionally query Twitter for new tweets. On SIGINT or SIGTERM it stops
+    accepting requests, waits for in-flight requests (see -shutdown-timeout),
+    stops the mention stream and closes stream.json, and lets a running
+    update save what it has before exiting. A second signal exits at once.
 
 update
     Updates the local store of stored tweets. Note that no synchronization
     will be attempted with a running copy of the service, so you should
     make sure to run this when no other instance of twivility is active.
+    To update (or backfill) a running service, use POST /api/admin/update.
 
 dump
-    Dump all tweets stored to stdout as a JSON object.
+    Dump all tweets stored to stdout as a JSON object. Every record has
+    Timestamp (exactly as Twitter gave it) and CreatedAt (parsed, in UTC).
 
 json
     A synonym for the "dump" command
 
+stream
+    Write streamed mentions to stream.json (and log them) until stopped.
+
+graph
+    Write the "who mentions whom" graph built from the stored tweets and
+    stream.json to stdout. See the -format, -window, and -min-weight flags.
+
+search <query>
+    Search the stored tweets and stream.json, writing the best matches (see
+    -limit) to stdout as JSON, one per line, with their Score and Source.
+    Words must all match the text (or author); "quoted phrases" must match
+    in order; OR, AND, NOT (or -word), and parentheses combine terms; and
+    from:acct, tag:hashtag, mention:acct, since:time, and until:time are
+    fields. For example:
+
+        twivility search '"tax returns" (from:timkaine OR #debate) -tag:maga'
+
 Flags
 
 -host <address binding string>
     The default value is "127.0.0.1:8484". Note that this flag only has an
-    effect when using the "service" command
+    effect when using the "service" command. If you listen on anything but
+    localhost, see -auth and -tls-cert.
+
+-tls-cert <filename> and -tls-key <filename>
+    Serve HTTPS with this certificate (PEM, including any intermediate
+    certificates) and private key. Both must be given.
+
+-auth <filename>
+    JSON file configuring authentication for the service command. Requests
+    need a static API key (in the X-API-Key header or as "Authorization:
+    Bearer <key>") or HTTP basic auth checked against an htpasswd file
+    (created with htpasswd -m or -s; bcrypt isn't supported). API keys have
+    a Role of "read" or "admin"; htpasswd users are "read" unless listed in
+    Admins. Admin API endpoints need the admin role. For example:
+
+        {"Keys": [
+            {"Name": "dashboard", "Key": "long-random-string", "Role": "read"},
+            {"Name": "ops", "Key": "another-long-random-string", "Role": "admin"}
+         ],
+         "Htpasswd": "users.htpasswd",
+         "Admins": ["craig"]}
+
+    Keys must be at least 16 characters. Use htpasswd users for browsers
+    (they'll be asked to log in). With no file, there's no authentication
+    and the admin endpoints can't be used at all. Since browsers send basic
+    auth from any page, admin POSTs also need an X-API-Key header or a
+    "Content-Type: application/json" header (which other sites can't send).
+
+-client-dir <directory>
+    Serve the HTML client from this directory (usually ./client) instead of
+    the copy compiled into the binary, so changes to the client show up
+    without a rebuild. By default the service needs no files from the
+    source tree.
+
+-shutdown-timeout <duration>
+    How long the service waits for in-flight requests to finish when it's
+    shutting down (default "30s").
+
+-from <time> and -to <time>
+    Only tweets created in this range are used by the "dump", "graph", and
+    "search" commands. Times may be RFC 3339 ("2016-10-09T15:04:05Z"), a date
+    ("2016-10-09", UTC), Unix seconds, or a duration before now ("24h" or
+    "7d"). Either may be left out.
+
+-limit <count>
+    The most results written by the "search" command (default 20).
+
+-format <graphml|dot>
+    Output format for the "graph" command: GraphML (the default) or
+    Graphviz DOT.
+
+-window <duration>
+    Only mentions this recent (for instance "24h" or "7d") are included by
+    the "graph" command. The default is everything.
+
+-min-weight <count>
+    Only edges with at least this many mentions are included by the "graph"
+    command.
+
+-hashtags <filename>
+    File with whitespace-delimited hashtags (and @accounts) to track in the
+    mention stream. Used by the "service" and "stream" commands. Once track
+    terms are changed with the admin API, the service saves them (and any
+    muted accounts) to tracking.json and uses that file instead.
+
+-languages <codes>
+    Comma-delimited list of language codes (for instance "en,es"). If given,
+    only mentions in those languages are streamed.
+
+-locations <boxes>
+    Comma-delimited list of bounding boxes, four numbers per box: the
+    longitude,latitude of the south-west corner and then the
+    longitude,latitude of the north-east corner. Note that Twitter treats
+    locations as an alternative to the tracked terms and accounts (any match
+    is streamed), while languages restrict everything.
+
+-recent-size <count>
+    The number of recently streamed mentions kept in memory for the
+    /api/recent-stream endpoint (default 100). On startup this buffer is
+    refilled from the end of stream.json.
+
+-stall-timeout <duration>
+    If the mention stream goes this long without any message at all, the
+    stream is restarted (default "2m"; use 0 to disable). Keep-alives from
+    Twitter don't count, so a very quiet filter will see some restarts: each
+    restart that isn't followed by a message doubles the timeout (up to an
+    hour) so we aren't rate limited for reconnecting. Stall warnings, limit
+    notices, disconnects, and restarts are reported in /api/stats as
+    StreamHealth.
+
+-sinks <filename>
+    JSON file configuring extra outputs for streamed mentions (everything is
+    still written to stream.json). Sink types are "hashtag" (a file per
+    hashtag in the directory Path), "unix" (JSON lines to the socket at Path),
+    "stdout", "webhook" (POST JSON to URL), and "csv" (append to the file at
+    Path). Each sink may have a Filter (Accts, Hashtags, Terms, and Retweets
+    of "exclude" or "only") and a Failure policy (Retries, RetryWait,
+    DisableAfter, and DisableFor). Retries wait RetryWait (default "1s")
+    before the first retry and twice as long before each one after, but never
+    more than 15 seconds in all for one mention. For example:
+
+        {"Sinks": [
+            {"Type": "hashtag", "Path": "./by-hashtag"},
+            {"Type": "webhook", "URL": "http://localhost:9000/hook",
+             "Failure": {"Retries": 2, "DisableAfter": 10, "DisableFor": "10m"}},
+            {"Type": "csv", "Path": "vote.csv", "Filter": {"Hashtags": ["#vote"]}}
+        ]}
+
+    Every sink has its own queue (size Queue, default 1000), so a slow or
+    broken sink never holds up the stream. Per-sink counts are in /api/stats.
+
+-alerts <filename>
+    JSON file configuring mention spike alerts for the service command. Each
+    rule watches the per-minute mention count for all mentions (Kind
+    "total"), each mentioned account ("acct"), or each hashtag ("hashtag"),
+    optionally limited to Names. A minute is a spike when its count is at
+    least MinCount (default 10) and Threshold (default 3) standard deviations
+    above the moving average (see Alpha, default 0.1) after Warmup (default
+    10) minutes of history. A new spike runs the rule's Actions: "log",
+    "file" (append JSON to Path), "command" (run Command with the alert JSON
+    on stdin), or "webhook" (POST JSON to URL). For example:
+
+        {"Rules": [
+            {"Name": "accts", "Kind": "acct", "MinCount": 20,
+             "Actions": [{"Type": "log"}, {"Type": "file", "Path": "alerts.json"}]},
+            {"Name": "vote", "Kind": "hashtag", "Names": ["#vote"],
+             "Actions": [{"Type": "command", "Command": ["./notify.sh"]}]}
+        ]}
+
+    Active and recent alerts are available from /api/alerts.
+
+-categories <filename>
+    JSON file configuring the categories used to label timeline tweets and
+    streamed mentions (see categories.example.json). A tweet is in a category
+    if any of the category's Regex (matched against the text), Keywords
+    (matched like track terms), Hashtags, or Accounts (author or mentioned)
+    match. Labels are returned as Categories on each tweet and counted in
+    /api/stats. An account is in a category if it's in Accounts or a Regex
+    matches its name (the client colors accounts by their first category,
+    falling back to its own lefty/righty names). By default there are no
+    categories: to try them, copy categories.example.json and pass the copy.
+
+    The unversioned /api/tweets/{acct} keeps its original result (just the
+    list of tweets, each with its Categories) for older clients, so it
+    doesn't have the per-category counts. Use /api/v1/tweets/{acct} for
+    those.
+
+The mention stream tracks every account in the store and every entry in the
+hashtag file by name. Accounts are also followed by user ID so that replies
+and retweets are captured.
 
 Environment Variables
 
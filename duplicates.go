@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Near-duplicate (copypasta) detection for streamed mentions. Every mention
+// gets a 64 bit SimHash fingerprint of its words and word pairs, ignoring
+// case, punctuation, URL's, and @mentions (which is what usually changes
+// between copies). Fingerprints within a few bits of each other are
+// near-duplicates, and we group them into clusters. Retweets and very short
+// tweets aren't fingerprinted since they're duplicates by design (or by
+// accident).
+//
+// To find a cluster without comparing against every other cluster, the
+// fingerprint is split into 4 bands of 16 bits: fingerprints within 3 bits
+// of each other must have at least one identical band.
+
+// Duplicate detection settings
+const (
+	minDupWords         = 5 // Fewest words we fingerprint
+	maxDupDistance      = 3 // Most differing bits for a near-duplicate
+	dupBands            = 4 // Bands of 16 bits (see above)
+	dupRetention        = 7 * 24 * time.Hour
+	maxClusterTweetIDs  = 100 // Most tweet ID's returned per cluster
+	defaultClusterLimit = 50
+)
+
+// dupWords returns the words we fingerprint
+func dupWords(txt string) []string {
+	words := make([]string, 0, 32)
+	for _, field := range strings.Fields(urlMatch.ReplaceAllString(txt, " ")) {
+		if strings.HasPrefix(field, "@") || strings.HasPrefix(field, "＠") {
+			continue
+		}
+		words = append(words, searchWords(field)...)
+	}
+	return words
+}
+
+// SimHash returns the fingerprint of the text. ok is false if the text is
+// too short to fingerprint
+func SimHash(txt string) (fingerprint uint64, ok bool) {
+	words := dupWords(txt)
+	if len(words) < minDupWords {
+		return 0, false
+	}
+
+	var weights [64]int
+	addFeature := func(feature string) {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		val := h.Sum64()
+		for bit := uint(0); bit < 64; bit++ {
+			if val&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	for i, word := range words {
+		addFeature(word)
+		if i > 0 {
+			addFeature(words[i-1] + " " + word)
+		}
+	}
+
+	for bit := uint(0); bit < 64; bit++ {
+		if weights[bit] > 0 {
+			fingerprint |= 1 << bit
+		}
+	}
+	return fingerprint, true
+}
+
+// MentionFingerprint is the hex SimHash fingerprint for a mention, or "" if
+// we don't fingerprint it (retweets and short tweets)
+func MentionFingerprint(rec TweetRecord) string {
+	if rec.IsRetweet {
+		return ""
+	}
+	fp, ok := SimHash(rec.Text)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%016x", fp)
+}
+
+// recordFingerprint returns the record's fingerprint, computing it for
+// mentions stored before we had fingerprints
+func recordFingerprint(rec TweetRecord) (uint64, bool) {
+	if rec.Fingerprint == "" {
+		rec.Fingerprint = MentionFingerprint(rec)
+	}
+	if rec.Fingerprint == "" {
+		return 0, false
+	}
+	fp, err := strconv.ParseUint(rec.Fingerprint, 16, 64)
+	return fp, err == nil
+}
+
+// dupBand returns the given band of the fingerprint
+func dupBand(fp uint64, band int) uint16 {
+	return uint16(fp >> (uint(band) * 16))
+}
+
+// DuplicateCluster is a group of near-duplicate mentions
+type DuplicateCluster struct {
+	ID          int64
+	Fingerprint string    // Fingerprint of the first mention
+	Text        string    // Text of the first mention
+	Size        int       // Number of mentions
+	FirstSeen   time.Time // Created time of the oldest mention
+	LastSeen    time.Time // Created time of the newest mention
+	Accts       []string  // Authors of the mentions
+	TweetIDs    []int64   // The newest mentions (up to 100), newest first
+}
+
+// dupCluster is our internal cluster
+type dupCluster struct {
+	id        int64
+	fp        uint64
+	text      string
+	ids       []int64
+	accts     *UniqueStrings
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// DuplicateQuery selects clusters from DuplicateClusters.Clusters
+type DuplicateQuery struct {
+	MinSize int // Smallest cluster returned (default 2)
+	Limit   int // Most clusters returned (default 50)
+}
+
+// DuplicateClusters is a thread-safe, incrementally updated set of
+// near-duplicate clusters
+type DuplicateClusters struct {
+	clusters  map[int64]*dupCluster
+	bands     [dupBands]map[uint16][]int64 // band value => cluster ID's
+	byTweet   map[int64]int64              // tweet ID => cluster ID
+	nextID    int64
+	lastPrune time.Time
+	now       func() time.Time
+	mtx       sync.RWMutex
+}
+
+// NewDuplicateClusters returns an empty set of clusters
+func NewDuplicateClusters() *DuplicateClusters {
+	dc := &DuplicateClusters{
+		clusters: make(map[int64]*dupCluster),
+		byTweet:  make(map[int64]int64),
+		nextID:   1,
+		now:      time.Now,
+	}
+	for i := range dc.bands {
+		dc.bands[i] = make(map[uint16][]int64)
+	}
+	return dc
+}
+
+// find returns the cluster near the fingerprint (or nil). Caller must hold
+// the lock
+func (dc *DuplicateClusters) find(fp uint64) *dupCluster {
+	var best *dupCluster
+	bestDist := maxDupDistance + 1
+	for band := range dc.bands {
+		for _, id := range dc.bands[band][dupBand(fp, band)] {
+			cluster := dc.clusters[id]
+			if cluster == nil {
+				continue
+			}
+			dist := bits.OnesCount64(cluster.fp ^ fp)
+			if dist < bestDist || (dist == bestDist && best != nil && cluster.id < best.id) {
+				best, bestDist = cluster, dist
+			}
+		}
+	}
+	return best
+}
+
+// Add fingerprints the given mentions and adds them to clusters. Mentions
+// we've already seen (and those we don't fingerprint) are skipped
+func (dc *DuplicateClusters) Add(tweets ...TweetRecord) {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+
+	now := dc.now()
+	dc.prune(now)
+	for _, tweet := range tweets {
+		if _, seen := dc.byTweet[tweet.TweetID]; seen {
+			continue
+		}
+		created := tweet.Created()
+		if created.Before(now.Add(-dupRetention)) {
+			continue
+		}
+		fp, ok := recordFingerprint(tweet)
+		if !ok {
+			continue
+		}
+
+		cluster := dc.find(fp)
+		if cluster == nil {
+			cluster = &dupCluster{
+				id:        dc.nextID,
+				fp:        fp,
+				text:      tweet.Text,
+				ids:       make([]int64, 0, 1),
+				accts:     NewUniqueStrings(),
+				firstSeen: created,
+				lastSeen:  created,
+			}
+			dc.nextID++
+			dc.clusters[cluster.id] = cluster
+			for band := range dc.bands {
+				key := dupBand(fp, band)
+				dc.bands[band][key] = append(dc.bands[band][key], cluster.id)
+			}
+		}
+
+		cluster.ids = append(cluster.ids, tweet.TweetID)
+		if tweet.UserScreenName != "" {
+			cluster.accts.Add(tweet.UserScreenName)
+		}
+		if created.Before(cluster.firstSeen) {
+			cluster.firstSeen = created
+		}
+		if created.After(cluster.lastSeen) {
+			cluster.lastSeen = created
+		}
+		dc.byTweet[tweet.TweetID] = cluster.id
+	}
+}
+
+// prune drops clusters we haven't seen in dupRetention (checked at most once
+// an hour). Caller must hold the write lock
+func (dc *DuplicateClusters) prune(now time.Time) {
+	if now.Sub(dc.lastPrune) < time.Hour {
+		return
+	}
+	dc.lastPrune = now
+
+	oldest := now.Add(-dupRetention)
+	for id, cluster := range dc.clusters {
+		if !cluster.lastSeen.Before(oldest) {
+			continue
+		}
+		delete(dc.clusters, id)
+		for _, tid := range cluster.ids {
+			delete(dc.byTweet, tid)
+		}
+		for band := range dc.bands {
+			key := dupBand(cluster.fp, band)
+			kept := dc.bands[band][key][:0]
+			for _, other := range dc.bands[band][key] {
+				if other != id {
+					kept = append(kept, other)
+				}
+			}
+			if len(kept) > 0 {
+				dc.bands[band][key] = kept
+			} else {
+				delete(dc.bands[band], key)
+			}
+		}
+	}
+}
+
+// Clusters returns the clusters with at least MinSize mentions, largest
+// first (newest first for ties)
+func (dc *DuplicateClusters) Clusters(q DuplicateQuery) []DuplicateCluster {
+	minSize := q.MinSize
+	if minSize < 2 {
+		minSize = 2
+	}
+	limit := q.Limit
+	if limit < 1 {
+		limit = defaultClusterLimit
+	}
+
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+
+	found := make([]DuplicateCluster, 0, 16)
+	for _, cluster := range dc.clusters {
+		if len(cluster.ids) < minSize {
+			continue
+		}
+
+		ids := make([]int64, 0, maxClusterTweetIDs)
+		for i := len(cluster.ids) - 1; i >= 0 && len(ids) < maxClusterTweetIDs; i-- {
+			ids = append(ids, cluster.ids[i])
+		}
+		found = append(found, DuplicateCluster{
+			ID:          cluster.id,
+			Fingerprint: fmt.Sprintf("%016x", cluster.fp),
+			Text:        cluster.text,
+			Size:        len(cluster.ids),
+			FirstSeen:   cluster.firstSeen,
+			LastSeen:    cluster.lastSeen,
+			Accts:       cluster.accts.Strings(),
+			TweetIDs:    ids,
+		})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Size != found[j].Size {
+			return found[i].Size > found[j].Size
+		}
+		if !found[i].LastSeen.Equal(found[j].LastSeen) {
+			return found[i].LastSeen.After(found[j].LastSeen)
+		}
+		return found[i].ID < found[j].ID
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+// Collapse returns the tweets with only the first tweet (in list order) from
+// each cluster of near-duplicates, keeping at most limit tweets (0 for no
+// limit)
+func (dc *DuplicateClusters) Collapse(tweets TweetRecordList, limit int) TweetRecordList {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+
+	kept := make(TweetRecordList, 0, len(tweets))
+	seen := make(map[int64]bool)
+	for _, tweet := range tweets {
+		if limit > 0 && len(kept) >= limit {
+			break
+		}
+		if id, inCluster := dc.byTweet[tweet.TweetID]; inCluster {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		kept = append(kept, tweet)
+	}
+	return kept
+}
+
+// ParseDuplicateQuery builds a query from the API query parameters min_size
+// and limit
+func ParseDuplicateQuery(values url.Values) (DuplicateQuery, error) {
+	q := DuplicateQuery{MinSize: 2, Limit: defaultClusterLimit}
+
+	if txt := values.Get("min_size"); len(txt) > 0 {
+		size, err := strconv.Atoi(txt)
+		if err != nil || size < 2 {
+			return q, errors.New("min_size must be an integer of at least 2")
+		}
+		q.MinSize = size
+	}
+	if txt := values.Get("limit"); len(txt) > 0 {
+		limit, err := strconv.Atoi(txt)
+		if err != nil || limit < 1 {
+			return q, errors.New("limit must be a positive integer")
+		}
+		q.Limit = limit
+	}
+
+	return q, nil
+}
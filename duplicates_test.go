@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math/bits"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimHash(t *testing.T) {
+	assert := assert.New(t)
+
+	base := "Everyone needs to call their senator today and demand a recount now"
+	fp, ok := SimHash(base)
+	assert.True(ok)
+
+	// Case, punctuation, URL's, and mentions don't matter
+	same, ok := SimHash("@someone EVERYONE needs to call their senator today, and demand a recount NOW! https://t.co/abc123")
+	assert.True(ok)
+	assert.Equal(fp, same)
+
+	// A small edit is close, different text isn't
+	edited, _ := SimHash("Everyone needs to call their senator today and demand a recount now please")
+	assert.True(bits.OnesCount64(fp^edited) <= maxDupDistance*3)
+	other, _ := SimHash("The debate tonight was about taxes and jobs and not much else")
+	assert.True(bits.OnesCount64(fp^other) > maxDupDistance)
+
+	// Too short
+	_, ok = SimHash("#vote @alice today")
+	assert.False(ok)
+
+	assert.Equal("", MentionFingerprint(TweetRecord{Text: base, IsRetweet: true}))
+	assert.Len(MentionFingerprint(TweetRecord{Text: base}), 16)
+}
+
+func TestDuplicateClusters(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 10, 9, 12, 0, 0, 0, time.UTC)
+	dups := NewDuplicateClusters()
+	dups.now = func() time.Time { return now }
+
+	copypasta := "Everyone needs to call their senator today and demand a recount now"
+	mention := func(tid int64, user string, txt string, ago time.Duration) TweetRecord {
+		return TweetRecord{TweetID: tid, UserScreenName: user, Text: txt, CreatedAt: now.Add(-ago)}
+	}
+
+	tweets := TweetRecordList{
+		mention(1, "alice", copypasta, 50*time.Minute),
+		mention(2, "bob", "@carol "+copypasta+" https://t.co/xyz", 40*time.Minute),
+		mention(3, "carol", "The debate tonight was about taxes and jobs and not much else", 30*time.Minute),
+		mention(4, "dave", copypasta+"!!!", 20*time.Minute),
+		mention(5, "erin", "too short", 10*time.Minute),
+		mention(6, "frank", copypasta, 100*24*time.Hour), // Too old
+	}
+	retweet := mention(7, "gina", copypasta, 5*time.Minute)
+	retweet.IsRetweet = true
+	tweets = append(tweets, retweet)
+
+	// Stored fingerprints are used as-is
+	stored := mention(8, "hank", "Some completely different text that we will not match", 5*time.Minute)
+	stored.Fingerprint = MentionFingerprint(mention(0, "", copypasta, 0))
+	tweets = append(tweets, stored)
+
+	dups.Add(tweets...)
+	dups.Add(tweets[0]) // Already seen
+
+	clusters := dups.Clusters(DuplicateQuery{})
+	assert.Len(clusters, 1)
+	cluster := clusters[0]
+	assert.Equal(4, cluster.Size)
+	assert.Equal(copypasta, cluster.Text)
+	assert.Equal([]string{"alice", "bob", "dave", "hank"}, cluster.Accts)
+	assert.Equal([]int64{8, 4, 2, 1}, cluster.TweetIDs)
+	assert.Equal(now.Add(-50*time.Minute), cluster.FirstSeen)
+	assert.Equal(now.Add(-5*time.Minute), cluster.LastSeen)
+
+	assert.Len(dups.Clusters(DuplicateQuery{MinSize: 5}), 0)
+
+	// Collapse keeps the first of each cluster
+	newestFirst := TweetRecordList{tweets[7], tweets[4], tweets[3], tweets[2], tweets[1], tweets[0]}
+	collapsed := dups.Collapse(newestFirst, 0)
+	assert.Len(collapsed, 3)
+	assert.Equal(int64(8), collapsed[0].TweetID)
+	assert.Equal(int64(5), collapsed[1].TweetID)
+	assert.Equal(int64(3), collapsed[2].TweetID)
+	assert.Len(dups.Collapse(newestFirst, 2), 2)
+
+	// Old clusters are pruned
+	now = now.Add(8 * 24 * time.Hour)
+	dups.Add(mention(20, "ivan", copypasta, 0))
+	clusters = dups.Clusters(DuplicateQuery{MinSize: 2})
+	assert.Len(clusters, 0)
+	assert.Len(dups.byTweet, 1)
+}
+
+func TestParseDuplicateQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	q, err := ParseDuplicateQuery(url.Values{})
+	assert.NoError(err)
+	assert.Equal(2, q.MinSize)
+	assert.Equal(defaultClusterLimit, q.Limit)
+
+	q, err = ParseDuplicateQuery(url.Values{"min_size": {"5"}, "limit": {"10"}})
+	assert.NoError(err)
+	assert.Equal(5, q.MinSize)
+	assert.Equal(10, q.Limit)
+
+	for _, bad := range []url.Values{{"min_size": {"1"}}, {"min_size": {"x"}}, {"limit": {"0"}}} {
+		_, err := ParseDuplicateQuery(bad)
+		assert.Error(err)
+	}
+}
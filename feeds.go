@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/xml"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Atom feeds (RFC 4287) of tweets for feed readers. Feeds are served by an
+// APIRouter with caching on, so they get ETags and gzip like the API. They
+// also send Last-Modified for readers that only use If-Modified-Since. That's
+// when our tweet data last changed rather than the newest entry, since tweets
+// can arrive out of order (like a backfill of older tweets). HTTP times are
+// only to the second, so readers sending If-None-Match get the exact answer
+
+// Feed sizes and content type
+const (
+	feedEntries     = 50
+	feedTitleLength = 80
+	atomContentType = "application/atom+xml; charset=utf-8"
+	atomNamespace   = "http://www.w3.org/2005/Atom"
+)
+
+// AtomFeed is the top level of an Atom document
+type AtomFeed struct {
+	XMLName   xml.Name    `xml:"feed"`
+	Namespace string      `xml:"xmlns,attr"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Generator string      `xml:"generator"`
+	Links     []AtomLink  `xml:"link"`
+	Entries   []AtomEntry `xml:"entry"`
+}
+
+// AtomLink is a link from a feed or entry
+type AtomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// AtomPerson is an entry author
+type AtomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+// AtomText is text content with a type (text or html)
+type AtomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// AtomCategory is a category (we use hashtags)
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// AtomEntry is a single tweet
+type AtomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Author     AtomPerson     `xml:"author"`
+	Links      []AtomLink     `xml:"link"`
+	Content    AtomText       `xml:"content"`
+	Categories []AtomCategory `xml:"category"`
+}
+
+// FeedInfo describes a feed apart from its entries
+type FeedInfo struct {
+	ID        string // Permanent ID (see feedID)
+	Title     string
+	Base      string // Scheme and host for our own links (see requestBase)
+	Self      string // Path of the feed itself
+	Alternate string // Path of the matching dashboard page ("" if none)
+}
+
+// feedID returns a permanent tag URI for one of our feeds (like
+// "acct/timkaine"), independent of the host we're served from
+func feedID(name string) string {
+	return "tag:twivility.com,2016:" + strings.ToLower(name)
+}
+
+// requestBase returns the scheme and host the request was made to (like
+// "https://example.com")
+func requestBase(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
+
+// feedTime formats a time for Atom. Records without a parsed time get the
+// Unix epoch, since Atom requires a time
+func feedTime(when time.Time) string {
+	if when.IsZero() {
+		when = time.Unix(0, 0)
+	}
+	return when.UTC().Format(time.RFC3339)
+}
+
+// feedEntryTitle is the plain text title for a tweet: the author and the
+// start of the text
+func feedEntryTitle(tweet TweetRecord) string {
+	txt := strings.Join(strings.Fields(html.UnescapeString(tweet.Text)), " ")
+	if runes := []rune(txt); len(runes) > feedTitleLength {
+		txt = string(runes[:feedTitleLength-3]) + "..."
+	}
+	return dashAcctName(tweet.UserScreenName) + ": " + txt
+}
+
+// BuildAtomFeed returns the feed for the tweets (which should be newest
+// first). The feed is updated when its newest entry was
+func BuildAtomFeed(info FeedInfo, tweets TweetRecordList) AtomFeed {
+	feed := AtomFeed{
+		Namespace: atomNamespace,
+		ID:        info.ID,
+		Title:     info.Title,
+		Generator: "Twivility",
+		Links:     []AtomLink{{Rel: "self", Type: "application/atom+xml", Href: info.Base + info.Self}},
+		Entries:   make([]AtomEntry, 0, len(tweets)),
+	}
+	if info.Alternate != "" {
+		feed.Links = append(feed.Links, AtomLink{Rel: "alternate", Type: "text/html", Href: info.Base + info.Alternate})
+	}
+
+	var newest time.Time
+	for _, tweet := range tweets {
+		created := tweet.Created()
+		if created.After(newest) {
+			newest = created
+		}
+
+		author := AtomPerson{Name: tweet.UserName, URI: "https://twitter.com/" + strings.TrimPrefix(tweet.UserScreenName, "@")}
+		if author.Name == "" {
+			author.Name = dashAcctName(tweet.UserScreenName)
+		}
+		entry := AtomEntry{
+			ID:        tweetURL(tweet),
+			Title:     feedEntryTitle(tweet),
+			Updated:   feedTime(created),
+			Published: feedTime(created),
+			Author:    author,
+			Links:     []AtomLink{{Rel: "alternate", Type: "text/html", Href: tweetURL(tweet)}},
+			Content:   AtomText{Type: "html", Body: string(linkifyTweetAt(tweet.Text, info.Base))},
+		}
+		for _, tag := range tweet.Hashtags {
+			entry.Categories = append(entry.Categories, AtomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	feed.Updated = feedTime(newest)
+
+	return feed
+}
+
+// writeAtomFeed writes the feed with a Last-Modified of when the data in it
+// last changed (no Last-Modified if that's zero). Read modified before the
+// data, so a change while we build the feed can't get an old time
+func writeAtomFeed(w http.ResponseWriter, feed AtomFeed, modified time.Time) {
+	buf, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Type", atomContentType)
+	w.Write([]byte(xml.Header))
+	w.Write(buf)
+}
+
+// feedName returns the name from a feed file like "timkaine.atom" (false if
+// it isn't an Atom file)
+func feedName(file string) (string, bool) {
+	if !strings.HasSuffix(file, ".atom") {
+		return "", false
+	}
+	name := strings.TrimSuffix(file, ".atom")
+	return name, name != ""
+}
+
+// hitTweets returns the tweets from the search hits (in the same order)
+func hitTweets(hits []SearchHit) TweetRecordList {
+	tweets := make(TweetRecordList, 0, len(hits))
+	for _, hit := range hits {
+		tweets = append(tweets, hit.Tweet)
+	}
+	return tweets
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeedHelpers(t *testing.T) {
+	assert := assert.New(t)
+
+	name, ok := feedName("TimKaine.atom")
+	assert.True(ok)
+	assert.Equal("TimKaine", name)
+	for _, file := range []string{"TimKaine", ".atom", "TimKaine.rss"} {
+		_, ok := feedName(file)
+		assert.False(ok)
+	}
+
+	assert.Equal("tag:twivility.com,2016:acct/timkaine", feedID("acct/TimKaine"))
+	assert.Equal("1970-01-01T00:00:00Z", feedTime(time.Time{}))
+
+	long := TweetRecord{UserScreenName: "bob", Text: "Fish &amp; chips\n" + strings.Repeat("x", 100)}
+	title := feedEntryTitle(long)
+	assert.True(strings.HasPrefix(title, "@bob: Fish & chips xxx"))
+	assert.True(strings.HasSuffix(title, "..."))
+	assert.Equal(len("@bob: ")+feedTitleLength, len(title))
+
+	req := httptest.NewRequest(http.MethodGet, "/feeds/acct/bob.atom", nil)
+	req.Host = "example.com:8484"
+	assert.Equal("http://example.com:8484", requestBase(req))
+
+	hits := []SearchHit{
+		{Source: SourceMentions, Tweet: TweetRecord{TweetID: 3}},
+		{Source: SourceTimeline, Tweet: TweetRecord{TweetID: 4}},
+	}
+	tweets := hitTweets(hits)
+	assert.Len(tweets, 2)
+	assert.Equal(int64(3), tweets[0].TweetID)
+	assert.Equal(int64(4), tweets[1].TweetID)
+}
+
+func TestAtomFeed(t *testing.T) {
+	assert := assert.New(t)
+
+	created := time.Date(2016, 10, 9, 15, 4, 5, 0, time.UTC)
+	tweets := TweetRecordList{
+		{
+			TweetID:        20,
+			UserScreenName: "timkaine",
+			UserName:       "Tim Kaine",
+			Text:           "Go vote #vote &lt;3 https://example.com",
+			CreatedAt:      created,
+			Hashtags:       []string{"#vote"},
+		},
+		{TweetID: 10, UserScreenName: "timkaine", Text: "Older", CreatedAt: created.Add(-time.Hour)},
+	}
+
+	changed := time.Date(2016, 10, 10, 8, 0, 0, 0, time.UTC)
+	version := NewStoreVersion()
+	version.now = func() time.Time { return changed }
+	version.Bump(tweets...)
+	feeds := NewAPIRouter()
+	feeds.Cache = NewResponseCache(version, 0)
+	feeds.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/acct/{file}",
+		Summary: "Feed",
+		Cache:   true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			writeAtomFeed(w, BuildAtomFeed(FeedInfo{
+				ID:        feedID("acct/timkaine"),
+				Title:     "Tweets by @timkaine",
+				Base:      requestBase(req),
+				Self:      "/feeds/acct/" + params["file"],
+				Alternate: dashAcctURL("timkaine"),
+			}, tweets), version.Changed())
+		},
+	})
+
+	call := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/acct/timkaine.atom", nil)
+		req.Host = "example.com"
+		for name, val := range headers {
+			req.Header.Set(name, val)
+		}
+		resp := httptest.NewRecorder()
+		feeds.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := call(nil)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal(atomContentType, resp.Header().Get("Content-Type"))
+	assert.Equal("Mon, 10 Oct 2016 08:00:00 GMT", resp.Header().Get("Last-Modified"))
+	etag := resp.Header().Get("ETag")
+	assert.NotEqual("", etag)
+	assert.True(strings.HasPrefix(resp.Body.String(), xml.Header))
+
+	var feed AtomFeed
+	assert.NoError(xml.Unmarshal(resp.Body.Bytes(), &feed))
+	assert.Equal("tag:twivility.com,2016:acct/timkaine", feed.ID)
+	assert.Equal("2016-10-09T15:04:05Z", feed.Updated)
+	assert.Equal([]AtomLink{
+		{Rel: "self", Type: "application/atom+xml", Href: "http://example.com/feeds/acct/timkaine.atom"},
+		{Rel: "alternate", Type: "text/html", Href: "http://example.com/dash/acct/timkaine"},
+	}, feed.Links)
+	assert.Len(feed.Entries, 2)
+
+	entry := feed.Entries[0]
+	assert.Equal("https://twitter.com/timkaine/status/20", entry.ID)
+	assert.Equal("@timkaine: Go vote #vote <3 https://example.com", entry.Title)
+	assert.Equal("2016-10-09T15:04:05Z", entry.Updated)
+	assert.Equal(AtomPerson{Name: "Tim Kaine", URI: "https://twitter.com/timkaine"}, entry.Author)
+	assert.Equal([]AtomCategory{{Term: "#vote"}}, entry.Categories)
+	assert.Equal("html", entry.Content.Type)
+	assert.Equal(`Go vote <a href="http://example.com/dash/hashtag/vote">#vote</a> &lt;3 `+
+		`<a href="https://example.com">https://example.com</a>`, entry.Content.Body)
+	assert.Equal("@timkaine", feed.Entries[1].Author.Name)
+
+	// Conditional GET: ETag or Last-Modified, from the cache or not
+	assert.Equal(http.StatusNotModified, call(map[string]string{"If-None-Match": etag}).Code)
+	assert.Equal(http.StatusNotModified, call(map[string]string{"If-Modified-Since": "Mon, 10 Oct 2016 08:00:00 GMT"}).Code)
+	resp = call(map[string]string{"If-Modified-Since": "Mon, 10 Oct 2016 07:59:59 GMT"})
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("Mon, 10 Oct 2016 08:00:00 GMT", resp.Header().Get("Last-Modified"))
+
+	feeds.Cache = NewResponseCache(version, 0)
+	assert.Equal(http.StatusNotModified, call(map[string]string{"If-Modified-Since": "Tue, 11 Oct 2016 00:00:00 GMT"}).Code)
+	resp = call(map[string]string{"If-None-Match": `W/"0-0"`, "If-Modified-Since": "Tue, 11 Oct 2016 00:00:00 GMT"})
+	assert.Equal(http.StatusOK, resp.Code) // If-None-Match wins
+
+	// A backfill of an older tweet changes the feed, even though the newest
+	// entry is the same
+	changed = changed.Add(time.Hour)
+	tweets = append(tweets, TweetRecord{TweetID: 5, UserScreenName: "timkaine", Text: "Oldest", CreatedAt: created.Add(-2 * time.Hour)})
+	version.Bump(tweets[2])
+	resp = call(map[string]string{"If-Modified-Since": "Mon, 10 Oct 2016 08:00:00 GMT"})
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("Mon, 10 Oct 2016 09:00:00 GMT", resp.Header().Get("Last-Modified"))
+	var backfilled AtomFeed
+	assert.NoError(xml.Unmarshal(resp.Body.Bytes(), &backfilled))
+	assert.Equal("2016-10-09T15:04:05Z", backfilled.Updated)
+	assert.Len(backfilled.Entries, 3)
+}
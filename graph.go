@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The mention graph is a directed, weighted "who mentions whom" graph: there
+// is an edge from A to B for every tweet by A that mentions B. Edge counts
+// are kept in hourly buckets so that we can filter by time window.
+
+const graphBucket = time.Hour
+
+// graphEdgeKey is the (source, target) pair for an edge
+type graphEdgeKey struct {
+	source string
+	target string
+}
+
+// MentionGraph is a thread-safe, incrementally built mention graph
+type MentionGraph struct {
+	edges map[graphEdgeKey]map[int64]int // edge => bucket (unix secs) => count
+	seen  *seenTweets                    // Tweets already added
+	now   func() time.Time
+	mtx   sync.RWMutex
+}
+
+// GraphNode is an account in the graph
+type GraphNode struct {
+	ID        string // Lower case screen name with a leading @
+	Mentions  int    // Weighted out degree: mentions of others by this account
+	Mentioned int    // Weighted in degree: mentions of this account by others
+}
+
+// GraphEdge is a weighted edge: Source mentioned Target Weight times
+type GraphEdge struct {
+	Source    string
+	Target    string
+	Weight    int
+	FirstSeen string // Start of the hour of the first mention
+	LastSeen  string // End of the hour of the last mention
+}
+
+// Graph is a snapshot of the mention graph (after filtering)
+type Graph struct {
+	Nodes []GraphNode
+	Edges []GraphEdge
+}
+
+// GraphQuery filters a graph snapshot. Zero values don't filter
+type GraphQuery struct {
+	Window    time.Duration // Only mentions this recent
+	From      time.Time     // Only mentions created at or after this (to the hour)
+	To        time.Time     // Only mentions created before this (to the hour)
+	MinWeight int           // Only edges with at least this weight
+}
+
+// NewMentionGraph returns an empty graph
+func NewMentionGraph() *MentionGraph {
+	return &MentionGraph{
+		edges: make(map[graphEdgeKey]map[int64]int),
+		seen:  newSeenTweets(seenTweetWindow),
+		now:   time.Now,
+	}
+}
+
+// graphNodeID is the node ID for an account
+func graphNodeID(acct string) string {
+	return "@" + normAcct(acct)
+}
+
+// Add adds the mentions in the given records. Records that were already
+// added are skipped (see seenTweets), as are self-mentions
+func (mg *MentionGraph) Add(tweets ...TweetRecord) {
+	mg.mtx.Lock()
+	defer mg.mtx.Unlock()
+
+	now := mg.now()
+	for _, tweet := range tweets {
+		if len(tweet.Mentions) < 1 || !mg.seen.Add("", tweet, now) {
+			continue
+		}
+
+		source := graphNodeID(tweet.UserScreenName)
+		bucket := tweet.Created().Truncate(graphBucket).Unix()
+
+		targets := NewUniqueStrings()
+		for _, mention := range tweet.Mentions {
+			targets.Add(graphNodeID(mention))
+		}
+		for _, target := range targets.Strings() {
+			if target == source || target == "@" {
+				continue
+			}
+			key := graphEdgeKey{source: source, target: target}
+			buckets, inMap := mg.edges[key]
+			if !inMap {
+				buckets = make(map[int64]int)
+				mg.edges[key] = buckets
+			}
+			buckets[bucket]++
+		}
+	}
+}
+
+// Graph returns a snapshot of the graph with the query applied. Nodes and
+// edges are sorted by weight (heaviest first)
+func (mg *MentionGraph) Graph(q GraphQuery) Graph {
+	mg.mtx.RLock()
+	defer mg.mtx.RUnlock()
+
+	oldest := int64(0)
+	if q.Window > 0 {
+		oldest = mg.now().Add(-q.Window).Truncate(graphBucket).Unix()
+	}
+	if !q.From.IsZero() && q.From.Truncate(graphBucket).Unix() > oldest {
+		oldest = q.From.Truncate(graphBucket).Unix()
+	}
+	newest := int64(math.MaxInt64)
+	if !q.To.IsZero() {
+		newest = q.To.Unix()
+	}
+
+	graph := Graph{Nodes: make([]GraphNode, 0), Edges: make([]GraphEdge, 0)}
+	nodes := make(map[string]*GraphNode)
+	node := func(id string) *GraphNode {
+		if n, inMap := nodes[id]; inMap {
+			return n
+		}
+		n := &GraphNode{ID: id}
+		nodes[id] = n
+		return n
+	}
+
+	for key, buckets := range mg.edges {
+		weight := 0
+		first, last := int64(0), int64(0)
+		for bucket, cnt := range buckets {
+			if bucket < oldest || bucket >= newest {
+				continue
+			}
+			weight += cnt
+			if first == 0 || bucket < first {
+				first = bucket
+			}
+			if bucket > last {
+				last = bucket
+			}
+		}
+		if weight < 1 || weight < q.MinWeight {
+			continue
+		}
+
+		graph.Edges = append(graph.Edges, GraphEdge{
+			Source:    key.source,
+			Target:    key.target,
+			Weight:    weight,
+			FirstSeen: time.Unix(first, 0).UTC().Format(time.RFC1123Z),
+			LastSeen:  time.Unix(last, 0).Add(graphBucket).UTC().Format(time.RFC1123Z),
+		})
+		node(key.source).Mentions += weight
+		node(key.target).Mentioned += weight
+	}
+
+	for _, n := range nodes {
+		graph.Nodes = append(graph.Nodes, *n)
+	}
+
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		lhs, rhs := graph.Nodes[i], graph.Nodes[j]
+		if lhs.Mentions+lhs.Mentioned != rhs.Mentions+rhs.Mentioned {
+			return lhs.Mentions+lhs.Mentioned > rhs.Mentions+rhs.Mentioned
+		}
+		return lhs.ID < rhs.ID
+	})
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		lhs, rhs := graph.Edges[i], graph.Edges[j]
+		if lhs.Weight != rhs.Weight {
+			return lhs.Weight > rhs.Weight
+		}
+		if lhs.Source != rhs.Source {
+			return lhs.Source < rhs.Source
+		}
+		return lhs.Target < rhs.Target
+	})
+
+	return graph
+}
+
+// ParseGraphQuery builds a query from the API query parameters window (like
+// "24h" or "7d"), from, to, and min_weight
+func ParseGraphQuery(values url.Values) (GraphQuery, error) {
+	q := GraphQuery{}
+
+	var err error
+	if q.From, q.To, err = ParseTimeRange(values, time.Now()); err != nil {
+		return q, err
+	}
+
+	if txt := values.Get("window"); len(txt) > 0 {
+		window, err := parseDays(txt)
+		if err != nil || window < 0 {
+			return q, errors.New("window must be a duration like 24h or 7d")
+		}
+		q.Window = window
+	}
+
+	if txt := values.Get("min_weight"); len(txt) > 0 {
+		weight, err := strconv.Atoi(txt)
+		if err != nil || weight < 0 {
+			return q, errors.New("min_weight must be a non-negative integer")
+		}
+		q.MinWeight = weight
+	}
+
+	return q, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Export formats
+
+// xmlText returns s escaped for XML
+func xmlText(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// WriteGraphML writes the graph in GraphML format
+func (g Graph) WriteGraphML(target io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	buf.WriteString(`  <key id="mentions" for="node" attr.name="mentions" attr.type="int"/>` + "\n")
+	buf.WriteString(`  <key id="mentioned" for="node" attr.name="mentioned" attr.type="int"/>` + "\n")
+	buf.WriteString(`  <key id="weight" for="edge" attr.name="weight" attr.type="int"/>` + "\n")
+	buf.WriteString(`  <key id="first" for="edge" attr.name="first_seen" attr.type="string"/>` + "\n")
+	buf.WriteString(`  <key id="last" for="edge" attr.name="last_seen" attr.type="string"/>` + "\n")
+	buf.WriteString(`  <graph id="mentions" edgedefault="directed">` + "\n")
+
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&buf, "    <node id=\"%s\">\n", xmlText(n.ID))
+		fmt.Fprintf(&buf, "      <data key=\"mentions\">%d</data>\n", n.Mentions)
+		fmt.Fprintf(&buf, "      <data key=\"mentioned\">%d</data>\n", n.Mentioned)
+		buf.WriteString("    </node>\n")
+	}
+	for i, e := range g.Edges {
+		fmt.Fprintf(&buf, "    <edge id=\"e%d\" source=\"%s\" target=\"%s\">\n", i, xmlText(e.Source), xmlText(e.Target))
+		fmt.Fprintf(&buf, "      <data key=\"weight\">%d</data>\n", e.Weight)
+		fmt.Fprintf(&buf, "      <data key=\"first\">%s</data>\n", xmlText(e.FirstSeen))
+		fmt.Fprintf(&buf, "      <data key=\"last\">%s</data>\n", xmlText(e.LastSeen))
+		buf.WriteString("    </edge>\n")
+	}
+
+	buf.WriteString("  </graph>\n</graphml>\n")
+	_, err := io.WriteString(target, buf.String())
+	return err
+}
+
+// WriteDOT writes the graph in Graphviz DOT format. Edge pen widths scale
+// with the log of the weight so heavy edges stand out without swamping the
+// drawing
+func (g Graph) WriteDOT(target io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("digraph mentions {\n")
+	buf.WriteString("  node [shape=box];\n")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&buf, "  %s [mentions=%d, mentioned=%d];\n", strconv.Quote(n.ID), n.Mentions, n.Mentioned)
+	}
+	for _, e := range g.Edges {
+		width := 1
+		for w := e.Weight; w >= 10; w /= 10 {
+			width++
+		}
+		fmt.Fprintf(&buf, "  %s -> %s [weight=%d, label=\"%d\", penwidth=%d];\n",
+			strconv.Quote(e.Source), strconv.Quote(e.Target), e.Weight, e.Weight, width)
+	}
+	buf.WriteString("}\n")
+	_, err := io.WriteString(target, buf.String())
+	return err
+}
+
+// WriteGraph writes the graph in the named format: graphml or dot
+func (g Graph) WriteGraph(format string, target io.Writer) error {
+	switch strings.ToLower(format) {
+	case "graphml":
+		return g.WriteGraphML(target)
+	case "dot", "gv":
+		return g.WriteDOT(target)
+	}
+	return fmt.Errorf("Unknown graph format '%s' (use graphml or dot)", format)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testGraph(now time.Time) *MentionGraph {
+	graph := NewMentionGraph()
+	graph.now = func() time.Time { return now }
+
+	graph.Add(
+		trendRecord(1, now, time.Hour, "alice", nil, []string{"@Bob", "@bob", "@carol"}),
+		trendRecord(2, now, 2*time.Hour, "Alice", nil, []string{"@bob"}),
+		trendRecord(3, now, 48*time.Hour, "bob", nil, []string{"@alice", "@bob"}),
+		trendRecord(4, now, time.Hour, "carol", nil, nil),
+	)
+	// Duplicates are ignored
+	graph.Add(trendRecord(1, now, time.Hour, "alice", nil, []string{"@bob"}))
+	return graph
+}
+
+func TestMentionGraph(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 10, 9, 12, 30, 0, 0, time.UTC)
+	graph := testGraph(now)
+
+	g := graph.Graph(GraphQuery{})
+	assert.Len(g.Edges, 3)
+	assert.Equal("@alice", g.Edges[0].Source)
+	assert.Equal("@bob", g.Edges[0].Target)
+	assert.Equal(2, g.Edges[0].Weight)
+	assert.Equal(time.Date(2016, 10, 9, 10, 0, 0, 0, time.UTC).Format(time.RFC1123Z), g.Edges[0].FirstSeen)
+	assert.Equal(time.Date(2016, 10, 9, 12, 0, 0, 0, time.UTC).Format(time.RFC1123Z), g.Edges[0].LastSeen)
+
+	assert.Len(g.Nodes, 3)
+	assert.Equal(GraphNode{ID: "@alice", Mentions: 3, Mentioned: 1}, g.Nodes[0])
+	assert.Equal(GraphNode{ID: "@bob", Mentions: 1, Mentioned: 2}, g.Nodes[1])
+	assert.Equal(GraphNode{ID: "@carol", Mentions: 0, Mentioned: 1}, g.Nodes[2])
+
+	g = graph.Graph(GraphQuery{Window: 24 * time.Hour})
+	assert.Len(g.Edges, 2)
+	assert.Len(g.Nodes, 3)
+
+	g = graph.Graph(GraphQuery{From: now.Add(-3 * time.Hour), To: now.Add(-90 * time.Minute)})
+	assert.Len(g.Edges, 1)
+	assert.Equal(1, g.Edges[0].Weight)
+
+	g = graph.Graph(GraphQuery{MinWeight: 2})
+	assert.Len(g.Edges, 1)
+	assert.Len(g.Nodes, 2)
+
+	// Tweets outside the dedup window are forgotten (the edges are kept)
+	later := now.Add(seenTweetWindow + time.Hour)
+	graph.now = func() time.Time { return later }
+	graph.Add(trendRecord(5, later, time.Minute, "carol", nil, []string{"@alice"}))
+	assert.Len(graph.seen.ids, 1)
+	assert.Len(graph.Graph(GraphQuery{}).Edges, 4)
+}
+
+func TestParseGraphQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	parse := func(raw string) (GraphQuery, error) {
+		values, err := url.ParseQuery(raw)
+		pcheck(err)
+		return ParseGraphQuery(values)
+	}
+
+	q, err := parse("")
+	assert.Nil(err)
+	assert.Equal(GraphQuery{}, q)
+
+	q, err = parse("window=30d&min_weight=3")
+	assert.Nil(err)
+	assert.Equal(GraphQuery{Window: 30 * 24 * time.Hour, MinWeight: 3}, q)
+
+	q, err = parse("from=2016-10-01&to=2016-10-02")
+	assert.Nil(err)
+	assert.Equal(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC), q.From)
+	assert.Equal(time.Date(2016, 10, 2, 0, 0, 0, 0, time.UTC), q.To)
+
+	_, err = parse("window=later")
+	assert.NotNil(err)
+	_, err = parse("min_weight=-1")
+	assert.NotNil(err)
+}
+
+func TestGraphExport(t *testing.T) {
+	assert := assert.New(t)
+
+	g := testGraph(time.Now()).Graph(GraphQuery{})
+	g.Nodes = append(g.Nodes, GraphNode{ID: "@<odd&\"name\">"})
+
+	var buf bytes.Buffer
+	assert.Nil(g.WriteGraph("GraphML", &buf))
+	assert.True(strings.HasPrefix(buf.String(), xml.Header))
+
+	// Must be valid XML
+	parsed := struct {
+		Graph struct {
+			Nodes []struct {
+				ID string `xml:"id,attr"`
+			} `xml:"node"`
+			Edges []struct {
+				Source string `xml:"source,attr"`
+				Target string `xml:"target,attr"`
+			} `xml:"edge"`
+		} `xml:"graph"`
+	}{}
+	assert.Nil(xml.Unmarshal(buf.Bytes(), &parsed))
+	assert.Len(parsed.Graph.Nodes, 4)
+	assert.Equal("@<odd&\"name\">", parsed.Graph.Nodes[3].ID)
+	assert.Len(parsed.Graph.Edges, 3)
+	assert.Equal("@alice", parsed.Graph.Edges[0].Source)
+
+	buf.Reset()
+	assert.Nil(g.WriteGraph("dot", &buf))
+	dot := buf.String()
+	assert.True(strings.HasPrefix(dot, "digraph mentions {"))
+	assert.Contains(dot, `"@alice" -> "@bob" [weight=2, label="2", penwidth=1];`)
+	assert.Contains(dot, `"@<odd&\"name\">"`)
+
+	assert.NotNil(g.WriteGraph("png", &buf))
+}
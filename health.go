@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// maxStallTimeout caps the watchdog backoff (see StallTimeout)
+const maxStallTimeout = time.Hour
+
+// StreamHealth tracks how well the mention stream is doing. The stream calls
+// Started when it connects and Touch for every message of any kind. It also
+// passes along stall warnings, limit notices, and disconnects. Everything is
+// thread-safe since the API reads while the stream writes
+type StreamHealth struct {
+	started          time.Time
+	lastMsg          time.Time
+	messages         int64
+	connects         int64
+	restarts         int64
+	quietRestarts    uint // Watchdog restarts since the last message
+	stallWarnings    int64
+	lastWarnPercent  int
+	lastWarnTime     time.Time
+	limitNotices     int64
+	undeliveredConn  int64
+	undeliveredTotal int64
+	disconnects      int64
+	lastDisconnect   string
+	mtx              sync.RWMutex
+}
+
+// HealthStats is a snapshot of StreamHealth for the stats API
+type HealthStats struct {
+	StreamStarted      string  // When the current stream connected
+	LastMessage        string  // When we last got a message of any kind
+	SecondsSinceLast   float64 // Seconds since LastMessage
+	Messages           int64   // Messages of any kind received
+	Connects           int64   // Times the stream connected (including reconnects)
+	WatchdogRestarts   int64   // Times the watchdog restarted a quiet stream
+	StallWarnings      int64   // Stall warnings received
+	LastWarningPercent int     // Percent full from the last stall warning
+	LastWarningTime    string  // When the last stall warning was received
+	LimitNotices       int64   // Limit notices received
+	Undelivered        int64   // Undelivered matches reported by limit notices
+	Disconnects        int64   // Disconnect messages received
+	LastDisconnect     string  // Reason given for the last disconnect
+}
+
+// NewStreamHealth returns health tracking for a stream that hasn't started
+func NewStreamHealth() *StreamHealth {
+	return &StreamHealth{}
+}
+
+// Started should be called when a stream connects. It counts as a message
+// so that a new stream gets a full timeout before being considered quiet
+func (sh *StreamHealth) Started() {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	sh.started = time.Now()
+	sh.lastMsg = sh.started
+	sh.connects++
+	sh.undeliveredConn = 0
+}
+
+// Touch records that a message (of any kind) was received
+func (sh *StreamHealth) Touch() {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	sh.lastMsg = time.Now()
+	sh.messages++
+	sh.quietRestarts = 0
+}
+
+// Restarted records a watchdog restart. The restarted stream gets a full
+// timeout before it is considered quiet, even if it fails to connect
+func (sh *StreamHealth) Restarted() {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	sh.restarts++
+	sh.quietRestarts++
+	sh.lastMsg = time.Now()
+}
+
+// StallTimeout returns how long the stream may be quiet before the watchdog
+// restarts it. Twitter's keep-alives aren't visible to us, so a healthy but
+// quiet filter looks stalled: every restart without a message since doubles
+// base (up to maxStallTimeout) so we don't reconnect often enough to be rate
+// limited
+func (sh *StreamHealth) StallTimeout(base time.Duration) time.Duration {
+	sh.mtx.RLock()
+	defer sh.mtx.RUnlock()
+	timeout := base
+	for i := uint(0); i < sh.quietRestarts && timeout < maxStallTimeout; i++ {
+		timeout *= 2
+	}
+	if timeout > maxStallTimeout && base < maxStallTimeout {
+		timeout = maxStallTimeout
+	}
+	return timeout
+}
+
+// Warning records a stall warning
+func (sh *StreamHealth) Warning(warn *twitter.StallWarning) {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	sh.stallWarnings++
+	sh.lastWarnPercent = warn.PercentFull
+	sh.lastWarnTime = time.Now()
+}
+
+// Limit records a limit notice. Twitter reports the number of undelivered
+// matches since the connection was made, so we only add what's new
+func (sh *StreamHealth) Limit(limit *twitter.StreamLimit) {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	sh.limitNotices++
+	if limit.Track > sh.undeliveredConn {
+		sh.undeliveredTotal += limit.Track - sh.undeliveredConn
+		sh.undeliveredConn = limit.Track
+	}
+}
+
+// Disconnect records a disconnect message
+func (sh *StreamHealth) Disconnect(dis *twitter.StreamDisconnect) {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	sh.disconnects++
+	sh.lastDisconnect = dis.Reason
+}
+
+// SinceLast returns the time since the last message (or the stream start).
+// If the stream has never started, zero is returned
+func (sh *StreamHealth) SinceLast() time.Duration {
+	sh.mtx.RLock()
+	defer sh.mtx.RUnlock()
+	if sh.lastMsg.IsZero() {
+		return 0
+	}
+	return time.Since(sh.lastMsg)
+}
+
+// fmtTime returns "" for zero times instead of Go's year 1
+func fmtTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC1123Z)
+}
+
+// Stats returns a snapshot of the current health
+func (sh *StreamHealth) Stats() HealthStats {
+	since := sh.SinceLast()
+
+	sh.mtx.RLock()
+	defer sh.mtx.RUnlock()
+	return HealthStats{
+		StreamStarted:      fmtTime(sh.started),
+		LastMessage:        fmtTime(sh.lastMsg),
+		SecondsSinceLast:   since.Seconds(),
+		Messages:           sh.messages,
+		Connects:           sh.connects,
+		WatchdogRestarts:   sh.restarts,
+		StallWarnings:      sh.stallWarnings,
+		LastWarningPercent: sh.lastWarnPercent,
+		LastWarningTime:    fmtTime(sh.lastWarnTime),
+		LimitNotices:       sh.limitNotices,
+		Undelivered:        sh.undeliveredTotal,
+		Disconnects:        sh.disconnects,
+		LastDisconnect:     sh.lastDisconnect,
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamHealth(t *testing.T) {
+	assert := assert.New(t)
+
+	sh := NewStreamHealth()
+	assert.Equal(time.Duration(0), sh.SinceLast())
+
+	stats := sh.Stats()
+	assert.Equal("", stats.StreamStarted)
+	assert.Equal("", stats.LastMessage)
+
+	sh.Started()
+	sh.Touch()
+	sh.Touch()
+	sh.Warning(&twitter.StallWarning{PercentFull: 60})
+	sh.Warning(&twitter.StallWarning{PercentFull: 80})
+	sh.Disconnect(&twitter.StreamDisconnect{Code: 7, Reason: "admin logout"})
+
+	stats = sh.Stats()
+	assert.NotEqual("", stats.StreamStarted)
+	assert.NotEqual("", stats.LastWarningTime)
+	assert.Equal(int64(2), stats.Messages)
+	assert.Equal(int64(2), stats.StallWarnings)
+	assert.Equal(80, stats.LastWarningPercent)
+	assert.Equal(int64(1), stats.Disconnects)
+	assert.Equal("admin logout", stats.LastDisconnect)
+	assert.True(sh.SinceLast() < time.Minute)
+}
+
+func TestStreamHealthLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	sh := NewStreamHealth()
+	sh.Started()
+
+	// Counts are cumulative per connection
+	sh.Limit(&twitter.StreamLimit{Track: 10})
+	sh.Limit(&twitter.StreamLimit{Track: 25})
+	assert.Equal(int64(25), sh.Stats().Undelivered)
+
+	// New connection starts over
+	sh.Started()
+	sh.Limit(&twitter.StreamLimit{Track: 5})
+	stats := sh.Stats()
+	assert.Equal(int64(30), stats.Undelivered)
+	assert.Equal(int64(3), stats.LimitNotices)
+}
+
+func TestWatchdogNeedsRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	tm := NewTwitterMentions(nil, "", "", "", "")
+	assert.Nil(tm.Stop()) // Nothing running is OK
+
+	// Never started: never restart
+	assert.False(tm.needsRestart(time.Nanosecond))
+
+	tm.Health.Started()
+	time.Sleep(5 * time.Millisecond)
+	assert.True(tm.needsRestart(time.Millisecond))
+	assert.False(tm.needsRestart(time.Hour))
+	assert.False(tm.needsRestart(0))
+
+	// A restart gets a full timeout
+	tm.Health.Restarted()
+	assert.False(tm.needsRestart(time.Minute))
+	assert.Equal(int64(1), tm.Health.Stats().WatchdogRestarts)
+
+	// Quiet restarts back off until a message arrives
+	assert.Equal(2*time.Minute, tm.Health.StallTimeout(time.Minute))
+	tm.Health.Restarted()
+	assert.Equal(4*time.Minute, tm.Health.StallTimeout(time.Minute))
+	for i := 0; i < 10; i++ {
+		tm.Health.Restarted()
+	}
+	assert.Equal(maxStallTimeout, tm.Health.StallTimeout(time.Minute))
+	assert.Equal(2*maxStallTimeout, tm.Health.StallTimeout(2*maxStallTimeout))
+	tm.Health.Touch()
+	assert.Equal(time.Minute, tm.Health.StallTimeout(time.Minute))
+
+	// Disabled watchdog returns right away
+	quit := make(chan struct{})
+	tm.Watchdog(0, quit)
+	close(quit)
+}
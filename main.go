@@ -3,14 +3,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -24,6 +30,7 @@ var buildDate string // Set by our build script
 const (
 	tweetStoreFile  = "tweetstore.gob"
 	streamStoreFile = "stream.json"
+	trackStoreFile  = "tracking.json"
 )
 
 /////////////////////////////////////////////////////////////////////////////
@@ -31,7 +38,8 @@ const (
 
 // WrappedTwitterClient is a thin wrapper around twitter.Client
 type WrappedTwitterClient struct {
-	client *twitter.Client
+	client  *twitter.Client
+	metrics *Metrics
 }
 
 // RetrieveHomeTimeline delegates to twitter.Client's Timelines.HomeTimeline
@@ -48,6 +56,7 @@ func (cli *WrappedTwitterClient) RetrieveHomeTimeline(count int, since int64, ma
 		homeTimelineParams.MaxID,
 		homeTimelineParams.SinceID)
 	tweets, resp, tweetErr := cli.client.Timelines.HomeTimeline(homeTimelineParams)
+	cli.metrics.ObserveTwitterCall("home_timeline", resp, tweetErr)
 	if tweetErr != nil {
 		log.Printf("GET Home Timeline FAILED => Resp[%d]:%s Headers:%v\n", resp.StatusCode, resp.Status, resp.Header)
 	}
@@ -57,16 +66,6 @@ func (cli *WrappedTwitterClient) RetrieveHomeTimeline(count int, since int64, ma
 /////////////////////////////////////////////////////////////////////////////
 // Actual service running
 
-func jsonResponse(w http.ResponseWriter, req *http.Request, jsonSrc interface{}) {
-	js, err := json.Marshal(jsonSrc)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
-}
-
 // statResult is what we return for the stats API (and isn't used anywhere else)
 type statResult struct {
 	LastUpdateTime string
@@ -74,62 +73,195 @@ type statResult struct {
 	MentionCount   int64
 	StoreSizeMB    float32
 	StreamSizeMB   float32
+	StreamFilter   StreamFilter
+	Tracking       TrackStats
+	StreamHealth   HealthStats
+	Sinks          map[string]SinkStats
+	Cache          CacheStats
+	Categories     categoryStats
 	Accts          map[string]int
 }
 
-// fileSizeMB returns the size of the given file in MB. On any error (including
-// file not found), 0.0 is returned
-func fileSizeMB(filename string) float32 {
+// tweetsResult is what we return for the tweets API
+type tweetsResult struct {
+	Acct           string
+	AcctCategories []string       // Categories for the account itself
+	Categories     map[string]int // Count of Tweets in each category
+	Total          int            // Tweets matching the filters (all pages)
+	NextMaxID      int64          // max_id for the next page (0 if no more)
+	Tweets         TweetRecordList
+}
+
+// versionResult is what we return for the version API
+type versionResult struct {
+	BuildDate  string // Empty unless built with script/build
+	APIVersion string
+	GoVersion  string
+}
+
+// updateResult is what we return for the admin update API
+type updateResult struct {
+	Backfill bool
+	Added    int // New tweets in the store
+}
+
+// streamRestartResult is what we return for the admin stream restart API
+type streamRestartResult struct {
+	Accts []string // Accounts tracked (everything in the store not muted)
+	Terms []string // Extra track terms
+}
+
+// categoryStats are the per-category counts for the stats API
+type categoryStats struct {
+	Timeline map[string]int // Tweets in the store
+	Mentions map[string]int // Mentions streamed since service start
+}
+
+// fileSize returns the size of the given file in bytes. On any error
+// (including file not found), 0 is returned
+func fileSize(filename string) int64 {
 	st, err := os.Stat(filename)
 	if err != nil || st.IsDir() {
-		return 0.0
+		return 0
 	}
-	return float32(st.Size()) / 1048576.0
+	return st.Size()
 }
 
-func runService(addrListen string, service *TwivilityService, mentions *TwitterMentions) {
+// fileSizeMB returns the size of the given file in MB (see fileSize)
+func fileSizeMB(filename string) float32 {
+	return float32(fileSize(filename)) / 1048576.0
+}
+
+// serviceOptions are the settings for runService from the command line
+type serviceOptions struct {
+	Addr         string         // Address to listen on (default 127.0.0.1:8484)
+	RecentSize   int            // Recent mentions kept for the recent-stream API
+	StallTimeout time.Duration  // Restart the stream after this long without messages
+	TLSCert      string         // Certificate file (serve HTTPS if given with TLSKey)
+	TLSKey       string         // Private key file for TLSCert
+	Auth         *Authenticator // nil for no authentication
+	Metrics      *Metrics       // Shared with the service and mention stream
+	ClientDir    string         // Serve the client from here (default: embedded)
+
+	// How long to wait for in-flight requests on shutdown
+	ShutdownTimeout time.Duration
+}
+
+func runService(opts serviceOptions, service *TwivilityService, mentions *TwitterMentions, alerts *AlertMonitor) error {
+	// SIGINT or SIGTERM starts a graceful shutdown (see the end of this
+	// function). We listen from the start so the initial update is covered
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	// Track terms and muted accounts (changed by the admin API). The hashtag
+	// file is only used until the settings are first saved
+	settings, err := LoadTrackSettings(trackStoreFile, mentions.Hashtags)
+	if err != nil {
+		return err
+	}
+	mentions.SetHashtags(settings.Terms())
+	streamAccounts := func() []string {
+		return settings.Accounts(service.GetAccounts())
+	}
+
+	clientFiles, err := ClientFiles(opts.ClientDir)
+	if err != nil {
+		return err
+	}
+	if opts.ClientDir != "" {
+		log.Printf("Serving the client from %s\n", opts.ClientDir)
+	}
+	dashboard, err := NewDashboard(clientFiles, opts.ClientDir != "")
+	if err != nil {
+		return err
+	}
+
 	// Initial update
 	service.UpdateTwitterFile(false)
-	lastUpdate := time.Now()
+	var lastUpdate atomic.Value // time.Time: set by the ticker and the admin API
+	lastUpdate.Store(time.Now())
 
-	// Start the mention stream
-	var lastMentionRecv time.Time
+	// Start the mention stream - but first load the most recent mentions
+	// we've already seen
+	recentMentions, err := LoadRecentMentions(streamStoreFile, opts.RecentSize)
+	if err != nil {
+		log.Printf("Could not read recent mentions from %s: %v\n", streamStoreFile, err)
+	}
+
+	// Hashtag trends, the mention graph, activity time series, and the
+	// search index from everything we have, kept current as records arrive
+	trends := NewHashtagTrends()
+	graph := NewMentionGraph()
+	activity := NewActivitySeries()
+	search := NewSearchIndex()
+	duplicates := NewDuplicateClusters()
+
+	// Bumped whenever the data changes (for API caching)
+	version := NewStoreVersion()
 
-	var recentMentions struct {
-		tweets []TweetRecord
-		curr   int
+	timeline := service.GetAllTweets()
+	version.Bump(timeline...)
+	trends.Add(SourceTimeline, timeline...)
+	graph.Add(timeline...)
+	activity.Add(SourceTimeline, timeline...)
+	search.Add(SourceTimeline, timeline...)
+	service.Added = func(tweets TweetRecordList) {
+		trends.Add(SourceTimeline, tweets...)
+		graph.Add(tweets...)
+		activity.Add(SourceTimeline, tweets...)
+		search.Add(SourceTimeline, tweets...)
+		version.Bump(tweets...)
 	}
-	recentMentions.curr = -1
-	recentMentions.tweets = make([]TweetRecord, 100)
 
-	mentions.Mention = func(tweet TweetRecord) {
-		lastMentionRecv = time.Now()
+	err = ReadMentionFile(streamStoreFile, func(rec TweetRecord) {
+		trends.Add(SourceMentions, rec)
+		graph.Add(rec)
+		activity.Add(SourceMentions, rec)
+		search.Add(SourceMentions, rec)
+		duplicates.Add(rec)
+		version.Bump(rec)
+	})
+	if err != nil {
+		log.Printf("Could not read mentions from %s: %v\n", streamStoreFile, err)
+	}
 
-		recentMentions.curr = (recentMentions.curr + 1) % 100
-		recentMentions.tweets[recentMentions.curr] = tweet
+	mentionCategories := NewCategoryCounter()
+	mentions.Mention = func(tweet TweetRecord) {
+		recentMentions.Add(tweet)
+		mentionCategories.Add(tweet)
+		trends.Add(SourceMentions, tweet)
+		graph.Add(tweet)
+		activity.Add(SourceMentions, tweet)
+		search.Add(SourceMentions, tweet)
+		duplicates.Add(tweet)
+		alerts.Add(tweet)
+		version.Bump(tweet)
 
-		cnt := mentions.Count
+		cnt := mentions.Count()
 		if cnt > 0 && cnt%1000 == 0 {
 			log.Printf("Mentions: Seen %d\n", cnt)
 		}
 	}
 
-	go mentions.Stream(service.GetAccounts())
-	defer mentions.Stop()
+	go mentions.Stream(streamAccounts())
+
+	// Restart the stream if it goes quiet (independent of our update ticker)
+	watchdogQuit := make(chan struct{})
+	go mentions.Watchdog(opts.StallTimeout, watchdogQuit)
 
 	// Make sure to update the tweets every 5 minutes. We also take the
 	// opportunity to stop and restart our stream gathering
 	updateTicker := time.NewTicker(5 * time.Minute)
 	updateQuit := make(chan struct{})
-	defer close(updateQuit)
 	go func() {
 		for {
 			select {
 			case <-updateTicker.C:
 				mentions.Stop()
 				service.UpdateTwitterFile(false)
-				lastUpdate = time.Now()
-				go mentions.Stream(service.GetAccounts())
+				lastUpdate.Store(time.Now())
+				go mentions.Stream(streamAccounts())
 			case <-updateQuit:
 				updateTicker.Stop()
 				return
@@ -137,80 +269,820 @@ func runService(addrListen string, service *TwivilityService, mentions *TwitterM
 		}
 	}()
 
-	// API endpoints
+	// API endpoints: served at /api/v1 and (for older clients) /api
 
-	http.HandleFunc("/api/stats", func(w http.ResponseWriter, req *http.Request) {
-		stats := statResult{
-			LastUpdateTime: lastUpdate.Format(time.RFC1123Z),
-			LastStreamRecv: lastMentionRecv.Format(time.RFC1123Z),
-			MentionCount:   mentions.Count,
-			StoreSizeMB:    fileSizeMB(tweetStoreFile),
-			StreamSizeMB:   fileSizeMB(streamStoreFile),
-			Accts:          make(map[string]int),
-		}
-		for _, acct := range service.GetAccounts() {
-			stats.Accts[acct] = service.GetTweets(acct).Len()
-		}
+	api := NewAPIRouter()
+	api.Prefix = "/api/" + APIVersion
+	api.Cache = NewResponseCache(version, 0)
+	api.Metrics = opts.Metrics
+	timeRangeParams := []APIParam{
+		{"from", "Only tweets created at or after this time"},
+		{"to", "Only tweets created before this time"},
+	}
+	seriesParams := []APIParam{
+		{"step", "minute, hour (the default), or day"},
+		{"from", "Start time (default depends on step)"},
+		{"to", "End time (default now)"},
+		{"source", "timeline, mentions, or all (the default)"},
+		{"acct", "A series of tweets by this account (may be repeated)"},
+		{"hashtag", "A series of tweets using this hashtag (may be repeated)"},
+		{"mention", "A series of tweets mentioning this account (may be repeated)"},
+	}
 
-		log.Printf("GET %s - returning stats\n", req.URL.Path)
-		jsonResponse(w, req, stats)
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/stats",
+		Summary: "Statistics on the current service",
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			stats := statResult{
+				LastUpdateTime: lastUpdate.Load().(time.Time).Format(time.RFC1123Z),
+				LastStreamRecv: recentMentions.LastRecv().Format(time.RFC1123Z),
+				MentionCount:   mentions.Count(),
+				StoreSizeMB:    fileSizeMB(tweetStoreFile),
+				StreamSizeMB:   fileSizeMB(streamStoreFile),
+				StreamFilter:   mentions.CurrentFilter(),
+				Tracking:       mentions.Terms.Stats(),
+				StreamHealth:   mentions.Health.Stats(),
+				Sinks:          make(map[string]SinkStats),
+				Cache:          api.Cache.Stats(),
+				Accts:          make(map[string]int),
+				Categories: categoryStats{
+					Timeline: CountCategories(service.GetAllTweets()),
+					Mentions: mentionCategories.Counts(),
+				},
+			}
+			for _, acct := range service.GetAccounts() {
+				stats.Accts[acct] = service.GetTweets(acct).Len()
+			}
+			if mentions.Sinks != nil {
+				stats.Sinks = mentions.Sinks.Stats()
+			}
+
+			log.Printf("GET %s - returning stats\n", req.URL.Path)
+			jsonResponse(w, req, stats)
+		},
 	})
 
-	http.HandleFunc("/api/accts", func(w http.ResponseWriter, req *http.Request) {
-		accts := service.GetAccounts()
-		log.Printf("GET %s - returning list of len %d\n", req.URL.Path, len(accts))
-		jsonResponse(w, req, accts)
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/accts",
+		Summary: "The accounts in the timeline",
+		Cache:   true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			accts := service.GetAccounts()
+			log.Printf("GET %s - returning list of len %d\n", req.URL.Path, len(accts))
+			jsonResponse(w, req, accts)
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/accts/{acct}/profile",
+		Summary: "Activity profile (posting-time heatmap, top hashtags and mentions) for an account",
+		Query: append([]APIParam{
+			{"tz", "Time zone for the heatmap and dates (default UTC)"},
+			{"limit", "Number of top hashtags and mentions (default 10)"},
+		}, timeRangeParams...),
+		Cache: true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			acct := ""
+			for _, known := range service.GetAccounts() {
+				if strings.EqualFold(known, params["acct"]) {
+					acct = known
+				}
+			}
+			if acct == "" {
+				notFound(w, "Unknown account "+params["acct"])
+				return
+			}
+			query, err := ParseProfileQuery(req.URL.Query(), time.Now())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			profile := BuildAcctProfile(acct, service.GetTweets(acct), query)
+			log.Printf("GET %s - returning profile of %d tweets for acct %s\n", req.URL.Path, profile.Tweets, acct)
+			jsonResponse(w, req, profile)
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/tweets/{acct}",
+		Summary: "A page of an account's tweets, newest first",
+		Query: append([]APIParam{
+			{"limit", "Most tweets returned (default 200, max 1000)"},
+			{"max_id", "Only tweets with an ID less than or equal to this"},
+			{"since_id", "Only tweets with an ID greater than this"},
+			{"hashtag", "Only tweets using this hashtag"},
+			{"mention", "Only tweets mentioning this account"},
+			{"type", "retweet or original"},
+			{"text", "Only tweets containing this text"},
+		}, timeRangeParams...),
+		Cache: true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			acct := params["acct"]
+			query, err := ParseTweetsQuery(req.URL.Query(), time.Now())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			page := query.Page(service.GetTweets(acct))
+			log.Printf("GET %s - returning list of len %d (of %d) for acct %s\n", req.URL.Path, len(page.Tweets), page.Total, acct)
+			jsonResponse(w, req, tweetsResult{
+				Acct:           acct,
+				AcctCategories: service.Classifier.ClassifyAcct(acct),
+				Categories:     CountCategories(page.Tweets),
+				Total:          page.Total,
+				NextMaxID:      page.NextMaxID,
+				Tweets:         page.Tweets,
+			})
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/recent-stream",
+		Summary: "The most recently streamed mentions, newest first",
+		Query: append([]APIParam{
+			{"acct", "Only mentions from or mentioning this account"},
+			{"hashtag", "Only mentions using this hashtag"},
+			{"limit", "Most mentions returned"},
+			{"since_id", "Only mentions with an ID greater than this"},
+			{"collapse", "true to return only the newest of each near-duplicate cluster"},
+		}, timeRangeParams...),
+		Cache: true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			query, err := ParseRecentQuery(req.URL.Query())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			var tweets TweetRecordList
+			if query.Collapse {
+				// Collapse before we limit so we return as many as we can
+				limit := query.Limit
+				query.Limit = 0
+				tweets = duplicates.Collapse(recentMentions.Query(query), limit)
+			} else {
+				tweets = recentMentions.Query(query)
+			}
+			log.Printf("GET %s - returning list of len %d\n", req.URL.Path, len(tweets))
+			jsonResponse(w, req, tweets)
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/trends/hashtags",
+		Summary: "Top hashtags for one or more sliding windows",
+		Query: []APIParam{
+			{"window", "Duration like 1h or 7d (may be repeated, default 1h,24h,7d)"},
+			{"acct", "Only tweets from or mentioning this account"},
+			{"source", "timeline, mentions, or all (the default)"},
+			{"limit", "Hashtags per window (default 20, 0 for all)"},
+		},
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			query, err := ParseTrendQuery(req.URL.Query())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			windows, err := trends.Top(query)
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			log.Printf("GET %s - returning %d windows\n", req.URL.Path, len(windows))
+			jsonResponse(w, req, windows)
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/graph",
+		Summary: "The directed who-mentions-whom graph",
+		Query: append([]APIParam{
+			{"window", "Only mentions this recent (like 24h or 7d)"},
+			{"min_weight", "Only edges with at least this weight"},
+		}, timeRangeParams...),
+		Cache: true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			query, err := ParseGraphQuery(req.URL.Query())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			g := graph.Graph(query)
+			log.Printf("GET %s - returning %d nodes and %d edges\n", req.URL.Path, len(g.Nodes), len(g.Edges))
+			jsonResponse(w, req, g)
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/timeseries",
+		Summary: "Activity time series (tweet counts per bucket)",
+		Query:   seriesParams,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			query, err := ParseSeriesQuery(req.URL.Query(), time.Now())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			result, err := activity.Query(query)
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			log.Printf("GET %s - returning %d series\n", req.URL.Path, len(result.Series))
+			jsonResponse(w, req, result)
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/sentiment",
+		Summary: "Sentiment time series (default: mentions of every account)",
+		Query:   seriesParams,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			query, err := ParseSeriesQuery(req.URL.Query(), time.Now())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			if len(query.Accts)+len(query.Hashtags)+len(query.Mentions) < 1 {
+				// Default to comparing the mention tone of every tracked account
+				query.Mentions = service.GetAccounts()
+			}
+			result, err := activity.Query(query)
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			log.Printf("GET %s - returning %d sentiment series\n", req.URL.Path, len(result.Series))
+			jsonResponse(w, req, result)
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/search",
+		Summary: "Full-text search of the timeline and streamed mentions",
+		Query: append([]APIParam{
+			{"q", "The search query (required)"},
+			{"limit", "Most hits returned (default 50, max 1000)"},
+			{"offset", "Hits to skip (for paging)"},
+		}, timeRangeParams...),
+		Cache: true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			query, err := ParseSearchQuery(req.URL.Query(), time.Now())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			result, err := search.Search(query)
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			log.Printf("GET %s - returning %d of %d hits for %s\n", req.URL.Path, len(result.Hits), result.Total, query.Query)
+			jsonResponse(w, req, result)
+		},
 	})
 
-	http.HandleFunc("/api/tweets/", func(w http.ResponseWriter, req *http.Request) {
-		acct := strings.Replace(req.URL.Path, "/api/tweets/", "", 1)
-		tweets := service.GetTweets(acct)
-		log.Printf("GET %s - returning list of len %d for acct %s\n", req.URL.Path, len(tweets), acct)
-		jsonResponse(w, req, tweets)
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/duplicates",
+		Summary: "Clusters of near-duplicate streamed mentions",
+		Query: []APIParam{
+			{"min_size", "Smallest cluster returned (default 2)"},
+			{"limit", "Most clusters returned (default 50)"},
+		},
+		Cache: true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			query, err := ParseDuplicateQuery(req.URL.Query())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			clusters := duplicates.Clusters(query)
+			log.Printf("GET %s - returning %d duplicate clusters\n", req.URL.Path, len(clusters))
+			jsonResponse(w, req, clusters)
+		},
 	})
 
-	http.HandleFunc("/api/recent-stream", func(w http.ResponseWriter, req *http.Request) {
-		tweets := TweetRecordList(make([]TweetRecord, 0, 100))
-		for _, tw := range recentMentions.tweets {
-			if tw.TweetID != 0 {
-				tweets = append(tweets, tw)
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/alerts",
+		Summary: "Mention spike alert rules, active alerts, and recent alerts",
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			result := alerts.Alerts()
+			log.Printf("GET %s - returning %d active and %d recent alerts\n", req.URL.Path, len(result.Active), len(result.Recent))
+			jsonResponse(w, req, result)
+		},
+	})
+
+	// Admin endpoints: changing what we track restarts the stream so the
+	// change takes effect right away
+
+	restartStream := func() streamRestartResult {
+		mentions.SetHashtags(settings.Terms())
+		accts := streamAccounts()
+		go mentions.Stream(accts)
+		sort.Strings(accts)
+		return streamRestartResult{Accts: accts, Terms: settings.Terms()}
+	}
+	trackChange := func(param string, parse func(string) (string, error), change func(string) (bool, error)) APIHandler {
+		return func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			entry, err := parse(params[param])
+			if err != nil {
+				badRequest(w, err)
+				return
 			}
+			changed, err := change(entry)
+			if err != nil {
+				log.Printf("%s %s - could not save track settings: %v\n", req.Method, req.URL.Path, err)
+				writeAPIError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+				return
+			}
+			log.Printf("%s %s - %s by %s (changed: %v)\n", req.Method, req.URL.Path, entry, requestUser(req).Name, changed)
+			if changed {
+				restartStream()
+			}
+			jsonResponse(w, req, settings.Lists())
 		}
-		SortTwitterRecords(tweets)
-		jsonResponse(w, req, tweets)
+	}
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/admin/track",
+		Summary: "Extra track terms and muted accounts",
+		Admin:   true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			log.Printf("GET %s - returning track settings\n", req.URL.Path)
+			jsonResponse(w, req, settings.Lists())
+		},
+	})
+	api.Add(APIRoute{
+		Method:  http.MethodPut,
+		Path:    "/admin/track/terms/{term}",
+		Summary: "Track a hashtag or @mention in the stream",
+		Admin:   true,
+		Handler: trackChange("term", ParseTrackTerm, settings.AddTerm),
+	})
+	api.Add(APIRoute{
+		Method:  http.MethodDelete,
+		Path:    "/admin/track/terms/{term}",
+		Summary: "Stop tracking a hashtag or @mention",
+		Admin:   true,
+		Handler: trackChange("term", ParseTrackTerm, settings.RemoveTerm),
+	})
+	api.Add(APIRoute{
+		Method:  http.MethodPut,
+		Path:    "/admin/track/muted/{acct}",
+		Summary: "Stop tracking a stored account in the stream",
+		Admin:   true,
+		Handler: trackChange("acct", ParseMutedAccount, settings.Mute),
+	})
+	api.Add(APIRoute{
+		Method:  http.MethodDelete,
+		Path:    "/admin/track/muted/{acct}",
+		Summary: "Track a muted account again",
+		Admin:   true,
+		Handler: trackChange("acct", ParseMutedAccount, settings.Unmute),
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodPost,
+		Path:    "/admin/update",
+		Summary: "Update the tweet store from Twitter now",
+		Query: []APIParam{
+			{"backfill", "true to query as if the store were empty first (default false)"},
+		},
+		Admin: true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			result := updateResult{}
+			if txt := req.URL.Query().Get("backfill"); txt != "" {
+				backfill, err := strconv.ParseBool(txt)
+				if err != nil {
+					badRequest(w, errors.New("Invalid backfill (use true or false): "+txt))
+					return
+				}
+				result.Backfill = backfill
+			}
+
+			log.Printf("POST %s - update (backfill %v) requested by %s\n", req.URL.Path, result.Backfill, requestUser(req).Name)
+			if result.Backfill {
+				added, err := service.UpdateTwitterFile(true)
+				if err != nil {
+					writeAPIError(w, http.StatusInternalServerError, ErrCodeInternal, "Backfill failed: "+err.Error())
+					return
+				}
+				result.Added += added
+			}
+			added, err := service.UpdateTwitterFile(false)
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, ErrCodeInternal, "Update failed: "+err.Error())
+				return
+			}
+			result.Added += added
+			lastUpdate.Store(time.Now())
+
+			restartStream() // There may be new accounts
+			jsonResponse(w, req, result)
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodPost,
+		Path:    "/admin/stream/restart",
+		Summary: "Restart the mention stream",
+		Admin:   true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			log.Printf("POST %s - stream restart requested by %s\n", req.URL.Path, requestUser(req).Name)
+			jsonResponse(w, req, restartStream())
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/version",
+		Summary: "Build date and versions of the running service",
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			log.Printf("GET %s - returning version\n", req.URL.Path)
+			jsonResponse(w, req, versionResult{
+				BuildDate:  buildDate,
+				APIVersion: APIVersion,
+				GoVersion:  runtime.Version(),
+			})
+		},
+	})
+
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/openapi.json",
+		Summary: "This OpenAPI document",
+		Cache:   true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			log.Printf("GET %s - returning OpenAPI document\n", req.URL.Path)
+			jsonResponse(w, req, api.OpenAPI("Twivility API", "/api/"+APIVersion))
+		},
+	})
+
+	http.Handle(api.Prefix+"/", http.StripPrefix(api.Prefix, api))
+
+	// Atom feeds: a router of their own (they aren't part of the versioned
+	// API), but with the same caching and conditional GET
+
+	feeds := NewAPIRouter()
+	feeds.Prefix = "/feeds"
+	feeds.Cache = NewResponseCache(version, 0)
+	feeds.Metrics = opts.Metrics
+
+	feeds.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/acct/{file}",
+		Summary: "Atom feed of an account's tweets (file is acct.atom)",
+		Cache:   true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			name, ok := feedName(params["file"])
+			acct := ""
+			for _, known := range service.GetAccounts() {
+				if ok && strings.EqualFold(known, name) {
+					acct = known
+				}
+			}
+			if acct == "" {
+				notFound(w, "Unknown account feed "+params["file"])
+				return
+			}
+			modified := version.Changed()
+			tweets := service.GetTweets(acct)
+			if len(tweets) > feedEntries {
+				tweets = tweets[:feedEntries]
+			}
+			log.Printf("GET %s - returning feed of %d tweets for acct %s\n", req.URL.Path, len(tweets), acct)
+			writeAtomFeed(w, BuildAtomFeed(FeedInfo{
+				ID:        feedID("acct/" + acct),
+				Title:     "Tweets by " + dashAcctName(acct),
+				Base:      requestBase(req),
+				Self:      "/feeds/acct/" + params["file"],
+				Alternate: dashAcctURL(acct),
+			}, tweets), modified)
+		},
+	})
+
+	feeds.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/hashtag/{file}",
+		Summary: "Atom feed of stored tweets and mentions using a hashtag (file is tag.atom)",
+		Cache:   true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			name, ok := feedName(params["file"])
+			tag := "#" + strings.TrimPrefix(name, "#")
+			if !ok || fieldValue(tag) == "" {
+				notFound(w, "Unknown hashtag feed "+params["file"])
+				return
+			}
+			modified := version.Changed()
+			result, err := search.Search(SearchQuery{Query: "tag:" + tag, Limit: feedEntries, Newest: true})
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			tweets := hitTweets(result.Hits)
+			log.Printf("GET %s - returning feed of %d tweets for hashtag %s\n", req.URL.Path, len(tweets), tag)
+			writeAtomFeed(w, BuildAtomFeed(FeedInfo{
+				ID:        feedID("hashtag/" + fieldValue(tag)),
+				Title:     "Tweets using " + tag,
+				Base:      requestBase(req),
+				Self:      "/feeds/hashtag/" + params["file"],
+				Alternate: dashHashtagURL(tag),
+			}, tweets), modified)
+		},
+	})
+
+	feeds.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/mentions/{file}",
+		Summary: "Atom feed of streamed mentions of an account (file is acct.atom)",
+		Cache:   true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			name, ok := feedName(params["file"])
+			acct := fieldValue(name)
+			if !ok || acct == "" {
+				notFound(w, "Unknown mentions feed "+params["file"])
+				return
+			}
+			modified := version.Changed()
+			result, err := search.Search(SearchQuery{
+				Query:  "mention:" + acct,
+				Limit:  feedEntries,
+				Source: SourceMentions,
+				Newest: true,
+			})
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			tweets := hitTweets(result.Hits)
+			log.Printf("GET %s - returning feed of %d mentions of %s\n", req.URL.Path, len(tweets), acct)
+			writeAtomFeed(w, BuildAtomFeed(FeedInfo{
+				ID:    feedID("mentions/" + acct),
+				Title: "Mentions of " + dashAcctName(acct),
+				Base:  requestBase(req),
+				Self:  "/feeds/mentions/" + params["file"],
+			}, tweets), modified)
+		},
 	})
 
-	// API default and unspecified API end points
+	feeds.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/search.atom",
+		Summary: "Atom feed of the newest stored tweets and mentions matching a search",
+		Query: append([]APIParam{
+			{"q", "The search (required): see /api/search"},
+		}, timeRangeParams...),
+		Cache: true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			query, err := ParseSearchQuery(req.URL.Query(), time.Now())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			// A relative time range changes as time passes, so there's no
+			// single time the feed changed
+			var modified time.Time
+			if !timeRelative(req.URL.Query()) {
+				modified = version.Changed()
+			}
+			query.Limit, query.Newest = feedEntries, true
+			result, err := search.Search(query)
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			tweets := hitTweets(result.Hits)
+			log.Printf("GET %s - returning feed of %d tweets for search %s\n", req.URL.Path, len(tweets), query.Query)
+			writeAtomFeed(w, BuildAtomFeed(FeedInfo{
+				ID:    feedID("search?" + req.URL.RawQuery),
+				Title: "Twivility search: " + query.Query,
+				Base:  requestBase(req),
+				Self:  "/feeds/search.atom?" + req.URL.RawQuery,
+			}, tweets), modified)
+		},
+	})
+
+	http.Handle(feeds.Prefix+"/", http.StripPrefix(feeds.Prefix, feeds))
+
+	// Unversioned paths whose results predate the versioned API keep their
+	// original results. They get their own cache since the cache key is the
+	// path relative to the API root
+
+	legacy := NewAPIRouter()
+	legacy.Prefix = "/api"
+	legacy.Cache = NewResponseCache(version, 0)
+	legacy.Metrics = opts.Metrics
+
+	legacy.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/tweets/{acct}",
+		Summary: "An account's tweets (just the list), newest first",
+		Cache:   true,
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			acct := params["acct"]
+			query, err := ParseTweetsQuery(req.URL.Query(), time.Now())
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			tweets := service.GetTweets(acct)
+			if req.URL.Query().Get("limit") == "" {
+				query.Limit = len(tweets) // Every matching tweet, as before paging
+			}
+			page := query.Page(tweets)
+			log.Printf("GET %s - returning list of len %d for acct %s\n", req.URL.Path, len(page.Tweets), acct)
+			jsonResponse(w, req, page.Tweets)
+		},
+	})
+
+	// API default page, with the unversioned paths as aliases for the
+	// current version (except for the legacy paths above)
+	unversioned := http.StripPrefix("/api", api)
+	unversionedLegacy := http.StripPrefix(legacy.Prefix, legacy)
+	apiDefault := opts.Metrics.Handler("/api/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveClientFile(w, req, clientFiles, "api-default.html")
+	}))
 	http.HandleFunc("/api/", func(w http.ResponseWriter, req *http.Request) {
+		if legacy.Handles(strings.TrimPrefix(req.URL.Path, legacy.Prefix)) {
+			unversionedLegacy.ServeHTTP(w, req)
+			return
+		}
 		if req.URL.Path != "/api/" {
-			http.Error(w, "Unknown API path "+req.URL.Path, 404)
+			unversioned.ServeHTTP(w, req)
 			return
 		}
-		http.ServeFile(w, req, "./client/api-default.html")
+		apiDefault.ServeHTTP(w, req)
 	})
 
+	// Prometheus metrics
+	http.Handle("/metrics", opts.Metrics.Handler("/metrics", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pw := NewPromWriter()
+		opts.Metrics.Write(pw)
+		WriteHealthMetrics(pw, mentions.Health.Stats())
+		WriteTrackMetrics(pw, mentions.Terms.Stats())
+
+		pw.Family("twivility_mentions_total", "Streamed mentions written to the stream file", "counter")
+		pw.Sample("twivility_mentions_total", float64(mentions.Count()))
+		pw.Family("twivility_store_size_bytes", "Size of the data files on disk", "gauge")
+		pw.Sample("twivility_store_size_bytes", float64(fileSize(tweetStoreFile)), "file", tweetStoreFile)
+		pw.Sample("twivility_store_size_bytes", float64(fileSize(streamStoreFile)), "file", streamStoreFile)
+		pw.Family("twivility_account_tweets", "Tweets in the store for each account", "gauge")
+		accts := service.GetAccounts()
+		sort.Strings(accts)
+		for _, acct := range accts {
+			pw.Sample("twivility_account_tweets", float64(service.GetTweets(acct).Len()), "acct", acct)
+		}
+
+		caches := []struct {
+			name  string
+			stats CacheStats
+		}{
+			{"api", api.Cache.Stats()},
+			{"legacy", legacy.Cache.Stats()},
+			{"feeds", feeds.Cache.Stats()},
+		}
+		pw.Family("twivility_api_cache_entries", "API responses currently cached", "gauge")
+		for _, cache := range caches {
+			pw.Sample("twivility_api_cache_entries", float64(cache.stats.Entries), "cache", cache.name)
+		}
+		pw.Family("twivility_api_cache_hits_total", "API requests answered from the cache", "counter")
+		for _, cache := range caches {
+			pw.Sample("twivility_api_cache_hits_total", float64(cache.stats.Hits), "cache", cache.name)
+		}
+		pw.Family("twivility_api_cache_misses_total", "Cacheable API requests that built a new response", "counter")
+		for _, cache := range caches {
+			pw.Sample("twivility_api_cache_misses_total", float64(cache.stats.Misses), "cache", cache.name)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(pw.Bytes())
+	})))
+
+	// Server-rendered dashboard pages
+	dashboard.Service = service
+	dashboard.Mentions = mentions
+	dashboard.Recent = recentMentions
+	dashboard.Trends = trends
+	dashboard.Search = search
+	dashboard.LastUpdate = func() time.Time { return lastUpdate.Load().(time.Time) }
+	dashboard.Metrics = opts.Metrics
+	http.Handle("/dash/", http.StripPrefix("/dash", dashboard))
+
 	// Our static HTML5 client
-	fs := http.FileServer(http.Dir("./client"))
-	http.Handle("/client/", http.StripPrefix("/client/", fs))
+	http.Handle("/client/", opts.Metrics.Handler("/client/{file}", http.StripPrefix("/client/", http.FileServer(clientFiles))))
 
 	// The default page if you just come to the root of the site (or an
 	// unhandled endpoint)
+	rootPage := opts.Metrics.Handler("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveClientFile(w, req, clientFiles, "main.html")
+	}))
+	unknownPage := opts.Metrics.Handler(unmatchedRoute, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "Unknown API path "+req.URL.Path, 404)
+	}))
 	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path != "/" {
-			http.Error(w, "Unknown API path "+req.URL.Path, 404)
+			unknownPage.ServeHTTP(w, req)
 			return
 		}
-		http.ServeFile(w, req, "./client/main.html")
+		rootPage.ServeHTTP(w, req)
 	})
 
+	addrListen := opts.Addr
 	if addrListen == "" {
 		log.Printf("No host specified: using default\n")
 		addrListen = "127.0.0.1:8484"
 	}
-	log.Printf("Starting listen on %s\n", addrListen)
-	http.ListenAndServe(addrListen, nil)
+	if opts.Auth == nil && !strings.HasPrefix(addrListen, "127.0.0.1:") && !strings.HasPrefix(addrListen, "localhost:") {
+		log.Printf("WARNING: listening on %s with no authentication (see the -auth flag)\n", addrListen)
+	}
+
+	// Everything (including the client) requires auth if it's configured
+	server := &http.Server{
+		Addr:    addrListen,
+		Handler: opts.Auth.Wrap(http.DefaultServeMux),
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if opts.TLSCert != "" {
+			log.Printf("Starting TLS listen on %s\n", addrListen)
+			serveErr <- server.ListenAndServeTLS(opts.TLSCert, opts.TLSKey)
+		} else {
+			log.Printf("Starting listen on %s\n", addrListen)
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	var listenErr error
+	select {
+	case sig := <-signals:
+		log.Printf("Received %v: shutting down (send again to exit immediately)\n", sig)
+		go func() {
+			log.Printf("Received %v: exiting without cleanup\n", <-signals)
+			os.Exit(1)
+		}()
+	case listenErr = <-serveErr:
+		log.Printf("Listen failed: %v\n", listenErr)
+	}
+
+	// Stop accepting requests and wait for the in-flight ones
+	ctx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+	defer cancel()
+	if shutdownErr := server.Shutdown(ctx); shutdownErr != nil {
+		log.Printf("Requests still running after %v: %v\n", opts.ShutdownTimeout, shutdownErr)
+	}
+
+	// Stop restarting things, then stop the stream (closing stream.json)
+	// and wait for any running update to save the tweet store
+	close(watchdogQuit)
+	close(updateQuit)
+	mentions.Shutdown()
+	service.Close()
 
 	log.Printf("Exiting\n")
+	return listenErr
+}
+
+// newSinkRouter creates the sinks in the given config file (if any)
+func newSinkRouter(sinksFile string) *SinkRouter {
+	config, err := ReadSinksConfig(sinksFile)
+	pcheck(err)
+	router, err := NewSinkRouter(config)
+	pcheck(err)
+	return router
+}
+
+// newAlertMonitor creates the alert rules in the given config file (if any)
+func newAlertMonitor(alertsFile string) *AlertMonitor {
+	config, err := ReadAlertsConfig(alertsFile)
+	pcheck(err)
+	alerts, err := NewAlertMonitor(config)
+	pcheck(err)
+	return alerts
+}
+
+// newAuthenticator creates the authenticator for the given config file (nil
+// if there's no file)
+func newAuthenticator(authFile string) *Authenticator {
+	config, err := ReadAuthConfig(authFile)
+	pcheck(err)
+	auth, err := NewAuthenticator(config)
+	pcheck(err)
+	if auth != nil {
+		log.Printf("Authentication required: %d API keys and %d htpasswd users\n", len(config.Keys), len(auth.users))
+	}
+	return auth
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -226,6 +1098,24 @@ func main() {
 	accessSecret := flags.String("access-secret", "", "Twitter Access Secret")
 	hostBinding := flags.String("host", "", "How to listen for service")
 	hashtagFile := flags.String("hashtags", "", "Filename with list of hashtags")
+	languages := flags.String("languages", "", "Comma-delimited language codes to filter mentions (e.g. en,es)")
+	locations := flags.String("locations", "", "Comma-delimited bounding boxes (sw-lon,sw-lat,ne-lon,ne-lat) to filter mentions")
+	stallTimeout := flags.Duration("stall-timeout", 2*time.Minute, "Restart the mention stream after this long with no messages (0 to disable)")
+	sinksFile := flags.String("sinks", "", "JSON file configuring extra output sinks for streamed mentions")
+	alertsFile := flags.String("alerts", "", "JSON file configuring mention spike alert rules")
+	graphFormat := flags.String("format", "graphml", "Output format for the graph command (graphml or dot)")
+	graphWindow := flags.String("window", "", "Only include mentions this recent in the graph command (e.g. 24h or 7d)")
+	graphMinWeight := flags.Int("min-weight", 0, "Only include edges with at least this weight in the graph command")
+	categoriesFile := flags.String("categories", "", "JSON file configuring the tweet classifier categories (see categories.example.json)")
+	fromTime := flags.String("from", "", "Only tweets created at or after this time for dump, graph, and search")
+	toTime := flags.String("to", "", "Only tweets created before this time for dump, graph, and search")
+	searchLimit := flags.Int("limit", 20, "Most results returned by the search command")
+	recentSize := flags.Int("recent-size", 100, "Number of recent mentions kept for the recent-stream API")
+	tlsCert := flags.String("tls-cert", "", "Certificate file for serving HTTPS (requires -tls-key)")
+	tlsKey := flags.String("tls-key", "", "Private key file for -tls-cert")
+	authFile := flags.String("auth", "", "JSON file configuring API keys and htpasswd users for the service")
+	clientDir := flags.String("client-dir", "", "Serve the HTML client from this directory instead of the copy built in")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 30*time.Second, "How long the service waits for in-flight requests when shutting down")
 
 	pcheck(flags.Parse(os.Args[1:]))
 	pcheck(flagutil.SetFlagsFromEnv(flags, "TWITTER"))
@@ -236,6 +1126,19 @@ func main() {
 
 	cmd := flags.Arg(0)
 
+	// Date range for the commands that support it
+	var from, to time.Time
+	if *fromTime != "" {
+		var err error
+		from, err = ParseTimeParam(*fromTime, time.Now())
+		pcheck(err)
+	}
+	if *toTime != "" {
+		var err error
+		to, err = ParseTimeParam(*toTime, time.Now())
+		pcheck(err)
+	}
+
 	// Remember that OAuth1 http.Client will automatically authorize Requests
 	config := oauth1.NewConfig(*consumerKey, *consumerSecret)
 	token := oauth1.NewToken(*accessToken, *accessSecret)
@@ -254,8 +1157,17 @@ func main() {
 	pcheck(userError)
 	log.Printf("User Verified:%v\n", user.Name)
 
-	wrapped := &WrappedTwitterClient{client: client}
+	classConfig, err := ReadClassifierConfig(*categoriesFile)
+	pcheck(err)
+	classifier, err := NewClassifier(classConfig)
+	pcheck(err)
+	log.Printf("Using categories %v\n", classifier.Names())
+
+	metrics := NewMetrics()
+	wrapped := &WrappedTwitterClient{client: client, metrics: metrics}
 	service := NewTwivilityService(wrapped, tweetStoreFile)
+	service.Classifier = classifier
+	service.Metrics = metrics
 
 	if cmd == "update" {
 		service.UpdateTwitterFile(false)
@@ -263,16 +1175,67 @@ func main() {
 		service.UpdateTwitterFile(true)
 		service.UpdateTwitterFile(false)
 	} else if cmd == "dump" || cmd == "json" {
-		records := service.ReadTwitterFile()
+		records := service.ReadTwitterFile().Between(from, to)
 		for _, rec := range records {
 			txt, err := json.Marshal(rec)
 			pcheck(err)
 			fmt.Println(string(txt))
 		}
+	} else if cmd == "graph" {
+		window := time.Duration(0)
+		if *graphWindow != "" {
+			var err error
+			window, err = parseDays(*graphWindow)
+			pcheck(err)
+		}
+
+		graph := NewMentionGraph()
+		graph.Add(service.ReadTwitterFile()...)
+		pcheck(ReadMentionFile(streamStoreFile, func(rec TweetRecord) {
+			graph.Add(rec)
+		}))
+
+		g := graph.Graph(GraphQuery{Window: window, From: from, To: to, MinWeight: *graphMinWeight})
+		log.Printf("Writing graph with %d nodes and %d edges\n", len(g.Nodes), len(g.Edges))
+		pcheck(g.WriteGraph(*graphFormat, os.Stdout))
+	} else if cmd == "search" {
+		search := NewSearchIndex()
+		search.Add(SourceTimeline, service.ReadTwitterFile()...)
+		pcheck(ReadMentionFile(streamStoreFile, func(rec TweetRecord) {
+			search.Add(SourceMentions, rec)
+		}))
+
+		query := strings.Join(flags.Args()[1:], " ")
+		result, err := search.Search(SearchQuery{Query: query, From: from, To: to, Limit: *searchLimit})
+		pcheck(err)
+		log.Printf("Found %d tweets in %d searched: showing %d\n", result.Total, search.Len(), len(result.Hits))
+		for _, hit := range result.Hits {
+			txt, err := json.Marshal(hit)
+			pcheck(err)
+			fmt.Println(string(txt))
+		}
 	} else if cmd == "service" {
 		log.Printf("Using hashtag file %s\n", *hashtagFile)
-		mentions := NewTwitterMentions(client, streamStoreFile, *hashtagFile)
-		runService(*hostBinding, service, mentions)
+		mentions := NewTwitterMentions(client, streamStoreFile, *hashtagFile, *languages, *locations)
+		mentions.Classifier = classifier
+		mentions.Metrics = metrics
+		mentions.Sinks = newSinkRouter(*sinksFile)
+		defer mentions.Sinks.Close()
+		alerts := newAlertMonitor(*alertsFile)
+		if (*tlsCert == "") != (*tlsKey == "") {
+			log.Panicf("-tls-cert and -tls-key must be used together\n")
+		}
+		pcheck(runService(serviceOptions{
+			Addr:            *hostBinding,
+			RecentSize:      *recentSize,
+			StallTimeout:    *stallTimeout,
+			TLSCert:         *tlsCert,
+			TLSKey:          *tlsKey,
+			Auth:            newAuthenticator(*authFile),
+			Metrics:         metrics,
+			ClientDir:       *clientDir,
+			ShutdownTimeout: *shutdownTimeout,
+		}, service, mentions, alerts))
 	} else if cmd == "stream" {
 		// We need an accounts list to listen to
 		log.Println("Outputting streamed mentions until CTRL+C")
@@ -280,17 +1243,20 @@ func main() {
 		accts := service.GetAccounts()
 
 		log.Printf("Using hashtag file %s\n", *hashtagFile)
-		mentions := NewTwitterMentions(client, streamStoreFile, *hashtagFile)
+		mentions := NewTwitterMentions(client, streamStoreFile, *hashtagFile, *languages, *locations)
+		mentions.Classifier = classifier
+		mentions.Sinks = newSinkRouter(*sinksFile)
+		defer mentions.Sinks.Close()
 		mentions.Mention = func(tweet TweetRecord) {
 			log.Printf("%d: %s\n", tweet.TweetID, tweet.Text)
 		}
 		go mentions.Stream(accts)
 
-		ch := make(chan os.Signal)
+		ch := make(chan os.Signal, 1)
 		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 		log.Println(<-ch)
-		mentions.Stop()
+		mentions.Shutdown()
 	} else {
-		log.Printf("Options are service, update, backfill, dump, or stream\n")
+		log.Printf("Options are service, update, backfill, dump, stream, graph, or search\n")
 	}
 }
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dghubble/go-twitter/twitter"
 )
@@ -15,12 +22,40 @@ import (
 
 // TwitterMentions provides stream-to-file functionality
 type TwitterMentions struct {
-	Client   *twitter.Client
-	Filename string
-	Count    int64
-	stream   *twitter.Stream
-	Hashtags []string
-	Mention  func(tweet TweetRecord)
+	Client     *twitter.Client
+	Filename   string
+	stream     *twitter.Stream
+	Hashtags   []string
+	Languages  []string
+	Locations  []string
+	Mention    func(tweet TweetRecord)
+	Terms      *TermCounter
+	Health     *StreamHealth
+	Sinks      *SinkRouter
+	Classifier *Classifier
+	Metrics    *Metrics
+
+	count     int64 // Mentions seen: only use atomically (see Count)
+	streamMtx sync.Mutex
+	closed    bool           // Set by Shutdown: no more streams
+	running   sync.WaitGroup // Streams still writing to our file
+	lastAccts []string
+	userIDs   map[string]int64 // screen name (lower case, no @) => user ID
+	filter    StreamFilter
+	matcher   *TrackMatcher
+	filterMtx sync.RWMutex
+}
+
+// ErrMentionsClosed is returned by Stream after Shutdown
+var ErrMentionsClosed = errors.New("Mention stream is shut down")
+
+// StreamFilter is the set of filters currently in use by the mention stream.
+// It is what we report in the stats API
+type StreamFilter struct {
+	Track     []string
+	Follow    []string
+	Languages []string
+	Locations []string
 }
 
 // readHashtags reads whitespace-delimited hashtags from the given file and
@@ -41,33 +76,219 @@ func readHashtags(filename string) ([]string, error) {
 
 	tags := NewUniqueStrings()
 	for _, one := range strings.Fields(string(buf)) {
-		if !strings.HasPrefix(one, "#") && !strings.HasPrefix(one, "@") {
-			one = "#" + one
-		}
-		tags.Add(one)
+		tags.Add(normTrackTerm(one))
 	}
 
 	return tags.Strings(), nil
 }
 
-// NewTwitterMentions creates a new TwitterMentions instance
-func NewTwitterMentions(client *twitter.Client, filename string, hashtagFile string) *TwitterMentions {
+// parseLanguages splits a comma-delimited list of BCP 47 language codes (as
+// in "en,es"). Blank entries are dropped and everything is lower cased
+func parseLanguages(spec string) []string {
+	langs := NewUniqueStrings()
+	for _, one := range strings.Split(spec, ",") {
+		one = strings.ToLower(strings.TrimSpace(one))
+		if len(one) > 0 {
+			langs.Add(one)
+		}
+	}
+	return langs.Strings()
+}
+
+// parseLocations parses a comma-delimited list of bounding boxes. Each box is
+// four numbers: the longitude,latitude of the south-west corner followed by
+// the longitude,latitude of the north-east corner (which is what Twitter
+// expects). The numbers are returned as strings since that's what the
+// streaming API wants, but they are checked first
+func parseLocations(spec string) ([]string, error) {
+	locs := allNonBlank(strings.Split(spec, ","))
+	if len(locs)%4 != 0 {
+		return []string{}, errors.New("Locations must be groups of 4 numbers (sw-lon,sw-lat,ne-lon,ne-lat)")
+	}
+
+	for i := 0; i < len(locs); i += 4 {
+		box := make([]float64, 4)
+		for j := 0; j < 4; j++ {
+			val, err := strconv.ParseFloat(locs[i+j], 64)
+			if err != nil {
+				return []string{}, err
+			}
+			box[j] = val
+		}
+
+		swLon, swLat, neLon, neLat := box[0], box[1], box[2], box[3]
+		if swLon < -180.0 || neLon > 180.0 || swLat < -90.0 || neLat > 90.0 {
+			return []string{}, errors.New("Location bounding box out of range: " + strings.Join(locs[i:i+4], ","))
+		}
+		if swLon >= neLon || swLat >= neLat {
+			return []string{}, errors.New("Location bounding box must be SW corner then NE corner: " + strings.Join(locs[i:i+4], ","))
+		}
+	}
+
+	return locs, nil
+}
+
+// ReadMentionFile calls each for every record in the given mention stream
+// file (in file order). A missing file has no records, and lines that can't
+// be parsed are logged and skipped
+func ReadMentionFile(filename string, each func(rec TweetRecord)) error {
+	input, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer SafeClose(input)
+
+	reader := bufio.NewReader(input)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			rec := TweetRecord{}
+			if jsonErr := json.Unmarshal(line, &rec); jsonErr != nil {
+				log.Printf("Skipping unreadable line in %s: %v\n", filename, jsonErr)
+			} else {
+				rec.backfill()
+				each(rec)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// NewTwitterMentions creates a new TwitterMentions instance. Languages and
+// locations are comma-delimited strings (see parseLanguages and
+// parseLocations) and may be empty
+func NewTwitterMentions(client *twitter.Client, filename string, hashtagFile string, languages string, locations string) *TwitterMentions {
 	tags, err := readHashtags(hashtagFile)
 	pcheck(err)
 
+	locs, err := parseLocations(locations)
+	pcheck(err)
+
 	return &TwitterMentions{
-		Client:   client,
-		Filename: filename,
-		Count:    0,
-		Hashtags: tags,
-		stream:   nil,
+		Client:    client,
+		Filename:  filename,
+		count:     0,
+		Hashtags:  tags,
+		Languages: parseLanguages(languages),
+		Locations: locs,
+		Terms:     NewTermCounter(),
+		Health:    NewStreamHealth(),
+		stream:    nil,
+		userIDs:   make(map[string]int64),
 	}
 }
 
-// WriteTweet writes the given tweet to the Writer as a line of JSON
+// normScreenName returns the screen name without the leading @ in lower
+// case: screen names are case insensitive
+func normScreenName(acct string) string {
+	return strings.ToLower(strings.TrimPrefix(acct, "@"))
+}
+
+// resolveFollow returns the user ID's (as strings, for the streaming API) for
+// the given accounts. We only look up accounts we haven't seen before, so
+// restarting the stream doesn't cost us any more API calls. Accounts that
+// can't be resolved are logged and skipped: we still track them by name.
+func (tm *TwitterMentions) resolveFollow(accts []string) []string {
+	if tm.userIDs == nil {
+		tm.userIDs = make(map[string]int64)
+	}
+
+	lookup := make([]string, 0, len(accts))
+	for _, acct := range accts {
+		name := normScreenName(acct)
+		if _, inMap := tm.userIDs[name]; !inMap && len(name) > 0 {
+			lookup = append(lookup, name)
+		}
+	}
+
+	// users/lookup only accepts 100 screen names per call
+	const lookupMax = 100
+	for start := 0; start < len(lookup) && tm.Client != nil; start += lookupMax {
+		end := start + lookupMax
+		if end > len(lookup) {
+			end = len(lookup)
+		}
+
+		users, resp, err := tm.Client.Users.Lookup(&twitter.UserLookupParams{
+			ScreenName:      lookup[start:end],
+			IncludeEntities: twitter.Bool(false),
+		})
+		tm.Metrics.ObserveTwitterCall("users_lookup", resp, err)
+		if err != nil {
+			log.Printf("Mentions: could not look up user ID's: %v\n", err)
+			continue
+		}
+		for _, user := range users {
+			tm.userIDs[normScreenName(user.ScreenName)] = user.ID
+		}
+	}
+
+	follow := NewUniqueStrings()
+	for _, acct := range accts {
+		if id, inMap := tm.userIDs[normScreenName(acct)]; inMap {
+			follow.Add(strconv.FormatInt(id, 10))
+		} else {
+			log.Printf("Mentions: no user ID for %s - will only track by name\n", acct)
+		}
+	}
+	return follow.Strings()
+}
+
+// CurrentFilter returns the filter used by the currently running stream (or
+// the last stream started)
+func (tm *TwitterMentions) CurrentFilter() StreamFilter {
+	tm.filterMtx.RLock()
+	defer tm.filterMtx.RUnlock()
+	return tm.filter
+}
+
+// setFilter records the filter params that the stream is using
+func (tm *TwitterMentions) setFilter(params *twitter.StreamFilterParams) {
+	tm.filterMtx.Lock()
+	defer tm.filterMtx.Unlock()
+	tm.matcher = NewTrackMatcher(params.Track)
+	tm.filter = StreamFilter{
+		Track:     params.Track,
+		Follow:    params.Follow,
+		Languages: params.Language,
+		Locations: params.Locations,
+	}
+}
+
+// matchedTerms returns the track entries of the current stream that match
+// the tweet
+func (tm *TwitterMentions) matchedTerms(tweet *twitter.Tweet) []string {
+	tm.filterMtx.RLock()
+	matcher := tm.matcher
+	tm.filterMtx.RUnlock()
+
+	if matcher == nil {
+		return nil
+	}
+	return matcher.Match(tweet)
+}
+
+// WriteTweet writes the given tweet to the Writer as a line of JSON. The
+// record is annotated with the track entries that it matched and its
+// categories (if we have a classifier). Once the write
+// succeeds, the record is also routed to our sinks (if any)
 func (tm *TwitterMentions) WriteTweet(tweet *twitter.Tweet, target io.Writer) error {
 	record := NewTweetRecord(tweet)
-	tm.Count++
+	record.MatchedTerms = tm.matchedTerms(tweet)
+	record.Categories = tm.Classifier.Classify(record)
+	record.Fingerprint = MentionFingerprint(record)
+	atomic.AddInt64(&tm.count, 1)
+	if tm.Terms != nil {
+		tm.Terms.Add(record.MatchedTerms)
+	}
 
 	txt, err := json.Marshal(record)
 	if err != nil {
@@ -82,6 +303,10 @@ func (tm *TwitterMentions) WriteTweet(tweet *twitter.Tweet, target io.Writer) er
 		return err
 	}
 
+	if tm.Sinks != nil {
+		tm.Sinks.Route(record, txt)
+	}
+
 	if tm.Mention != nil {
 		tm.Mention(record)
 	}
@@ -90,12 +315,25 @@ func (tm *TwitterMentions) WriteTweet(tweet *twitter.Tweet, target io.Writer) er
 }
 
 // Stream starts listening for mentions of accts and writing to the file.
-// Supports running in a goroutine.
+// Supports running in a goroutine. Starting a new stream stops any stream
+// that is already running.
 func (tm *TwitterMentions) Stream(accts []string) error {
-	// Restarts should work
-	if err := tm.Stop(); err != nil {
-		return err
+	tm.streamMtx.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			tm.streamMtx.Unlock()
+		}
+	}()
+
+	if tm.closed {
+		return ErrMentionsClosed
 	}
+	tm.running.Add(1)
+	defer tm.running.Done()
+
+	// Restarts should work
+	tm.stopStream()
 
 	// Create our tracking array (and insure all accts are prefixed with @)
 	gather := NewUniqueStrings()
@@ -110,34 +348,52 @@ func (tm *TwitterMentions) Stream(accts []string) error {
 	}
 	trackQuery := gather.Strings()
 
+	// Everything we track by @name we also follow by user ID
+	followAccts := make([]string, 0, len(trackQuery))
+	for _, one := range trackQuery {
+		if strings.HasPrefix(one, "@") {
+			followAccts = append(followAccts, one)
+		}
+	}
+
 	log.Printf("Mentions: starting stream on %v\n", trackQuery)
 
 	// Our file should exist, even if it's empty
 	TouchFile(tm.Filename)
 
-	// If we've never seen a count, start with the line count in the data file
-	if tm.Count < 1 {
+	// If we've never seen a count, start with the line count in the data file.
+	// A stream we just stopped may still be writing, so only replace zero
+	if tm.Count() < 1 {
 		initCount, err := lineCounter(tm.Filename)
 		pcheck(err) // Yes, panic - because we can't stream at all
-		tm.Count = int64(initCount)
+		atomic.CompareAndSwapInt64(&tm.count, 0, int64(initCount))
 	}
 
 	// Open the data file
 	output, err := os.OpenFile(tm.Filename, os.O_APPEND|os.O_WRONLY, 0600)
 	pcheck(err)
-	defer SafeClose(output)
-
-	// If we see a stream, someone else is running and we have a race condition
-	if tm.stream != nil {
-		log.Panicln("Stream found an already running instance: RACE CONDITION")
-	}
+	defer func() {
+		if err := output.Sync(); err != nil {
+			log.Printf("Mentions: could not sync %s: %v\n", tm.Filename, err)
+		}
+		SafeClose(output)
+	}()
 
 	// Start our stream
 	params := &twitter.StreamFilterParams{
 		Track:         trackQuery,
+		Follow:        tm.resolveFollow(followAccts),
+		Language:      tm.Languages,
+		Locations:     tm.Locations,
 		StallWarnings: twitter.Bool(true),
 	}
+	tm.setFilter(params)
+	tm.Terms.Track(trackQuery)
+	tm.lastAccts = accts
+	log.Printf("Mentions: following %d user ID's, languages %v, locations %v\n", len(params.Follow), params.Language, params.Locations)
+
 	stream, err := tm.Client.Streams.Filter(params)
+	tm.Metrics.ObserveTwitterCall("statuses_filter", nil, err)
 	if err != nil {
 		log.Printf("Could not start Mention stream: %v\n", err)
 		return err
@@ -145,10 +401,18 @@ func (tm *TwitterMentions) Stream(accts []string) error {
 
 	// Have a stream!
 	tm.stream = stream
+	tm.Health.Started()
+	tm.streamMtx.Unlock()
+	locked = false
 
 	// Set up a demux to receive tweets
 	demux := twitter.NewSwitchDemux()
 
+	// Anything at all from the stream means it's still alive
+	demux.All = func(message interface{}) {
+		tm.Health.Touch()
+	}
+
 	// Our main action: write the tweet to the file as a JSON record on a line
 	demux.Tweet = func(tweet *twitter.Tweet) {
 		err := tm.WriteTweet(tweet, output)
@@ -157,15 +421,19 @@ func (tm *TwitterMentions) Stream(accts []string) error {
 		}
 	}
 
-	// We currently just log these warnings and disconnects...
+	// We log these warnings and disconnects and track them in our health
+	// stats. The watchdog handles any actual action
 	demux.StreamLimit = func(limit *twitter.StreamLimit) {
 		log.Printf("Mentions: stream limit - %d undelivered matches\n", limit.Track)
+		tm.Health.Limit(limit)
 	}
 	demux.StreamDisconnect = func(dis *twitter.StreamDisconnect) {
 		log.Printf("Mentions: Disconnect [%d] %s\n", dis.Code, dis.Reason)
+		tm.Health.Disconnect(dis)
 	}
 	demux.Warning = func(warn *twitter.StallWarning) {
 		log.Printf("Mentions: Stall Warning (%d%%) [%s] %s\n", warn.PercentFull, warn.Code, warn.Message)
+		tm.Health.Warning(warn)
 	}
 
 	// Loop until the stream is no more
@@ -176,13 +444,88 @@ func (tm *TwitterMentions) Stream(accts []string) error {
 	return nil
 }
 
-// Stop stop listening for mentions of accts
-func (tm *TwitterMentions) Stop() error {
+// Count returns the number of mentions seen (starting with the number
+// already in our file). A restarted stream's predecessor may still be
+// writing, so the count is always updated atomically
+func (tm *TwitterMentions) Count() int64 {
+	return atomic.LoadInt64(&tm.count)
+}
+
+// stopStream stops the current stream (if any). Caller must hold streamMtx
+func (tm *TwitterMentions) stopStream() {
 	if tm.stream == nil {
-		return nil // Nothing to do
+		return // Nothing to do
 	}
 	tm.stream.Stop()
 	tm.stream = nil
 	log.Printf("Mentions: stopped stream\n")
+}
+
+// Stop stop listening for mentions of accts
+func (tm *TwitterMentions) Stop() error {
+	tm.streamMtx.Lock()
+	defer tm.streamMtx.Unlock()
+	tm.stopStream()
 	return nil
 }
+
+// SetHashtags replaces the hashtags (and other extra terms) we track. They
+// are used the next time the stream starts
+func (tm *TwitterMentions) SetHashtags(tags []string) {
+	tm.streamMtx.Lock()
+	defer tm.streamMtx.Unlock()
+	tm.Hashtags = tags
+}
+
+// Shutdown stops the current stream and waits until every stream has
+// finished writing and closed our file. Any later call to Stream (from the
+// watchdog or an update) returns ErrMentionsClosed
+func (tm *TwitterMentions) Shutdown() {
+	tm.streamMtx.Lock()
+	tm.closed = true
+	tm.stopStream()
+	tm.streamMtx.Unlock()
+
+	tm.running.Wait()
+	log.Printf("Mentions: shut down with %d mentions seen\n", tm.Count())
+}
+
+// needsRestart is true if the stream has been quiet for longer than timeout
+// (backed off after quiet restarts: see StreamHealth.StallTimeout)
+func (tm *TwitterMentions) needsRestart(timeout time.Duration) bool {
+	return timeout > 0 && tm.Health.SinceLast() > tm.Health.StallTimeout(timeout)
+}
+
+// Watchdog restarts the stream when it has gone longer than timeout without
+// any message at all. We restart with the accounts last passed to Stream, so
+// a restart doesn't need to wait on anything else (like an update holding the
+// tweet store lock). Twitter's keep-alives aren't visible to us, so a very
+// quiet filter will also be restarted: each restart that isn't followed by a
+// message doubles the timeout (up to an hour). Runs until quit is closed.
+func (tm *TwitterMentions) Watchdog(timeout time.Duration, quit <-chan struct{}) {
+	if timeout <= 0 {
+		log.Printf("Mentions: watchdog disabled\n")
+		return
+	}
+
+	check := time.NewTicker(timeout / 4)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-check.C:
+			if tm.needsRestart(timeout) {
+				log.Printf("Mentions: watchdog - no messages for %v: restarting stream\n", tm.Health.SinceLast())
+				tm.Health.Restarted()
+				log.Printf("Mentions: watchdog - next restart after %v without messages\n", tm.Health.StallTimeout(timeout))
+
+				tm.streamMtx.Lock()
+				accts := tm.lastAccts
+				tm.streamMtx.Unlock()
+				go tm.Stream(accts)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
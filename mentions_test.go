@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadHashtags(t *testing.T) {
+	assert := assert.New(t)
+
+	tags, err := readHashtags("")
+	assert.Nil(err)
+	assert.Empty(tags)
+
+	tags, err = readHashtags("/this/file/should/not/exist")
+	assert.Nil(err)
+	assert.Empty(tags)
+
+	tmpfile, err := ioutil.TempFile("", "twivility")
+	pcheck(err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.WriteString("vote #debate\n@someone   vote\n")
+	tmpfile.Close()
+
+	tags, err = readHashtags(tmpfile.Name())
+	assert.Nil(err)
+	assert.Equal([]string{"#debate", "#vote", "@someone"}, tags)
+}
+
+func TestParseLanguages(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty(parseLanguages(""))
+	assert.Empty(parseLanguages(" , "))
+	assert.Equal([]string{"en", "es"}, parseLanguages("es, EN,,en"))
+}
+
+func TestParseLocations(t *testing.T) {
+	assert := assert.New(t)
+
+	locs, err := parseLocations("")
+	assert.Nil(err)
+	assert.Empty(locs)
+
+	locs, err = parseLocations("-122.75,36.8,-121.75,37.8")
+	assert.Nil(err)
+	assert.Equal([]string{"-122.75", "36.8", "-121.75", "37.8"}, locs)
+
+	locs, err = parseLocations("-122.75,36.8,-121.75,37.8, -74,40,-73,41")
+	assert.Nil(err)
+	assert.Len(locs, 8)
+
+	_, err = parseLocations("-122.75,36.8,-121.75")
+	assert.NotNil(err)
+	_, err = parseLocations("-122.75,36.8,-121.75,north")
+	assert.NotNil(err)
+	_, err = parseLocations("-200,36.8,-121.75,37.8")
+	assert.NotNil(err)
+	_, err = parseLocations("-121.75,37.8,-122.75,36.8")
+	assert.NotNil(err)
+}
+
+func TestResolveFollow(t *testing.T) {
+	assert := assert.New(t)
+
+	// No client: only what's already cached can be resolved
+	tm := NewTwitterMentions(nil, "", "", "", "")
+	tm.userIDs["someone"] = 42
+	tm.userIDs["other"] = 7
+
+	assert.Equal([]string{"42", "7"}, tm.resolveFollow([]string{"@SomeOne", "other", "@unknown"}))
+	assert.Empty(tm.resolveFollow([]string{}))
+}
+
+func TestWriteTweetMatchedTerms(t *testing.T) {
+	assert := assert.New(t)
+
+	tm := NewTwitterMentions(nil, "", "", "", "")
+	tm.setFilter(&twitter.StreamFilterParams{Track: []string{"#vote", "@bob"}})
+
+	var seen TweetRecord
+	tm.Mention = func(tweet TweetRecord) {
+		seen = tweet
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(tm.WriteTweet(matchTweet("#Vote for @bob", "alice"), &buf))
+	assert.Equal([]string{"#vote", "@bob"}, seen.MatchedTerms)
+	assert.Equal(int64(1), tm.Count())
+	assert.Equal(int64(1), tm.Terms.Count("#vote"))
+
+	stored := TweetRecord{}
+	assert.Nil(json.Unmarshal(buf.Bytes(), &stored))
+	assert.Equal([]string{"#vote", "@bob"}, stored.MatchedTerms)
+}
+
+func TestReadMentionFile(t *testing.T) {
+	assert := assert.New(t)
+
+	count := 0
+	assert.Nil(ReadMentionFile("/this/file/should/not/exist", func(rec TweetRecord) { count++ }))
+	assert.Equal(0, count)
+
+	tmpfile, err := ioutil.TempFile("", "twivility")
+	pcheck(err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.WriteString("{\"TweetID\": 1}\n\nGARBAGE\n{\"TweetID\": 2}")
+	tmpfile.Close()
+
+	ids := make([]int64, 0)
+	assert.Nil(ReadMentionFile(tmpfile.Name(), func(rec TweetRecord) { ids = append(ids, rec.TweetID) }))
+	assert.Equal([]int64{1, 2}, ids)
+}
+
+func TestMentionsShutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	tm := NewTwitterMentions(nil, "/this/file/should/not/exist", "", "", "")
+	tm.Shutdown()
+	tm.Shutdown() // Safe to repeat
+
+	// No more streams: we never touch the client or the file
+	assert.Equal(ErrMentionsClosed, tm.Stream([]string{"someone"}))
+	_, err := os.Stat(tm.Filename)
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics. Metrics keeps the counters and histograms for things
+// that only happen once (updates, Twitter API calls, and API requests); the
+// /metrics handler adds gauges from our other stats (stream health, track
+// term counts, and so on) at scrape time. Everything is written in the
+// Prometheus text format, and Metrics methods are safe to call on nil (they
+// do nothing) so tests and commands don't need one
+
+// Histogram buckets (in seconds)
+var (
+	requestBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+	updateBuckets  = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120}
+)
+
+// Outcome label values
+const (
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+)
+
+// unmatchedRoute is the route label for requests that match no route
+const unmatchedRoute = "unmatched"
+
+// histogram is a Prometheus histogram (not thread-safe: the owner locks)
+type histogram struct {
+	buckets []float64 // Upper bounds
+	counts  []int64   // Observations <= each bound (not cumulative)
+	sum     float64
+	count   int64
+}
+
+// newHistogram returns an empty histogram with the given bucket bounds
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+// observe adds a value
+func (h *histogram) observe(val float64) {
+	for i, bound := range h.buckets {
+		if val <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += val
+	h.count++
+}
+
+// rateLimit is the last rate limit state Twitter sent for an endpoint
+type rateLimit struct {
+	limit     int64
+	remaining int64
+	reset     int64 // Unix seconds
+}
+
+// routeKey identifies a route for request metrics
+type routeKey struct {
+	route  string
+	method string
+}
+
+// Metrics is the thread-safe set of counters and histograms we keep
+type Metrics struct {
+	updates        map[string]int64 // outcome => count
+	updateDuration *histogram
+	lastUpdate     time.Time           // Last successful update
+	apiCalls       map[[2]string]int64 // [endpoint, outcome] => count
+	rateLimits     map[string]rateLimit
+	requests       map[routeKey]map[int]int64 // => status code => count
+	requestTimes   map[routeKey]*histogram
+	mtx            sync.Mutex
+}
+
+// NewMetrics returns empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		updates:        make(map[string]int64),
+		updateDuration: newHistogram(updateBuckets),
+		apiCalls:       make(map[[2]string]int64),
+		rateLimits:     make(map[string]rateLimit),
+		requests:       make(map[routeKey]map[int]int64),
+		requestTimes:   make(map[routeKey]*histogram),
+	}
+}
+
+// outcome returns the outcome label for the error
+func outcome(err error) string {
+	if err != nil {
+		return outcomeError
+	}
+	return outcomeSuccess
+}
+
+// ObserveUpdate records a timeline store update
+func (m *Metrics) ObserveUpdate(dur time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.updates[outcome(err)]++
+	m.updateDuration.observe(dur.Seconds())
+	if err == nil {
+		m.lastUpdate = time.Now()
+	}
+}
+
+// ObserveTwitterCall records a call to the Twitter API endpoint, along with
+// the rate limit headers from the response (resp may be nil)
+func (m *Metrics) ObserveTwitterCall(endpoint string, resp *http.Response, err error) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.apiCalls[[2]string{endpoint, outcome(err)}]++
+
+	if resp == nil {
+		return
+	}
+	header := func(name string) (int64, bool) {
+		val, err := strconv.ParseInt(resp.Header.Get(name), 10, 64)
+		return val, err == nil
+	}
+	limit, okLimit := header("X-Rate-Limit-Limit")
+	remaining, okRemaining := header("X-Rate-Limit-Remaining")
+	reset, okReset := header("X-Rate-Limit-Reset")
+	if okLimit && okRemaining && okReset {
+		m.rateLimits[endpoint] = rateLimit{limit: limit, remaining: remaining, reset: reset}
+	}
+}
+
+// ObserveRequest records a request for the route pattern
+func (m *Metrics) ObserveRequest(route string, method string, status int, dur time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	key := routeKey{route: route, method: method}
+	codes, ok := m.requests[key]
+	if !ok {
+		codes = make(map[int]int64)
+		m.requests[key] = codes
+		m.requestTimes[key] = newHistogram(requestBuckets)
+	}
+	codes[status]++
+	m.requestTimes[key].observe(dur.Seconds())
+}
+
+// Handler returns the handler with its requests counted and timed under the
+// route (a fixed pattern like "/client/{file}", so there's a label per route
+// rather than per path)
+func (m *Metrics) Handler(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(sw, req)
+		m.ObserveRequest(route, req.Method, sw.status, time.Since(started))
+	})
+}
+
+// Write adds our metrics to the writer
+func (m *Metrics) Write(pw *PromWriter) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	pw.Family("twivility_updates_total", "Timeline store updates by outcome", "counter")
+	for _, out := range []string{outcomeSuccess, outcomeError} {
+		pw.Sample("twivility_updates_total", float64(m.updates[out]), "outcome", out)
+	}
+	pw.Family("twivility_update_duration_seconds", "Time taken by timeline store updates", "histogram")
+	pw.Histogram("twivility_update_duration_seconds", m.updateDuration)
+	if !m.lastUpdate.IsZero() {
+		pw.Family("twivility_last_update_timestamp_seconds", "When the last successful update finished", "gauge")
+		pw.Sample("twivility_last_update_timestamp_seconds", unixSeconds(m.lastUpdate))
+	}
+
+	pw.Family("twivility_twitter_api_calls_total", "Twitter API calls by endpoint and outcome", "counter")
+	calls := make([][2]string, 0, len(m.apiCalls))
+	for key := range m.apiCalls {
+		calls = append(calls, key)
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i][0] < calls[j][0] || (calls[i][0] == calls[j][0] && calls[i][1] < calls[j][1])
+	})
+	for _, key := range calls {
+		pw.Sample("twivility_twitter_api_calls_total", float64(m.apiCalls[key]), "endpoint", key[0], "outcome", key[1])
+	}
+
+	endpoints := make([]string, 0, len(m.rateLimits))
+	for endpoint := range m.rateLimits {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	pw.Family("twivility_twitter_rate_limit", "Twitter API rate limit per window by endpoint", "gauge")
+	for _, endpoint := range endpoints {
+		pw.Sample("twivility_twitter_rate_limit", float64(m.rateLimits[endpoint].limit), "endpoint", endpoint)
+	}
+	pw.Family("twivility_twitter_rate_limit_remaining", "Twitter API calls left in the current window by endpoint", "gauge")
+	for _, endpoint := range endpoints {
+		pw.Sample("twivility_twitter_rate_limit_remaining", float64(m.rateLimits[endpoint].remaining), "endpoint", endpoint)
+	}
+	pw.Family("twivility_twitter_rate_limit_reset_timestamp_seconds", "When the current Twitter API rate limit window ends", "gauge")
+	for _, endpoint := range endpoints {
+		pw.Sample("twivility_twitter_rate_limit_reset_timestamp_seconds", float64(m.rateLimits[endpoint].reset), "endpoint", endpoint)
+	}
+
+	keys := make([]routeKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].route < keys[j].route || (keys[i].route == keys[j].route && keys[i].method < keys[j].method)
+	})
+	pw.Family("twivility_http_requests_total", "HTTP requests by route, method, and status code", "counter")
+	for _, key := range keys {
+		codes := make([]int, 0, len(m.requests[key]))
+		for code := range m.requests[key] {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			pw.Sample("twivility_http_requests_total", float64(m.requests[key][code]),
+				"route", key.route, "method", key.method, "code", strconv.Itoa(code))
+		}
+	}
+	pw.Family("twivility_http_request_duration_seconds", "HTTP request latency by route and method", "histogram")
+	for _, key := range keys {
+		pw.Histogram("twivility_http_request_duration_seconds", m.requestTimes[key], "route", key.route, "method", key.method)
+	}
+}
+
+// unixSeconds returns the time as (fractional) Unix seconds
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// WriteHealthMetrics adds the mention stream health to the writer
+func WriteHealthMetrics(pw *PromWriter, stats HealthStats) {
+	counters := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"twivility_stream_messages_total", "Mention stream messages of any kind received", stats.Messages},
+		{"twivility_stream_connects_total", "Times the mention stream connected (reconnects are connects after the first)", stats.Connects},
+		{"twivility_stream_watchdog_restarts_total", "Times the watchdog restarted a quiet mention stream", stats.WatchdogRestarts},
+		{"twivility_stream_stall_warnings_total", "Stall warnings received", stats.StallWarnings},
+		{"twivility_stream_limit_notices_total", "Limit notices received", stats.LimitNotices},
+		{"twivility_stream_undelivered_total", "Undelivered matches reported by limit notices", stats.Undelivered},
+		{"twivility_stream_disconnects_total", "Disconnect messages received", stats.Disconnects},
+	}
+	for _, c := range counters {
+		pw.Family(c.name, c.help, "counter")
+		pw.Sample(c.name, float64(c.value))
+	}
+
+	pw.Family("twivility_stream_stall_percent_full", "Percent full from the last stall warning", "gauge")
+	pw.Sample("twivility_stream_stall_percent_full", float64(stats.LastWarningPercent))
+	pw.Family("twivility_stream_seconds_since_message", "Seconds since the last mention stream message", "gauge")
+	pw.Sample("twivility_stream_seconds_since_message", stats.SecondsSinceLast)
+}
+
+// WriteTrackMetrics adds the mention counts per track term to the writer
+func WriteTrackMetrics(pw *PromWriter, stats TrackStats) {
+	pw.Family("twivility_track_mentions_total", "Streamed mentions counted for track terms", "counter")
+	pw.Sample("twivility_track_mentions_total", float64(stats.Mentions))
+	pw.Family("twivility_track_unmatched_total", "Streamed mentions that matched no track term", "counter")
+	pw.Sample("twivility_track_unmatched_total", float64(stats.Unmatched))
+
+	terms := make([]string, 0, len(stats.Terms))
+	for term := range stats.Terms {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	pw.Family("twivility_track_term_mentions_total", "Streamed mentions matching each track term", "counter")
+	for _, term := range terms {
+		pw.Sample("twivility_track_term_mentions_total", float64(stats.Terms[term].Count), "term", term)
+	}
+}
+
+// PromWriter builds a response in the Prometheus text format
+type PromWriter struct {
+	buf bytes.Buffer
+}
+
+// NewPromWriter returns an empty writer
+func NewPromWriter() *PromWriter {
+	return &PromWriter{}
+}
+
+// Family starts a metric family (every family must be started once before
+// its samples)
+func (pw *PromWriter) Family(name string, help string, metricType string) {
+	help = strings.Replace(strings.Replace(help, `\`, `\\`, -1), "\n", `\n`, -1)
+	fmt.Fprintf(&pw.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// promValue formats a sample value
+func promValue(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	case math.IsNaN(val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+// promLabels formats label name, value pairs
+func promLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		val := strings.Replace(labels[i+1], `\`, `\\`, -1)
+		val = strings.Replace(val, `"`, `\"`, -1)
+		val = strings.Replace(val, "\n", `\n`, -1)
+		parts = append(parts, labels[i]+`="`+val+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Sample writes a single sample. labels are name, value pairs
+func (pw *PromWriter) Sample(name string, val float64, labels ...string) {
+	pw.buf.WriteString(name + promLabels(labels) + " " + promValue(val) + "\n")
+}
+
+// Histogram writes the bucket, sum, and count samples of a histogram
+func (pw *PromWriter) Histogram(name string, h *histogram, labels ...string) {
+	bucketLabels := make([]string, len(labels), len(labels)+2)
+	copy(bucketLabels, labels)
+	bucketLabels = append(bucketLabels, "le", "")
+	le := len(bucketLabels) - 1
+
+	cumulative := int64(0)
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		bucketLabels[le] = promValue(bound)
+		pw.Sample(name+"_bucket", float64(cumulative), bucketLabels...)
+	}
+	bucketLabels[le] = "+Inf"
+	pw.Sample(name+"_bucket", float64(h.count), bucketLabels...)
+	pw.Sample(name+"_sum", h.sum, labels...)
+	pw.Sample(name+"_count", float64(h.count), labels...)
+}
+
+// Bytes returns everything written so far
+func (pw *PromWriter) Bytes() []byte {
+	return pw.buf.Bytes()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	pw := NewPromWriter()
+	pw.Family("test_total", "A test\ncounter", "counter")
+	pw.Sample("test_total", 3)
+	pw.Sample("test_total", 1.5, "term", `#vote "now"`, "acct", `a\b`)
+
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(0.05)
+	h.observe(0.5)
+	h.observe(0.7)
+	h.observe(10)
+	pw.Family("test_seconds", "A histogram", "histogram")
+	pw.Histogram("test_seconds", h, "route", "/x")
+
+	assert.Equal(strings.Join([]string{
+		`# HELP test_total A test\ncounter`,
+		`# TYPE test_total counter`,
+		`test_total 3`,
+		`test_total{term="#vote \"now\"",acct="a\\b"} 1.5`,
+		`# HELP test_seconds A histogram`,
+		`# TYPE test_seconds histogram`,
+		`test_seconds_bucket{route="/x",le="0.1"} 1`,
+		`test_seconds_bucket{route="/x",le="1"} 3`,
+		`test_seconds_bucket{route="/x",le="+Inf"} 4`,
+		`test_seconds_sum{route="/x"} 11.25`,
+		`test_seconds_count{route="/x"} 4`,
+	}, "\n")+"\n", string(pw.Bytes()))
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	// Nil metrics do nothing
+	var none *Metrics
+	none.ObserveUpdate(time.Second, nil)
+	none.ObserveTwitterCall("home_timeline", nil, nil)
+	none.ObserveRequest("/accts", http.MethodGet, http.StatusOK, time.Millisecond)
+	pw := NewPromWriter()
+	none.Write(pw)
+	assert.Len(pw.Bytes(), 0)
+
+	metrics := NewMetrics()
+	metrics.ObserveUpdate(2*time.Second, nil)
+	metrics.ObserveUpdate(200*time.Second, errors.New("Twitter is down"))
+
+	resp := &http.Response{Header: make(http.Header)}
+	resp.Header.Set("X-Rate-Limit-Limit", "15")
+	resp.Header.Set("X-Rate-Limit-Remaining", "12")
+	resp.Header.Set("X-Rate-Limit-Reset", "1476000000")
+	metrics.ObserveTwitterCall("home_timeline", resp, nil)
+	metrics.ObserveTwitterCall("home_timeline", nil, errors.New("Timeout"))
+	metrics.ObserveTwitterCall("statuses_filter", nil, nil)
+
+	// Request metrics come from the router
+	api := NewAPIRouter()
+	api.Prefix = "/api/v1"
+	api.Metrics = metrics
+	api.Add(APIRoute{
+		Method:  http.MethodGet,
+		Path:    "/tweets/{acct}",
+		Summary: "Tweets",
+		Handler: func(w http.ResponseWriter, req *http.Request, params PathParams) {
+			jsonResponse(w, req, params)
+		},
+	})
+	for _, path := range []string{"/tweets/a", "/tweets/b", "/nope"} {
+		api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// Other handlers are timed under a fixed route
+	page := metrics.Handler("/client/{file}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "Nope", http.StatusTeapot)
+	}))
+	page.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/client/a.js", nil))
+	page.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/client/b.js", nil))
+
+	pw = NewPromWriter()
+	metrics.Write(pw)
+	txt := string(pw.Bytes())
+	for _, line := range []string{
+		`twivility_updates_total{outcome="success"} 1`,
+		`twivility_updates_total{outcome="error"} 1`,
+		`twivility_update_duration_seconds_bucket{le="2.5"} 1`,
+		`twivility_update_duration_seconds_bucket{le="+Inf"} 2`,
+		`twivility_update_duration_seconds_count 2`,
+		`twivility_twitter_api_calls_total{endpoint="home_timeline",outcome="error"} 1`,
+		`twivility_twitter_api_calls_total{endpoint="home_timeline",outcome="success"} 1`,
+		`twivility_twitter_api_calls_total{endpoint="statuses_filter",outcome="success"} 1`,
+		`twivility_twitter_rate_limit{endpoint="home_timeline"} 15`,
+		`twivility_twitter_rate_limit_remaining{endpoint="home_timeline"} 12`,
+		`twivility_twitter_rate_limit_reset_timestamp_seconds{endpoint="home_timeline"} 1.476e+09`,
+		`twivility_http_requests_total{route="/api/v1/tweets/{acct}",method="GET",code="200"} 2`,
+		`twivility_http_requests_total{route="unmatched",method="GET",code="404"} 1`,
+		`twivility_http_request_duration_seconds_count{route="/api/v1/tweets/{acct}",method="GET"} 2`,
+		`twivility_http_requests_total{route="/client/{file}",method="GET",code="418"} 2`,
+		`twivility_http_request_duration_seconds_count{route="/client/{file}",method="GET"} 2`,
+	} {
+		assert.Contains(txt, line+"\n")
+	}
+	assert.Contains(txt, "twivility_last_update_timestamp_seconds ")
+}
+
+func TestStreamMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	health := NewStreamHealth()
+	health.Started()
+	health.Started()
+	health.Restarted()
+
+	terms := NewTermCounter()
+	terms.Track([]string{"#vote", "@timkaine"})
+	terms.Add([]string{"#vote"})
+	terms.Add(nil)
+
+	pw := NewPromWriter()
+	WriteHealthMetrics(pw, health.Stats())
+	WriteTrackMetrics(pw, terms.Stats())
+	txt := string(pw.Bytes())
+	for _, line := range []string{
+		"twivility_stream_connects_total 2",
+		"twivility_stream_watchdog_restarts_total 1",
+		"twivility_stream_stall_warnings_total 0",
+		"twivility_track_mentions_total 2",
+		"twivility_track_unmatched_total 1",
+		`twivility_track_term_mentions_total{term="#vote"} 1`,
+		`twivility_track_term_mentions_total{term="@timkaine"} 0`,
+	} {
+		assert.Contains(txt, line+"\n")
+	}
+}
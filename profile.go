@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Account activity profiles: when an account posts (a weekday by hour
+// heatmap in the requested time zone) and what it posts about
+
+// defaultProfileLimit is the default number of top hashtags and mentions
+const defaultProfileLimit = 10
+
+// NameCount is a name (hashtag or account) and how often it was used
+type NameCount struct {
+	Name  string
+	Count int
+}
+
+// AcctProfile is the activity profile for a single account
+type AcctProfile struct {
+	Acct            string
+	TimeZone        string
+	Tweets          int
+	FirstSeen       string   // Oldest tweet (RFC 3339 in TimeZone, "" if no tweets)
+	LastSeen        string   // Newest tweet
+	Weekdays        []string // Row labels for Heatmap
+	Heatmap         [][]int  // Tweets by [weekday][hour] (Sunday first)
+	AvgInterval     string   // Average time between tweets (like "5h30m0s")
+	AvgIntervalSecs float64
+	RetweetRatio    float64 // Fraction of tweets that are retweets
+	TopHashtags     []NameCount
+	TopMentions     []NameCount
+}
+
+// ProfileQuery controls how a profile is built
+type ProfileQuery struct {
+	Location *time.Location // Time zone for the heatmap and dates (default UTC)
+	Limit    int            // Number of top hashtags and mentions (default 10)
+	From     time.Time      // Only tweets created at or after this
+	To       time.Time      // Only tweets created before this
+}
+
+// topCounts returns the (at most limit) names with the highest counts
+func topCounts(counts map[string]int, limit int) []NameCount {
+	top := make([]NameCount, 0, len(counts))
+	for name, cnt := range counts {
+		top = append(top, NameCount{Name: name, Count: cnt})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Name < top[j].Name
+	})
+	if limit > 0 && len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
+
+// BuildAcctProfile returns the profile for the account's tweets
+func BuildAcctProfile(acct string, tweets TweetRecordList, q ProfileQuery) AcctProfile {
+	loc := q.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	limit := q.Limit
+	if limit < 1 {
+		limit = defaultProfileLimit
+	}
+	tweets = tweets.Between(q.From, q.To)
+
+	profile := AcctProfile{
+		Acct:     acct,
+		TimeZone: loc.String(),
+		Tweets:   len(tweets),
+		Weekdays: make([]string, 7),
+		Heatmap:  make([][]int, 7),
+	}
+	for day := range profile.Heatmap {
+		profile.Weekdays[day] = time.Weekday(day).String()
+		profile.Heatmap[day] = make([]int, 24)
+	}
+
+	hashtags := make(map[string]int)
+	mentions := make(map[string]int)
+	retweets := 0
+	var first, last time.Time
+
+	for _, tweet := range tweets {
+		created := tweet.Created().In(loc)
+		profile.Heatmap[created.Weekday()][created.Hour()]++
+		if first.IsZero() || created.Before(first) {
+			first = created
+		}
+		if last.IsZero() || created.After(last) {
+			last = created
+		}
+
+		if tweet.IsRetweet {
+			retweets++
+		}
+		for _, tag := range tweet.Hashtags {
+			hashtags[normHashtag(tag)]++
+		}
+		for _, mention := range tweet.Mentions {
+			mentions[graphNodeID(mention)]++
+		}
+	}
+
+	if len(tweets) > 0 {
+		profile.FirstSeen = first.Format(time.RFC3339)
+		profile.LastSeen = last.Format(time.RFC3339)
+		profile.RetweetRatio = float64(retweets) / float64(len(tweets))
+	}
+	if len(tweets) > 1 {
+		avg := last.Sub(first) / time.Duration(len(tweets)-1)
+		profile.AvgInterval = avg.Round(time.Second).String()
+		profile.AvgIntervalSecs = avg.Round(time.Second).Seconds()
+	}
+	profile.TopHashtags = topCounts(hashtags, limit)
+	profile.TopMentions = topCounts(mentions, limit)
+
+	return profile
+}
+
+// ParseProfileQuery builds a query from the API query parameters tz (an IANA
+// time zone name like America/New_York, default UTC), limit, from, and to
+func ParseProfileQuery(values url.Values, now time.Time) (ProfileQuery, error) {
+	q := ProfileQuery{Location: time.UTC, Limit: defaultProfileLimit}
+
+	if txt := strings.TrimSpace(values.Get("tz")); len(txt) > 0 {
+		loc, err := time.LoadLocation(txt)
+		if err != nil {
+			return q, errors.New("Unknown time zone '" + txt + "'")
+		}
+		q.Location = loc
+	}
+
+	if txt := values.Get("limit"); len(txt) > 0 {
+		limit, err := strconv.Atoi(txt)
+		if err != nil || limit < 1 {
+			return q, errors.New("limit must be a positive integer")
+		}
+		q.Limit = limit
+	}
+
+	var err error
+	if q.From, q.To, err = ParseTimeRange(values, now); err != nil {
+		return q, err
+	}
+
+	return q, nil
+}
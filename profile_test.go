@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildAcctProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	// Sunday 2016-10-09
+	at := func(day int, hour int) time.Time {
+		return time.Date(2016, 10, day, hour, 0, 0, 0, time.UTC)
+	}
+	tweets := TweetRecordList{
+		{TweetID: 1, CreatedAt: at(9, 2), Hashtags: []string{"#Debate"}, Mentions: []string{"@bob"}},
+		{TweetID: 2, CreatedAt: at(9, 14), Hashtags: []string{"#debate", "#vote"}, IsRetweet: true},
+		{TweetID: 3, CreatedAt: at(10, 2), Mentions: []string{"@Bob", "@carol"}},
+		{TweetID: 4, CreatedAt: at(11, 2), Hashtags: []string{"#vote", "#debate"}},
+	}
+
+	profile := BuildAcctProfile("alice", tweets, ProfileQuery{})
+	assert.Equal("alice", profile.Acct)
+	assert.Equal("UTC", profile.TimeZone)
+	assert.Equal(4, profile.Tweets)
+	assert.Equal("2016-10-09T02:00:00Z", profile.FirstSeen)
+	assert.Equal("2016-10-11T02:00:00Z", profile.LastSeen)
+	assert.Equal("Sunday", profile.Weekdays[0])
+	assert.Equal(1, profile.Heatmap[0][2])
+	assert.Equal(1, profile.Heatmap[0][14])
+	assert.Equal(1, profile.Heatmap[1][2])
+	assert.Equal(1, profile.Heatmap[2][2])
+	assert.Equal("16h0m0s", profile.AvgInterval)
+	assert.Equal(16.0*3600, profile.AvgIntervalSecs)
+	assert.Equal(0.25, profile.RetweetRatio)
+	assert.Equal([]NameCount{{"#debate", 3}, {"#vote", 2}}, profile.TopHashtags)
+	assert.Equal([]NameCount{{"@bob", 2}, {"@carol", 1}}, profile.TopMentions)
+
+	// Time zones move tweets to other days and hours
+	ny, err := time.LoadLocation("America/New_York")
+	pcheck(err)
+	profile = BuildAcctProfile("alice", tweets, ProfileQuery{Location: ny, Limit: 1})
+	assert.Equal("America/New_York", profile.TimeZone)
+	assert.Equal("2016-10-08T22:00:00-04:00", profile.FirstSeen)
+	assert.Equal(1, profile.Heatmap[6][22]) // Saturday 10pm
+	assert.Equal(1, profile.Heatmap[0][10])
+	assert.Len(profile.TopHashtags, 1)
+
+	// Date range
+	profile = BuildAcctProfile("alice", tweets, ProfileQuery{From: at(10, 0)})
+	assert.Equal(2, profile.Tweets)
+	assert.Equal("24h0m0s", profile.AvgInterval)
+
+	// Nothing to profile
+	profile = BuildAcctProfile("nobody", nil, ProfileQuery{})
+	assert.Equal(0, profile.Tweets)
+	assert.Equal("", profile.FirstSeen)
+	assert.Equal("", profile.AvgInterval)
+	assert.Equal(0.0, profile.RetweetRatio)
+	assert.Len(profile.Heatmap, 7)
+	assert.Len(profile.Heatmap[6], 24)
+	assert.Len(profile.TopHashtags, 0)
+}
+
+func TestParseProfileQuery(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2016, 10, 9, 12, 0, 0, 0, time.UTC)
+
+	q, err := ParseProfileQuery(url.Values{}, now)
+	assert.NoError(err)
+	assert.Equal(time.UTC, q.Location)
+	assert.Equal(defaultProfileLimit, q.Limit)
+
+	q, err = ParseProfileQuery(url.Values{"tz": {"Europe/London"}, "limit": {"3"}, "from": {"7d"}}, now)
+	assert.NoError(err)
+	assert.Equal("Europe/London", q.Location.String())
+	assert.Equal(3, q.Limit)
+	assert.Equal(now.Add(-7*24*time.Hour), q.From)
+
+	for _, bad := range []url.Values{{"tz": {"Mars/Olympus"}}, {"limit": {"0"}}, {"to": {"garbage"}}} {
+		_, err := ParseProfileQuery(bad, now)
+		assert.Error(err)
+	}
+}
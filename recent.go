@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecentMentions is a thread-safe ring buffer of the most recently streamed
+// mentions. It is written by the mention stream and read by the API
+type RecentMentions struct {
+	tweets   []TweetRecord
+	curr     int
+	count    int
+	lastRecv time.Time
+	mtx      sync.RWMutex
+}
+
+// RecentQuery is a filter for RecentMentions.Query. Zero values mean "don't
+// filter on this"
+type RecentQuery struct {
+	Acct     string    // Only mentions from or mentioning this account
+	Hashtag  string    // Only mentions using this hashtag
+	Limit    int       // Max number of mentions returned
+	SinceID  int64     // Only mentions with an ID greater than this
+	From     time.Time // Only mentions created at or after this
+	To       time.Time // Only mentions created before this
+	Collapse bool      // Only the newest of each near-duplicate cluster (see DuplicateClusters)
+}
+
+// NewRecentMentions returns an empty buffer holding up to size mentions
+func NewRecentMentions(size int) *RecentMentions {
+	if size < 1 {
+		size = 1
+	}
+	return &RecentMentions{
+		tweets: make([]TweetRecord, size),
+		curr:   -1,
+	}
+}
+
+// LoadRecentMentions returns a new buffer of the given size filled from the
+// last lines of the given mention stream file (see TwitterMentions). A
+// missing file just gives an empty buffer. Lines we can't parse are skipped
+func LoadRecentMentions(filename string, size int) (*RecentMentions, error) {
+	recent := NewRecentMentions(size)
+
+	lines, err := tailLines(filename, recent.Size())
+	if err != nil {
+		return recent, err
+	}
+
+	for _, line := range lines {
+		rec := TweetRecord{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			log.Printf("Skipping unreadable line in %s: %v\n", filename, err)
+			continue
+		}
+		rec.backfill()
+		recent.push(rec)
+	}
+
+	log.Printf("Loaded %d recent mentions from %s\n", recent.Len(), filename)
+	return recent, nil
+}
+
+// push adds to the ring buffer. Caller must hold the write lock (or be the
+// only one with access to the buffer)
+func (rm *RecentMentions) push(tweet TweetRecord) {
+	rm.curr = (rm.curr + 1) % len(rm.tweets)
+	rm.tweets[rm.curr] = tweet
+	if rm.count < len(rm.tweets) {
+		rm.count++
+	}
+}
+
+// Add a newly received mention, possibly pushing out the oldest mention
+func (rm *RecentMentions) Add(tweet TweetRecord) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.push(tweet)
+	rm.lastRecv = time.Now()
+}
+
+// Size is the max number of mentions kept
+func (rm *RecentMentions) Size() int {
+	return len(rm.tweets)
+}
+
+// Len is the number of mentions currently kept
+func (rm *RecentMentions) Len() int {
+	rm.mtx.RLock()
+	defer rm.mtx.RUnlock()
+	return rm.count
+}
+
+// LastRecv is the time the last mention was added (zero if none have been
+// added since startup)
+func (rm *RecentMentions) LastRecv() time.Time {
+	rm.mtx.RLock()
+	defer rm.mtx.RUnlock()
+	return rm.lastRecv
+}
+
+// matchAny returns true if target is in list (ignoring case)
+func matchAny(list []string, target string) bool {
+	for _, one := range list {
+		if strings.EqualFold(one, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if the given tweet passes the query filters (ignoring
+// Limit)
+func (q RecentQuery) Match(tweet TweetRecord) bool {
+	if q.SinceID > 0 && tweet.TweetID <= q.SinceID {
+		return false
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		created := tweet.Created()
+		if (!q.From.IsZero() && created.Before(q.From)) || (!q.To.IsZero() && !created.Before(q.To)) {
+			return false
+		}
+	}
+	if len(q.Acct) > 0 {
+		acct := "@" + strings.TrimPrefix(q.Acct, "@")
+		fromAcct := strings.EqualFold(acct, "@"+strings.TrimPrefix(tweet.UserScreenName, "@"))
+		if !fromAcct && !matchAny(tweet.Mentions, acct) {
+			return false
+		}
+	}
+	if len(q.Hashtag) > 0 {
+		if !matchAny(tweet.Hashtags, "#"+strings.TrimPrefix(q.Hashtag, "#")) {
+			return false
+		}
+	}
+	return true
+}
+
+// Query returns the mentions matching the query in our canonical sort order
+// (newest first)
+func (rm *RecentMentions) Query(q RecentQuery) TweetRecordList {
+	rm.mtx.RLock()
+	defer rm.mtx.RUnlock()
+
+	tweets := make(TweetRecordList, 0, rm.count)
+	for _, tw := range rm.tweets[:rm.count] {
+		if q.Match(tw) {
+			tweets = append(tweets, tw)
+		}
+	}
+
+	SortTwitterRecords(tweets)
+	if q.Limit > 0 && len(tweets) > q.Limit {
+		tweets = tweets[:q.Limit]
+	}
+	return tweets
+}
+
+// ParseRecentQuery builds a query from the API query parameters acct,
+// hashtag, limit, since_id, from, to, and collapse
+func ParseRecentQuery(values url.Values) (RecentQuery, error) {
+	q := RecentQuery{
+		Acct:    strings.TrimSpace(values.Get("acct")),
+		Hashtag: strings.TrimSpace(values.Get("hashtag")),
+	}
+
+	var err error
+	if q.From, q.To, err = ParseTimeRange(values, time.Now()); err != nil {
+		return q, err
+	}
+
+	if txt := values.Get("limit"); len(txt) > 0 {
+		limit, err := strconv.Atoi(txt)
+		if err != nil || limit < 0 {
+			return q, errors.New("limit must be a non-negative integer")
+		}
+		q.Limit = limit
+	}
+
+	if txt := values.Get("since_id"); len(txt) > 0 {
+		since, err := strconv.ParseInt(txt, 10, 64)
+		if err != nil || since < 0 {
+			return q, errors.New("since_id must be a non-negative tweet ID")
+		}
+		q.SinceID = since
+	}
+
+	if txt := values.Get("collapse"); len(txt) > 0 {
+		collapse, err := strconv.ParseBool(txt)
+		if err != nil {
+			return q, errors.New("collapse must be true or false")
+		}
+		q.Collapse = collapse
+	}
+
+	return q, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeRecent(tid int64, user string, hashtags []string, mentions []string) TweetRecord {
+	return TweetRecord{
+		TweetID:        tid,
+		UserScreenName: user,
+		Hashtags:       hashtags,
+		Mentions:       mentions,
+	}
+}
+
+func TestRecentMentionsRing(t *testing.T) {
+	assert := assert.New(t)
+
+	recent := NewRecentMentions(3)
+	assert.Equal(3, recent.Size())
+	assert.Equal(0, recent.Len())
+	assert.Empty(recent.Query(RecentQuery{}))
+	assert.True(recent.LastRecv().IsZero())
+
+	for tid := int64(1); tid <= 5; tid++ {
+		recent.Add(makeRecent(tid, "user", nil, nil))
+	}
+	assert.Equal(3, recent.Len())
+	assert.False(recent.LastRecv().IsZero())
+
+	tweets := recent.Query(RecentQuery{})
+	assert.Len(tweets, 3)
+	assert.Equal(int64(5), tweets[0].TweetID)
+	assert.Equal(int64(4), tweets[1].TweetID)
+	assert.Equal(int64(3), tweets[2].TweetID)
+}
+
+func TestRecentMentionsQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	recent := NewRecentMentions(10)
+	recent.Add(makeRecent(1, "alice", []string{"#Vote"}, []string{"@Bob"}))
+	recent.Add(makeRecent(2, "bob", []string{"#debate"}, nil))
+	recent.Add(makeRecent(3, "carol", []string{"#vote", "#debate"}, []string{"@alice"}))
+	recent.Add(makeRecent(4, "dave", nil, []string{"@bob"}))
+
+	ids := func(q RecentQuery) []int64 {
+		found := make([]int64, 0)
+		for _, tw := range recent.Query(q) {
+			found = append(found, tw.TweetID)
+		}
+		return found
+	}
+
+	assert.Equal([]int64{4, 3, 2, 1}, ids(RecentQuery{}))
+	assert.Equal([]int64{4, 2, 1}, ids(RecentQuery{Acct: "bob"}))
+	assert.Equal([]int64{4, 2, 1}, ids(RecentQuery{Acct: "@BOB"}))
+	assert.Equal([]int64{3, 1}, ids(RecentQuery{Hashtag: "vote"}))
+	assert.Equal([]int64{3}, ids(RecentQuery{Hashtag: "#vote", Acct: "alice", SinceID: 1}))
+	assert.Equal([]int64{4, 3}, ids(RecentQuery{Limit: 2}))
+	assert.Equal([]int64{}, ids(RecentQuery{SinceID: 4}))
+}
+
+func TestRecentMentionsDateRange(t *testing.T) {
+	assert := assert.New(t)
+
+	day := func(d int) time.Time {
+		return time.Date(2016, 10, d, 12, 0, 0, 0, time.UTC)
+	}
+
+	recent := NewRecentMentions(10)
+	for d := 1; d <= 4; d++ {
+		recent.Add(TweetRecord{TweetID: int64(d), CreatedAt: day(d)})
+	}
+	// No CreatedAt: time comes from the ID
+	recent.Add(TweetRecord{TweetID: 785275432357216256})
+
+	assert.Len(recent.Query(RecentQuery{From: day(2)}), 4)
+	assert.Len(recent.Query(RecentQuery{To: day(2)}), 1)
+	assert.Len(recent.Query(RecentQuery{From: day(2), To: day(4)}), 2)
+	assert.Len(recent.Query(RecentQuery{From: day(9), To: day(11)}), 1)
+}
+
+func TestParseRecentQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	parse := func(raw string) (RecentQuery, error) {
+		values, err := url.ParseQuery(raw)
+		pcheck(err)
+		return ParseRecentQuery(values)
+	}
+
+	q, err := parse("")
+	assert.Nil(err)
+	assert.Equal(RecentQuery{}, q)
+
+	q, err = parse("acct=bob&hashtag=%23vote&limit=5&since_id=1234")
+	assert.Nil(err)
+	assert.Equal(RecentQuery{Acct: "bob", Hashtag: "#vote", Limit: 5, SinceID: 1234}, q)
+
+	q, err = parse("from=2016-10-01&to=2016-10-02")
+	assert.Nil(err)
+	assert.Equal(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC), q.From)
+	assert.Equal(time.Date(2016, 10, 2, 0, 0, 0, 0, time.UTC), q.To)
+	_, err = parse("from=2016-10-02&to=2016-10-01")
+	assert.NotNil(err)
+
+	_, err = parse("limit=lots")
+	assert.NotNil(err)
+	_, err = parse("limit=-1")
+	assert.NotNil(err)
+	_, err = parse("since_id=x")
+	assert.NotNil(err)
+
+	q, err = parse("collapse=true")
+	assert.Nil(err)
+	assert.True(q.Collapse)
+	_, err = parse("collapse=maybe")
+	assert.NotNil(err)
+}
+
+func TestLoadRecentMentions(t *testing.T) {
+	assert := assert.New(t)
+
+	recent, err := LoadRecentMentions("/this/file/should/not/exist", 5)
+	assert.Nil(err)
+	assert.Equal(0, recent.Len())
+
+	tmpfile, err := ioutil.TempFile("", "twivility")
+	pcheck(err)
+	defer os.Remove(tmpfile.Name())
+
+	for tid := int64(1); tid <= 8; tid++ {
+		txt, err := json.Marshal(makeRecent(tid, "user", nil, nil))
+		pcheck(err)
+		tmpfile.Write(append(txt, '\n'))
+	}
+	tmpfile.WriteString("GARBAGE\n")
+	tmpfile.Close()
+
+	recent, err = LoadRecentMentions(tmpfile.Name(), 5)
+	assert.Nil(err)
+	assert.Equal(4, recent.Len()) // One line was garbage
+	assert.True(recent.LastRecv().IsZero())
+
+	tweets := recent.Query(RecentQuery{})
+	assert.Equal(int64(8), tweets[0].TweetID)
+	assert.Equal(int64(5), tweets[3].TweetID)
+}
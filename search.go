@@ -0,0 +1,725 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Full-text search over timeline tweets and streamed mentions. The index is
+// an inverted index from words (with their positions in Text, for phrase
+// queries) and fields (author, hashtags, and mentions) to records. Queries
+// look like:
+//
+//     debate "tax returns" from:realDonaldTrump -tag:maga
+//     (clinton OR kaine) AND NOT mention:timkaine since:2016-10-01
+//
+// - Words must all match (AND is implied). A word matches the tweet text
+//   or the author's screen name
+// - "quoted phrases" must appear in the text in order
+// - OR, AND, and NOT (upper case) and parentheses work as expected, and
+//   -term is the same as NOT term
+// - from:acct, tag:hashtag, and mention:acct match the author, a hashtag,
+//   and a mentioned account. A bare #hashtag or @acct is the same as tag: or
+//   mention:
+// - since:time and until:time limit the whole query to a date range (see
+//   ParseTimeParam)
+//
+// Results are ranked with TF-IDF: rarer words count for more, and words
+// that appear more than once in a tweet count a little more. Ties go to the
+// newest tweet.
+
+// Search limits
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 1000
+)
+
+// searchDoc is a single indexed record. A tweet can come from both sources
+// (like a tracked account's own tweet), but it's indexed once: sources are
+// all the sources it came from, first one first
+type searchDoc struct {
+	sources []string
+	tweet   TweetRecord
+}
+
+// hasSource returns true if the doc came from the source ("" is any source)
+func (doc searchDoc) hasSource(source string) bool {
+	if source == "" {
+		return true
+	}
+	for _, one := range doc.sources {
+		if one == source {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchIndex is a thread-safe, incrementally updated inverted index
+type SearchIndex struct {
+	docs   []searchDoc
+	byID   map[int64]int            // tweet ID => doc
+	words  map[string]map[int][]int // word => doc => positions in text
+	fields map[string]map[int]bool  // field:value => docs
+	mtx    sync.RWMutex
+}
+
+// SearchHit is a single search result
+type SearchHit struct {
+	Score  float64
+	Source string // timeline or mentions (the query's source if it has one)
+	Tweet  TweetRecord
+}
+
+// SearchResult is the full result of a search
+type SearchResult struct {
+	Query string
+	Total int // Number of matching tweets (Hits may be limited)
+	Hits  []SearchHit
+}
+
+// SearchQuery is a search request
+type SearchQuery struct {
+	Query  string
+	From   time.Time // Start (inclusive), combined with since:
+	To     time.Time // End (exclusive), combined with until:
+	Limit  int
+	Offset int
+	Source string // Only hits from this source ("" for all of them)
+	Newest bool   // Rank newest first instead of by score
+}
+
+// NewSearchIndex returns an empty index
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		docs:   make([]searchDoc, 0, 1024),
+		byID:   make(map[int64]int),
+		words:  make(map[string]map[int][]int),
+		fields: make(map[string]map[int]bool),
+	}
+}
+
+// searchWords splits text into lower case words (runs of word characters)
+func searchWords(txt string) []string {
+	words := make([]string, 0, 16)
+	runes := []rune(foldTerm(txt))
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(runes) && isWordRune(runes[i]) {
+			i++
+		}
+		words = append(words, string(runes[start:i]))
+	}
+	return words
+}
+
+// fieldValue is the indexed form of a field value: lower case without any
+// leading # or @
+func fieldValue(val string) string {
+	val = foldTerm(strings.TrimSpace(val))
+	return strings.TrimLeft(val, "#@")
+}
+
+// Len is the number of indexed records
+func (ix *SearchIndex) Len() int {
+	ix.mtx.RLock()
+	defer ix.mtx.RUnlock()
+	return len(ix.docs)
+}
+
+// Add indexes the given records from the given source. Records we've
+// already indexed are only noted as also coming from the source
+func (ix *SearchIndex) Add(source string, tweets ...TweetRecord) {
+	ix.mtx.Lock()
+	defer ix.mtx.Unlock()
+
+	addField := func(key string, doc int) {
+		docs, inMap := ix.fields[key]
+		if !inMap {
+			docs = make(map[int]bool)
+			ix.fields[key] = docs
+		}
+		docs[doc] = true
+	}
+
+	for _, tweet := range tweets {
+		if doc, inMap := ix.byID[tweet.TweetID]; inMap {
+			if !ix.docs[doc].hasSource(source) {
+				ix.docs[doc].sources = append(ix.docs[doc].sources, source)
+			}
+			continue
+		}
+
+		doc := len(ix.docs)
+		ix.byID[tweet.TweetID] = doc
+		ix.docs = append(ix.docs, searchDoc{sources: []string{source}, tweet: tweet})
+
+		for pos, word := range searchWords(tweet.Text) {
+			postings, inMap := ix.words[word]
+			if !inMap {
+				postings = make(map[int][]int)
+				ix.words[word] = postings
+			}
+			postings[doc] = append(postings[doc], pos)
+		}
+
+		if name := fieldValue(tweet.UserScreenName); name != "" {
+			addField("from:"+name, doc)
+		}
+		for _, tag := range tweet.Hashtags {
+			addField("tag:"+fieldValue(tag), doc)
+		}
+		for _, mention := range tweet.Mentions {
+			addField("mention:"+fieldValue(mention), doc)
+		}
+	}
+}
+
+// idf is the inverse document frequency for a term in df documents. Caller
+// must hold the read lock
+func (ix *SearchIndex) idf(df int) float64 {
+	return math.Log(1.0 + float64(len(ix.docs))/float64(df))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Query evaluation: every node returns the matching docs and their scores
+
+type searchNode interface {
+	eval(ix *SearchIndex) map[int]float64
+}
+
+// wordNode matches a word in the text or the author's screen name
+type wordNode struct {
+	word string
+}
+
+func (n wordNode) eval(ix *SearchIndex) map[int]float64 {
+	found := make(map[int]float64)
+	postings := ix.words[n.word]
+	authors := ix.fields["from:"+n.word]
+	if len(postings)+len(authors) < 1 {
+		return found
+	}
+
+	idf := ix.idf(len(postings) + len(authors))
+	for doc, positions := range postings {
+		found[doc] = (1.0 + math.Log(float64(len(positions)))) * idf
+	}
+	for doc := range authors {
+		found[doc] += idf
+	}
+	return found
+}
+
+// phraseNode matches words next to each other (in order) in the text
+type phraseNode struct {
+	words []string
+}
+
+func (n phraseNode) eval(ix *SearchIndex) map[int]float64 {
+	found := make(map[int]float64)
+	first := ix.words[n.words[0]]
+
+	for doc, starts := range first {
+		matches := 0
+		for _, start := range starts {
+			isMatch := true
+			for offset, word := range n.words[1:] {
+				if !containsInt(ix.words[word][doc], start+offset+1) {
+					isMatch = false
+					break
+				}
+			}
+			if isMatch {
+				matches++
+			}
+		}
+		if matches > 0 {
+			found[doc] = float64(matches)
+		}
+	}
+
+	// Score like a single (rare) word
+	if len(found) > 0 {
+		idf := ix.idf(len(found)) * float64(len(n.words))
+		for doc, matches := range found {
+			found[doc] = (1.0 + math.Log(matches)) * idf
+		}
+	}
+	return found
+}
+
+// containsInt returns true if target is in list
+func containsInt(list []int, target int) bool {
+	for _, one := range list {
+		if one == target {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldNode matches a field:value
+type fieldNode struct {
+	key string
+}
+
+func (n fieldNode) eval(ix *SearchIndex) map[int]float64 {
+	docs := ix.fields[n.key]
+	found := make(map[int]float64, len(docs))
+	if len(docs) > 0 {
+		idf := ix.idf(len(docs))
+		for doc := range docs {
+			found[doc] = idf
+		}
+	}
+	return found
+}
+
+// allNode matches everything (with no score)
+type allNode struct{}
+
+func (n allNode) eval(ix *SearchIndex) map[int]float64 {
+	found := make(map[int]float64, len(ix.docs))
+	for doc := range ix.docs {
+		found[doc] = 0
+	}
+	return found
+}
+
+// notNode matches everything its child doesn't
+type notNode struct {
+	child searchNode
+}
+
+func (n notNode) eval(ix *SearchIndex) map[int]float64 {
+	return subtractDocs(allNode{}.eval(ix), n.child.eval(ix))
+}
+
+// subtractDocs removes the docs in exclude from found (in place)
+func subtractDocs(found map[int]float64, exclude map[int]float64) map[int]float64 {
+	for doc := range exclude {
+		delete(found, doc)
+	}
+	return found
+}
+
+// andNode matches docs matching all children (scores are summed)
+type andNode struct {
+	children []searchNode
+}
+
+func (n andNode) eval(ix *SearchIndex) map[int]float64 {
+	// Negated children just remove docs, so we don't need their complement
+	var found map[int]float64
+	excludes := make([]searchNode, 0, len(n.children))
+	for _, child := range n.children {
+		if not, isNot := child.(notNode); isNot {
+			excludes = append(excludes, not.child)
+			continue
+		}
+
+		matched := child.eval(ix)
+		if found == nil {
+			found = matched
+			continue
+		}
+		for doc, score := range found {
+			if other, inMap := matched[doc]; inMap {
+				found[doc] = score + other
+			} else {
+				delete(found, doc)
+			}
+		}
+	}
+
+	if found == nil {
+		found = allNode{}.eval(ix)
+	}
+	for _, exclude := range excludes {
+		found = subtractDocs(found, exclude.eval(ix))
+	}
+	return found
+}
+
+// orNode matches docs matching any child (scores are summed)
+type orNode struct {
+	children []searchNode
+}
+
+func (n orNode) eval(ix *SearchIndex) map[int]float64 {
+	found := make(map[int]float64)
+	for _, child := range n.children {
+		for doc, score := range child.eval(ix) {
+			found[doc] += score
+		}
+	}
+	return found
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Query parsing
+
+// Query token kinds
+const (
+	tokWord = iota
+	tokPhrase
+	tokLParen
+	tokRParen
+	tokNeg
+)
+
+type searchToken struct {
+	kind int
+	text string
+}
+
+// lexSearch splits the query into tokens
+func lexSearch(query string) ([]searchToken, error) {
+	tokens := make([]searchToken, 0, 16)
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			i++
+		case r == '(':
+			tokens = append(tokens, searchToken{kind: tokLParen})
+			i++
+		case r == ')':
+			tokens = append(tokens, searchToken{kind: tokRParen})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, errors.New("Unterminated quote in query")
+			}
+			tokens = append(tokens, searchToken{kind: tokPhrase, text: string(runes[i+1 : end])})
+			i = end + 1
+		case r == '-' && i+1 < len(runes) && !strings.ContainsRune(" \t\n\r)", runes[i+1]):
+			tokens = append(tokens, searchToken{kind: tokNeg})
+			i++
+		default:
+			end := i
+			for end < len(runes) && !strings.ContainsRune(" \t\n\r()\"", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, searchToken{kind: tokWord, text: string(runes[i:end])})
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+// searchParser is a recursive descent parser for queries:
+//
+//	or    := and ("OR" and)*
+//	and   := unary ("AND"? unary)*
+//	unary := ("NOT" | "-") unary | "(" or ")" | phrase | word
+type searchParser struct {
+	tokens   []searchToken
+	pos      int
+	now      time.Time
+	since    time.Time
+	until    time.Time
+	relative bool // since: or until: is relative to now
+}
+
+func (p *searchParser) peek() (searchToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return searchToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *searchParser) isOp(op string) bool {
+	tok, ok := p.peek()
+	return ok && tok.kind == tokWord && tok.text == op
+}
+
+// combine returns a single node for the (non-nil) children
+func combine(children []searchNode, isAnd bool) searchNode {
+	kept := make([]searchNode, 0, len(children))
+	for _, child := range children {
+		if child != nil {
+			kept = append(kept, child)
+		}
+	}
+	if len(kept) < 1 {
+		return nil
+	}
+	if len(kept) == 1 {
+		return kept[0]
+	}
+	if isAnd {
+		return andNode{children: kept}
+	}
+	return orNode{children: kept}
+}
+
+func (p *searchParser) parseOr() (searchNode, error) {
+	children := make([]searchNode, 0, 2)
+	for {
+		child, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		if !p.isOp("OR") {
+			break
+		}
+		p.pos++
+	}
+	return combine(children, false), nil
+}
+
+func (p *searchParser) parseAnd() (searchNode, error) {
+	children := make([]searchNode, 0, 4)
+	for {
+		if p.isOp("AND") {
+			p.pos++
+		}
+		tok, ok := p.peek()
+		if !ok || tok.kind == tokRParen || p.isOp("OR") {
+			break
+		}
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) < 1 {
+		return nil, errors.New("Missing search term in query")
+	}
+	return combine(children, true), nil
+}
+
+func (p *searchParser) parseUnary() (searchNode, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, errors.New("Missing search term in query")
+	}
+	p.pos++
+
+	switch tok.kind {
+	case tokNeg:
+		return p.parseNot()
+	case tokLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if next, ok := p.peek(); !ok || next.kind != tokRParen {
+			return nil, errors.New("Missing ) in query")
+		}
+		p.pos++
+		return node, nil
+	case tokRParen:
+		return nil, errors.New("Unexpected ) in query")
+	case tokPhrase:
+		return textNode(tok.text), nil
+	}
+
+	if tok.text == "NOT" {
+		return p.parseNot()
+	}
+	return p.parseWord(tok.text)
+}
+
+func (p *searchParser) parseNot() (searchNode, error) {
+	child, err := p.parseUnary()
+	if err != nil || child == nil {
+		return nil, err
+	}
+	return notNode{child: child}, nil
+}
+
+// parseWord handles a single (unquoted) word, which may be a field
+func (p *searchParser) parseWord(word string) (searchNode, error) {
+	if strings.HasPrefix(word, "#") || strings.HasPrefix(word, "＃") {
+		return fieldNode{key: "tag:" + fieldValue(word)}, nil
+	}
+	if strings.HasPrefix(word, "@") || strings.HasPrefix(word, "＠") {
+		return fieldNode{key: "mention:" + fieldValue(word)}, nil
+	}
+
+	if colon := strings.Index(word, ":"); colon > 0 {
+		name := strings.ToLower(word[:colon])
+		val := word[colon+1:]
+		switch name {
+		case "from", "tag", "mention":
+			if fieldValue(val) == "" {
+				return nil, fmt.Errorf("Missing value for %s: in query", name)
+			}
+			return fieldNode{key: name + ":" + fieldValue(val)}, nil
+		case "since", "until":
+			when, err := ParseTimeParam(val, p.now)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s: %v", name, err)
+			}
+			if name == "since" {
+				p.since = when
+			} else {
+				p.until = when
+			}
+			p.relative = p.relative || relativeTime(val)
+			return nil, nil
+		}
+	}
+
+	return textNode(word), nil
+}
+
+// textNode is a word or phrase node for the text (nil if there are no words)
+func textNode(txt string) searchNode {
+	words := searchWords(txt)
+	switch len(words) {
+	case 0:
+		return nil
+	case 1:
+		return wordNode{word: words[0]}
+	}
+	return phraseNode{words: words}
+}
+
+// parseSearch parses the query into a node (nil matches everything) and the
+// since and until times in the query
+func parseSearch(query string, now time.Time) (searchNode, time.Time, time.Time, error) {
+	tokens, err := lexSearch(query)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	if len(tokens) < 1 {
+		return nil, time.Time{}, time.Time{}, errors.New("Empty query")
+	}
+
+	p := &searchParser{tokens: tokens, now: now}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, time.Time{}, time.Time{}, errors.New("Unexpected ) in query")
+	}
+	return node, p.since, p.until, nil
+}
+
+// searchTimeRelative returns true if the query has a since: or until: time
+// relative to now (like since:24h), so its results change with the time
+func searchTimeRelative(query string) bool {
+	tokens, err := lexSearch(query)
+	if err != nil {
+		return false
+	}
+	p := &searchParser{tokens: tokens, now: time.Now()}
+	p.parseOr()
+	return p.relative
+}
+
+// Search runs the query, returning hits ranked by score (newest first for
+// ties) or just newest first
+func (ix *SearchIndex) Search(q SearchQuery) (SearchResult, error) {
+	node, since, until, err := parseSearch(q.Query, time.Now())
+	if err != nil {
+		return SearchResult{}, err
+	}
+	from, to := q.From, q.To
+	if since.After(from) {
+		from = since
+	}
+	if !until.IsZero() && (to.IsZero() || until.Before(to)) {
+		to = until
+	}
+	if node == nil {
+		node = allNode{}
+	}
+
+	ix.mtx.RLock()
+	defer ix.mtx.RUnlock()
+
+	hits := make([]SearchHit, 0, 64)
+	for doc, score := range node.eval(ix) {
+		rec := ix.docs[doc]
+		if rec.hasSource(q.Source) && rec.tweet.CreatedIn(from, to) {
+			source := q.Source
+			if source == "" {
+				source = rec.sources[0]
+			}
+			hits = append(hits, SearchHit{
+				Score:  math.Floor(score*1000+0.5) / 1000,
+				Source: source,
+				Tweet:  rec.tweet,
+			})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if !q.Newest && hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Tweet.TweetID > hits[j].Tweet.TweetID
+	})
+
+	result := SearchResult{Query: q.Query, Total: len(hits)}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if q.Offset >= len(hits) {
+		hits = hits[:0]
+	} else {
+		hits = hits[q.Offset:]
+	}
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	result.Hits = hits
+	return result, nil
+}
+
+// ParseSearchQuery builds a query from the API query parameters q, from, to,
+// limit (default 50, max 1000), and offset
+func ParseSearchQuery(values url.Values, now time.Time) (SearchQuery, error) {
+	q := SearchQuery{Query: strings.TrimSpace(values.Get("q")), Limit: defaultSearchLimit}
+	if q.Query == "" {
+		return q, errors.New("q (the query) is required")
+	}
+
+	var err error
+	if q.From, q.To, err = ParseTimeRange(values, now); err != nil {
+		return q, err
+	}
+
+	if txt := values.Get("limit"); len(txt) > 0 {
+		limit, err := strconv.Atoi(txt)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			return q, fmt.Errorf("limit must be from 1 to %d", maxSearchLimit)
+		}
+		q.Limit = limit
+	}
+	if txt := values.Get("offset"); len(txt) > 0 {
+		offset, err := strconv.Atoi(txt)
+		if err != nil || offset < 0 {
+			return q, errors.New("offset must be a non-negative integer")
+		}
+		q.Offset = offset
+	}
+
+	return q, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSearchIndex() *SearchIndex {
+	day := func(d int) time.Time {
+		return time.Date(2016, 10, d, 12, 0, 0, 0, time.UTC)
+	}
+	search := NewSearchIndex()
+	search.Add(SourceTimeline,
+		TweetRecord{TweetID: 1, UserScreenName: "timkaine", Text: "Release your tax returns #debate", Hashtags: []string{"#debate"}, CreatedAt: day(1)},
+		TweetRecord{TweetID: 2, UserScreenName: "realDonaldTrump", Text: "The tax plan is great. Great!", CreatedAt: day(2)},
+		TweetRecord{TweetID: 3, UserScreenName: "HillaryClinton", Text: "Returns on tax day @timkaine", Mentions: []string{"@timkaine"}, CreatedAt: day(3)},
+	)
+	search.Add(SourceMentions,
+		TweetRecord{TweetID: 10, UserScreenName: "voter", Text: "#MAGA tax returns now", Hashtags: []string{"#MAGA"}, CreatedAt: day(4)},
+		TweetRecord{TweetID: 11, UserScreenName: "other", Text: "Watching the #Debate with @TimKaine fans", Hashtags: []string{"#Debate"}, Mentions: []string{"@TimKaine"}, CreatedAt: day(5)},
+		TweetRecord{TweetID: 1, UserScreenName: "timkaine", Text: "Duplicate", CreatedAt: day(1)},
+	)
+	return search
+}
+
+func TestSearch(t *testing.T) {
+	assert := assert.New(t)
+	search := testSearchIndex()
+	assert.Equal(5, search.Len())
+
+	ids := func(query string) []int64 {
+		result, err := search.Search(SearchQuery{Query: query})
+		assert.NoError(err, query)
+		found := make([]int64, 0, len(result.Hits))
+		for _, hit := range result.Hits {
+			found = append(found, hit.Tweet.TweetID)
+		}
+		return found
+	}
+	// anyOrder returns the matches sorted by ID (when we don't care about rank)
+	anyOrder := func(query string) []int64 {
+		found := ids(query)
+		sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+		return found
+	}
+
+	// Words (all must match), ignoring case and punctuation
+	assert.Equal([]int64{10, 3, 1}, ids("TAX returns"))
+	assert.Equal([]int64{2}, ids("great"))
+	assert.Len(ids("nothing"), 0)
+
+	// A word can match the author
+	assert.Equal([]int64{1, 3, 11}, anyOrder("timkaine"))
+
+	// Phrases must be in order
+	assert.Equal([]int64{10, 1}, ids(`"tax returns"`))
+	assert.Equal([]int64{3}, ids(`"returns on tax"`))
+
+	// Fields
+	assert.Equal([]int64{1}, ids("from:TimKaine"))
+	assert.Equal([]int64{1}, ids("from:@timkaine"))
+	assert.Equal([]int64{1, 11}, anyOrder("tag:debate"))
+	assert.Equal([]int64{1, 11}, anyOrder("#DEBATE"))
+	assert.Equal([]int64{3, 11}, anyOrder("mention:timkaine"))
+	assert.Equal([]int64{3, 11}, anyOrder("@timkaine"))
+
+	// Boolean operators
+	assert.Equal([]int64{1, 2, 3, 10}, anyOrder("tax"))
+	assert.Equal([]int64{1, 3, 10}, anyOrder("tax -great"))
+	assert.Equal([]int64{1, 3, 10}, anyOrder("tax AND NOT great"))
+	assert.Equal([]int64{2, 11}, anyOrder("great OR watching"))
+	assert.Equal([]int64{1, 10}, anyOrder("returns (tag:debate OR tag:maga)"))
+	assert.Equal([]int64{2, 11}, anyOrder("NOT returns"))
+
+	// Dates
+	assert.Equal([]int64{2, 3}, anyOrder("tax since:2016-10-02 until:2016-10-04"))
+	assert.Len(ids("since:2016-10-05"), 1)
+
+	result, err := search.Search(SearchQuery{
+		Query: "tax",
+		From:  time.Date(2016, 10, 3, 0, 0, 0, 0, time.UTC),
+		Limit: 1,
+	})
+	assert.NoError(err)
+	assert.Equal(2, result.Total)
+	assert.Len(result.Hits, 1)
+	assert.Equal(SourceMentions, result.Hits[0].Source)
+	assert.True(result.Hits[0].Score > 0)
+
+	result, err = search.Search(SearchQuery{Query: "tax", Limit: 2, Offset: 3})
+	assert.NoError(err)
+	assert.Equal(4, result.Total)
+	assert.Len(result.Hits, 1)
+	result, err = search.Search(SearchQuery{Query: "tax", Offset: 10})
+	assert.NoError(err)
+	assert.Len(result.Hits, 0)
+
+	// Rare words rank higher
+	assert.Equal([]int64{1, 11}, ids("debate OR release"))
+
+	// Newest first and only one source
+	result, err = search.Search(SearchQuery{Query: "debate OR release", Limit: 1, Newest: true})
+	assert.NoError(err)
+	assert.Equal(int64(11), result.Hits[0].Tweet.TweetID)
+	result, err = search.Search(SearchQuery{Query: "tax", Source: SourceTimeline, Newest: true})
+	assert.NoError(err)
+	assert.Equal(3, result.Total)
+	assert.Equal(int64(3), result.Hits[0].Tweet.TweetID)
+
+	// A tweet from both sources is found for either (and only once for both)
+	result, err = search.Search(SearchQuery{Query: "from:timkaine", Source: SourceMentions})
+	assert.NoError(err)
+	assert.Len(result.Hits, 1)
+	assert.Equal(SourceMentions, result.Hits[0].Source)
+	assert.Equal("Release your tax returns #debate", result.Hits[0].Tweet.Text)
+	result, err = search.Search(SearchQuery{Query: "from:timkaine"})
+	assert.NoError(err)
+	assert.Len(result.Hits, 1)
+	assert.Equal(SourceTimeline, result.Hits[0].Source)
+
+	// Errors
+	for _, bad := range []string{"", `"open phrase`, "(tax", "tax)", "tax OR", "NOT", "from:", "since:garbage"} {
+		_, err := search.Search(SearchQuery{Query: bad})
+		assert.Error(err, bad)
+	}
+}
+
+func TestSearchIncremental(t *testing.T) {
+	assert := assert.New(t)
+	search := NewSearchIndex()
+
+	result, err := search.Search(SearchQuery{Query: "hello"})
+	assert.NoError(err)
+	assert.Equal(0, result.Total)
+
+	search.Add(SourceMentions, TweetRecord{TweetID: 1, Text: "hello world"})
+	result, err = search.Search(SearchQuery{Query: "hello"})
+	assert.NoError(err)
+	assert.Equal(1, result.Total)
+
+	search.Add(SourceMentions, TweetRecord{TweetID: 2, Text: "Hello again"})
+	result, err = search.Search(SearchQuery{Query: "hello"})
+	assert.NoError(err)
+	assert.Equal(2, result.Total)
+	assert.Equal(int64(2), result.Hits[0].Tweet.TweetID) // Newest first on ties
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2016, 10, 9, 12, 0, 0, 0, time.UTC)
+
+	parse := func(query string) (SearchQuery, error) {
+		values, err := url.ParseQuery(query)
+		pcheck(err)
+		return ParseSearchQuery(values, now)
+	}
+
+	q, err := parse("q=tax+returns")
+	assert.NoError(err)
+	assert.Equal("tax returns", q.Query)
+	assert.Equal(defaultSearchLimit, q.Limit)
+	assert.Equal(0, q.Offset)
+
+	q, err = parse("q=tax&limit=10&offset=20&from=24h")
+	assert.NoError(err)
+	assert.Equal(10, q.Limit)
+	assert.Equal(20, q.Offset)
+	assert.Equal(now.Add(-24*time.Hour), q.From)
+
+	for _, bad := range []string{"", "q=+", "q=a&limit=0", "q=a&limit=1001", "q=a&limit=x", "q=a&offset=-1", "q=a&from=garbage"} {
+		_, err := parse(bad)
+		assert.Error(err, bad)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Lexicon-based sentiment scoring. Every word in a tweet is looked up in
+// sentimentLexicon (see sentiment_lexicon.go) which gives it a valence from
+// -4 (very negative) to +4 (very positive). The valences are adjusted by
+// these rules and then summed:
+//
+// - Negation: a negator ("not", "never", "don't", etc) flips and damps the
+//   valence of the next 3 words in the same clause
+// - Boosters and dampeners: "very good" is more positive than "good" and
+//   "slightly bad" is less negative than "bad"
+// - CAPS: a word in all caps (in a tweet that isn't all caps) is emphasized
+// - Exclamation points: each one (up to 4) pushes the total further from 0
+//
+// The sum is normalized to the range -1 to +1 (see normSentiment), so the
+// score of a tweet is never more than 1 no matter how many words it has.
+
+const (
+	negationScale   = -0.74 // Multiplier for a negated word
+	negationWindow  = 3     // Number of words a negator covers
+	boosterIncr     = 0.293 // Added (in the word's direction) per booster
+	capsIncr        = 0.733 // Added (in the word's direction) for CAPS
+	exclaimIncr     = 0.292 // Added (in the sum's direction) per !
+	maxExclaims     = 4
+	sentimentNormal = 15.0 // Controls how fast the normalized score nears +/- 1
+)
+
+// urlMatch finds URL's, which we don't score
+var urlMatch = regexp.MustCompile(`https?://\S+`)
+
+// sentimentToken is a single word in a tweet
+type sentimentToken struct {
+	word   string // Lower case
+	caps   bool   // Was all caps in the tweet
+	clause bool   // Is the first word of a new clause
+}
+
+// isClauseRune is true for punctuation that ends a clause (and therefore
+// negation)
+func isClauseRune(r rune) bool {
+	return strings.ContainsRune(".,;:!?", r)
+}
+
+// sentimentTokens splits the text into words, skipping URL's and @mentions.
+// Hashtags are scored as plain words
+func sentimentTokens(txt string) []sentimentToken {
+	runes := []rune(urlMatch.ReplaceAllString(txt, " "))
+	tokens := make([]sentimentToken, 0, 32)
+	newClause := true
+
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			if isClauseRune(runes[i]) {
+				newClause = true
+			}
+			i++
+			continue
+		}
+
+		// Words may have embedded apostrophes (don't, isn’t)
+		start := i
+		for i < len(runes) && (isWordRune(runes[i]) || ((runes[i] == '\'' || runes[i] == '’') && i+1 < len(runes) && isWordRune(runes[i+1]))) {
+			i++
+		}
+		if start > 0 && (runes[start-1] == '@' || runes[start-1] == '＠') {
+			continue
+		}
+
+		raw := string(runes[start:i])
+		word := strings.ToLower(strings.Replace(raw, "’", "'", -1))
+		tokens = append(tokens, sentimentToken{
+			word:   word,
+			caps:   word != raw && isAllCaps(raw),
+			clause: newClause,
+		})
+		newClause = false
+	}
+
+	return tokens
+}
+
+// isAllCaps is true if the string has at least 2 letters and none of them are
+// lower case
+func isAllCaps(s string) bool {
+	letters := 0
+	for _, r := range s {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	return letters > 1
+}
+
+// isNegator returns true for words that negate what follows
+func isNegator(word string) bool {
+	return sentimentNegators[word] || strings.HasSuffix(word, "n't")
+}
+
+// toward returns incr with the same sign as val
+func toward(val float64, incr float64) float64 {
+	if val < 0 {
+		return -incr
+	}
+	return incr
+}
+
+// normSentiment maps a raw sum to the range -1 to +1
+func normSentiment(sum float64) float64 {
+	if sum == 0 {
+		return 0
+	}
+	norm := sum / math.Sqrt(sum*sum+sentimentNormal)
+	return math.Floor(norm*1000+0.5) / 1000
+}
+
+// ScoreSentiment returns the sentiment of the text from -1 (most negative) to
+// +1 (most positive). Text with no sentiment words scores 0
+func ScoreSentiment(txt string) float64 {
+	tokens := sentimentTokens(txt)
+
+	// If everything is in caps, caps isn't emphasis
+	allCaps := isAllCaps(urlMatch.ReplaceAllString(txt, " "))
+
+	sum := 0.0
+	negated := 0 // Words left in the current negation
+	boost := 0.0 // Pending booster/dampener adjustment
+	for _, tok := range tokens {
+		if tok.clause {
+			negated = 0
+			boost = 0
+		}
+
+		if isNegator(tok.word) {
+			negated = negationWindow
+			continue
+		}
+		if adj, isBooster := sentimentBoosters[tok.word]; isBooster {
+			boost += adj
+			continue
+		}
+
+		val, inLexicon := sentimentLexicon[tok.word]
+		if inLexicon {
+			if boost != 0 {
+				val += toward(val, boost)
+			}
+			if tok.caps && !allCaps {
+				val += toward(val, capsIncr)
+			}
+			if negated > 0 {
+				val *= negationScale
+			}
+			sum += val
+		}
+
+		boost = 0
+		if negated > 0 {
+			negated--
+		}
+	}
+
+	if sum != 0 {
+		exclaims := strings.Count(txt, "!")
+		if exclaims > maxExclaims {
+			exclaims = maxExclaims
+		}
+		sum += toward(sum, float64(exclaims)*exclaimIncr)
+	}
+
+	return normSentiment(sum)
+}
@@ -0,0 +1,228 @@
+package main
+
+// The bundled sentiment lexicon (see sentiment.go). Valences run from -4 to
+// +4. Words are lower case; hashtags are scored as their plain word.
+
+// sentimentNegators flip the valence of the words that follow. Any word
+// ending in n't is a negator as well
+var sentimentNegators = map[string]bool{
+	"ain't": true, "aint": true, "cannot": true, "cant": true, "dont": true,
+	"doesnt": true, "didnt": true, "isnt": true, "wasnt": true, "wont": true,
+	"neither": true, "never": true, "no": true, "nobody": true, "none": true,
+	"nope": true, "nor": true, "not": true, "nothing": true, "nowhere": true,
+	"without": true,
+}
+
+// sentimentBoosters increase (positive) or decrease (negative) the intensity
+// of the next word
+var sentimentBoosters = map[string]float64{
+	"absolutely": boosterIncr, "completely": boosterIncr, "especially": boosterIncr,
+	"extremely": boosterIncr, "incredibly": boosterIncr, "most": boosterIncr,
+	"much": boosterIncr, "really": boosterIncr, "so": boosterIncr,
+	"super": boosterIncr, "too": boosterIncr, "totally": boosterIncr,
+	"truly": boosterIncr, "utterly": boosterIncr, "very": boosterIncr,
+	"almost": -boosterIncr, "barely": -boosterIncr, "hardly": -boosterIncr,
+	"kinda": -boosterIncr, "less": -boosterIncr, "marginally": -boosterIncr,
+	"partly": -boosterIncr, "slightly": -boosterIncr, "somewhat": -boosterIncr,
+	"sorta": -boosterIncr,
+}
+
+// sentimentLexicon is the valence of each sentiment word
+var sentimentLexicon = map[string]float64{
+	// Positive
+	"admire":       2.5,
+	"amazing":      2.8,
+	"applaud":      2.2,
+	"appreciate":   2.0,
+	"awesome":      3.1,
+	"beautiful":    2.9,
+	"best":         3.2,
+	"better":       1.9,
+	"bless":        1.8,
+	"blessed":      2.3,
+	"brave":        2.4,
+	"brilliant":    2.8,
+	"calm":         1.3,
+	"celebrate":    2.7,
+	"champion":     2.1,
+	"charming":     2.2,
+	"cheer":        2.3,
+	"clean":        1.3,
+	"confident":    2.2,
+	"congrats":     2.4,
+	"congratulate": 2.5,
+	"cool":         1.3,
+	"courage":      2.2,
+	"delight":      2.9,
+	"delighted":    2.9,
+	"eager":        1.5,
+	"easy":         1.3,
+	"effective":    1.6,
+	"enjoy":        2.2,
+	"excellent":    2.7,
+	"excited":      2.2,
+	"exciting":     2.2,
+	"fair":         1.3,
+	"faith":        1.6,
+	"fantastic":    2.6,
+	"favorite":     2.0,
+	"fine":         0.8,
+	"free":         1.5,
+	"fresh":        1.3,
+	"friend":       2.2,
+	"fun":          2.3,
+	"glad":         2.0,
+	"good":         1.9,
+	"grateful":     2.0,
+	"great":        3.1,
+	"greatest":     3.2,
+	"happy":        2.7,
+	"healthy":      1.7,
+	"help":         1.7,
+	"helpful":      1.8,
+	"honest":       2.3,
+	"honor":        2.2,
+	"hope":         1.9,
+	"hopeful":      1.7,
+	"huge":         1.3,
+	"impressive":   2.3,
+	"inspiring":    2.4,
+	"joy":          2.8,
+	"kind":         2.4,
+	"laugh":        2.2,
+	"leader":       1.3,
+	"like":         1.5,
+	"love":         3.2,
+	"loved":        2.9,
+	"lovely":       2.8,
+	"loyal":        2.1,
+	"lucky":        1.8,
+	"nice":         1.8,
+	"optimistic":   2.2,
+	"peace":        2.5,
+	"perfect":      2.7,
+	"pleased":      1.9,
+	"positive":     2.3,
+	"powerful":     1.8,
+	"pride":        1.4,
+	"progress":     1.8,
+	"protect":      1.5,
+	"proud":        2.1,
+	"qualified":    1.6,
+	"ready":        1.0,
+	"respect":      2.1,
+	"safe":         1.9,
+	"smart":        1.7,
+	"strong":       2.3,
+	"success":      2.7,
+	"successful":   2.8,
+	"support":      1.7,
+	"terrific":     2.9,
+	"thank":        1.5,
+	"thanks":       1.9,
+	"tremendous":   2.4,
+	"true":         1.4,
+	"trust":        2.3,
+	"united":       1.8,
+	"victory":      2.8,
+	"win":          2.8,
+	"winner":       2.8,
+	"winning":      2.4,
+	"wins":         2.7,
+	"wonderful":    2.7,
+	"wow":          2.8,
+	"yay":          2.4,
+	"yes":          1.7,
+
+	// Negative
+	"abuse":       -3.2,
+	"afraid":      -2.2,
+	"angry":       -2.3,
+	"annoying":    -1.8,
+	"attack":      -2.1,
+	"awful":       -2.0,
+	"bad":         -2.5,
+	"betray":      -3.2,
+	"bias":        -0.4,
+	"biased":      -1.1,
+	"blame":       -1.4,
+	"boring":      -1.3,
+	"broken":      -2.1,
+	"corrupt":     -3.0,
+	"corruption":  -3.0,
+	"crazy":       -1.4,
+	"crime":       -2.5,
+	"criminal":    -2.4,
+	"crisis":      -3.1,
+	"crooked":     -2.3,
+	"cry":         -2.1,
+	"damn":        -1.7,
+	"danger":      -2.4,
+	"dangerous":   -2.1,
+	"dead":        -3.3,
+	"death":       -2.9,
+	"deceive":     -1.7,
+	"defeat":      -2.0,
+	"desperate":   -1.3,
+	"destroy":     -2.5,
+	"disaster":    -3.1,
+	"disgrace":    -2.2,
+	"disgusting":  -2.4,
+	"dishonest":   -2.7,
+	"dumb":        -2.3,
+	"evil":        -3.4,
+	"fail":        -2.5,
+	"failed":      -2.3,
+	"failure":     -2.3,
+	"fake":        -2.1,
+	"fear":        -2.2,
+	"fight":       -1.6,
+	"fraud":       -2.8,
+	"hate":        -2.7,
+	"hurt":        -2.4,
+	"idiot":       -2.3,
+	"illegal":     -2.6,
+	"incompetent": -2.7,
+	"kill":        -3.7,
+	"lame":        -1.8,
+	"liar":        -3.1,
+	"lie":         -1.6,
+	"lies":        -1.8,
+	"lose":        -1.7,
+	"loser":       -2.4,
+	"losing":      -1.6,
+	"lost":        -1.3,
+	"mad":         -2.2,
+	"mess":        -1.5,
+	"nasty":       -2.6,
+	"negative":    -2.7,
+	"nightmare":   -2.7,
+	"pathetic":    -2.7,
+	"poor":        -2.1,
+	"problem":     -1.7,
+	"racist":      -3.1,
+	"ridiculous":  -2.1,
+	"rigged":      -2.2,
+	"sad":         -2.1,
+	"scam":        -2.3,
+	"scandal":     -1.9,
+	"scared":      -1.9,
+	"shame":       -2.1,
+	"sick":        -2.3,
+	"stupid":      -2.4,
+	"terrible":    -2.1,
+	"terror":      -3.0,
+	"threat":      -2.4,
+	"tired":       -1.9,
+	"trouble":     -1.7,
+	"ugly":        -2.3,
+	"unfair":      -2.1,
+	"upset":       -1.6,
+	"violence":    -3.1,
+	"war":         -2.9,
+	"weak":        -1.9,
+	"worried":     -1.2,
+	"worse":       -2.1,
+	"worst":       -3.1,
+	"wrong":       -2.1,
+}
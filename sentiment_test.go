@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScoreSentiment(t *testing.T) {
+	assert := assert.New(t)
+
+	// Neutral
+	assert.Equal(0.0, ScoreSentiment(""))
+	assert.Equal(0.0, ScoreSentiment("The debate is tonight at 9"))
+
+	good := ScoreSentiment("What a good speech")
+	bad := ScoreSentiment("What a bad speech")
+	assert.True(good > 0)
+	assert.True(bad < 0)
+	assert.True(good <= 1.0)
+	assert.True(bad >= -1.0)
+
+	// Negation flips (and damps), but only within the clause
+	notGood := ScoreSentiment("That was not good")
+	assert.True(notGood < 0)
+	assert.True(-notGood < good)
+	assert.True(ScoreSentiment("It isn't good") < 0)
+	assert.True(ScoreSentiment("It isn’t good") < 0)
+	assert.True(ScoreSentiment("Not now. Good speech") > 0)
+	assert.True(ScoreSentiment("Not a single person in the room was good") > 0) // Out of the window
+
+	// Emphasis
+	assert.True(ScoreSentiment("What a very good speech") > good)
+	assert.True(ScoreSentiment("What a slightly good speech") < good)
+	assert.True(ScoreSentiment("What a GOOD speech") > good)
+	assert.Equal(ScoreSentiment("what a good speech"), ScoreSentiment("WHAT A GOOD SPEECH"))
+	assert.True(ScoreSentiment("What a good speech!!") > good)
+	assert.True(ScoreSentiment("What a bad speech!!") < bad)
+	assert.Equal(ScoreSentiment("What a good speech!!!!"), ScoreSentiment("What a good speech!!!!!!!"))
+
+	// Hashtags count, mentions and URL's don't
+	assert.True(ScoreSentiment("#winning") > 0)
+	assert.Equal(0.0, ScoreSentiment("@love http://example.com/bad"))
+
+	// Lots of words stay in range
+	assert.True(ScoreSentiment("love love love love love great great best best awesome") < 1.0)
+}
+
+func TestNewTweetRecordSentiment(t *testing.T) {
+	assert := assert.New(t)
+
+	rec := NewTweetRecord(&twitter.Tweet{
+		ID:   1,
+		Text: "RT @someone: this is trunc...",
+		User: &twitter.User{ScreenName: "someone"},
+		RetweetedStatus: &twitter.Tweet{
+			Text: "This is a terrible idea",
+		},
+	})
+	assert.True(rec.Sentiment < 0)
+
+	// Older records are scored when backfilled
+	old := TweetRecord{TweetID: 785275432357216256, Text: "Great news"}
+	old.backfill()
+	assert.True(old.Sentiment > 0)
+	assert.False(old.CreatedAt.IsZero())
+}
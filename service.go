@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dghubble/go-twitter/twitter"
 )
@@ -15,6 +18,9 @@ type TwitterClient interface {
 	RetrieveHomeTimeline(count int, since int64, max int64) ([]twitter.Tweet, error)
 }
 
+// ErrServiceClosed is returned by updates after Close
+var ErrServiceClosed = errors.New("Twivility service is closed")
+
 // TwivilityService handles rest-ful requests for twivility. Someone else needs
 // to map our functions
 type TwivilityService struct {
@@ -23,6 +29,17 @@ type TwivilityService struct {
 	currentTweets TweetRecordList
 	tweetMap      map[string]TweetRecordList
 	tweetStoreMtx sync.RWMutex
+	closing       int32 // Set (atomically) by Close
+
+	// Added (if set) is called with the new records after every update that
+	// adds records. It is called after the store lock is released
+	Added func(tweets TweetRecordList)
+
+	// Classifier (if set) labels every record we read or add
+	Classifier *Classifier
+
+	// Metrics (if set) records update durations and outcomes
+	Metrics *Metrics
 }
 
 // NewTwivilityService - return a nice, new twitter service. See main.go for
@@ -70,6 +87,7 @@ func (service *TwivilityService) ReadTwitterFile() TweetRecordList {
 
 	TouchFile(service.dataFileName) // Make sure at least empty file exists
 	service.currentTweets = ReadTwitterFile(service.dataFileName)
+	service.Classifier.Label(service.currentTweets)
 	service.updateTweetMap()
 
 	log.Printf("Read %d records from %s\n", len(service.currentTweets), service.dataFileName)
@@ -79,10 +97,27 @@ func (service *TwivilityService) ReadTwitterFile() TweetRecordList {
 // UpdateTwitterFile updates our twitter store on disk
 // If backfill is true, query as if the twitter file is empty and then
 // eliminate duplicates
-func (service *TwivilityService) UpdateTwitterFile(backfill bool) (int, error) {
+func (service *TwivilityService) UpdateTwitterFile(backfill bool) (count int, err error) {
+	started := time.Now()
+	defer func() {
+		service.Metrics.ObserveUpdate(time.Since(started), err)
+	}()
+
+	// Registered before the unlock so that it runs after the unlock
+	added := make(TweetRecordList, 0, 64)
+	defer func() {
+		if service.Added != nil && len(added) > 0 {
+			service.Added(added)
+		}
+	}()
+
 	service.tweetStoreMtx.Lock()
 	defer service.tweetStoreMtx.Unlock()
 
+	if service.closed() {
+		return 0, ErrServiceClosed
+	}
+
 	TouchFile(service.dataFileName) // Make sure at least empty file exists
 	existing := ReadTwitterFile(service.dataFileName)
 	SortTwitterRecords(existing)
@@ -110,6 +145,7 @@ func (service *TwivilityService) UpdateTwitterFile(backfill bool) (int, error) {
 		tweets, tweetErr := service.client.RetrieveHomeTimeline(qCount, qSince, qMax)
 		if tweetErr != nil {
 			log.Printf("Error getting user timeline: %v\n", tweetErr)
+			added = added[:0] // Nothing was saved
 			return 0, tweetErr
 		}
 
@@ -121,7 +157,9 @@ func (service *TwivilityService) UpdateTwitterFile(backfill bool) (int, error) {
 			if _, inMap := seen[tweetID]; !inMap {
 				// New ID!
 				newRec := NewTweetRecord(&tweet)
+				newRec.Categories = service.Classifier.Classify(newRec)
 				existing = append(existing, newRec)
+				added = append(added, newRec)
 				seen[tweetID] = true
 				addCount++
 				if tweetID < batchMin || batchMin == 0 {
@@ -143,8 +181,16 @@ func (service *TwivilityService) UpdateTwitterFile(backfill bool) (int, error) {
 		if qMax <= qSince+1 {
 			break // Nothing left to find
 		}
+
+		if service.closed() {
+			log.Printf("Shutting down: saving the %d records we have so far\n", totalAdded)
+			break // The next update will pick up where we left off
+		}
 	}
 
+	// Relabel everything in case our categories changed
+	service.Classifier.Label(existing)
+
 	log.Printf("Added %d records: rewriting file %s\n", totalAdded, service.dataFileName)
 	existing.WriteTwitterFile(service.dataFileName)
 	service.currentTweets = existing
@@ -152,6 +198,27 @@ func (service *TwivilityService) UpdateTwitterFile(backfill bool) (int, error) {
 	return totalAdded, nil
 }
 
+// closed is true once Close has been called
+func (service *TwivilityService) closed() bool {
+	return atomic.LoadInt32(&service.closing) != 0
+}
+
+// Close stops any further updates. An update that is already running stops
+// after its current Twitter call and saves what it has so far: Close waits
+// until it's done, so the store file is never left half written
+func (service *TwivilityService) Close() {
+	atomic.StoreInt32(&service.closing, 1)
+	service.tweetStoreMtx.Lock()
+	defer service.tweetStoreMtx.Unlock()
+}
+
+// GetAllTweets returns every record in the current store (sorted)
+func (service *TwivilityService) GetAllTweets() TweetRecordList {
+	service.tweetStoreMtx.RLock()
+	defer service.tweetStoreMtx.RUnlock()
+	return service.currentTweets
+}
+
 // GetAccounts returns all accounts in our current twitter store
 func (service *TwivilityService) GetAccounts() []string {
 	service.tweetStoreMtx.RLock()
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 
 	"github.com/dghubble/go-twitter/twitter"
@@ -110,6 +111,11 @@ func TestTwitterFileIO(t *testing.T) {
 	assert.Equal(int64(2), tweets[2].TweetID)
 	assert.Equal(int64(1), tweets[3].TweetID)
 
+	// Our test timestamps can't be parsed and our test IDs aren't snowflakes,
+	// so there are no created times
+	assert.True(tweets[0].CreatedAt.IsZero())
+	assert.True(tweets[3].Created().IsZero())
+
 	// check hash tags came back OK
 	assert.Equal(0, len(tweets[0].Hashtags))
 	assert.Equal(1, len(tweets[1].Hashtags))
@@ -232,3 +238,71 @@ func TestTwitterFailingClient(t *testing.T) {
 	assertUpdate(0, false, service)
 	assert.Equal(4, len(service.ReadTwitterFile()))
 }
+
+func TestTwitterAddedCallback(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpfile, err := ioutil.TempFile("", "twivility")
+	pcheck(err)
+	defer os.Remove(tmpfile.Name())
+
+	calls := 0
+	var added TweetRecordList
+
+	service := NewTwivilityService(&TestTwitterClient{}, tmpfile.Name())
+	service.Added = func(tweets TweetRecordList) {
+		calls++
+		added = tweets
+		assert.Len(service.GetAllTweets(), 4) // Store lock must be released
+	}
+
+	service.UpdateTwitterFile(false)
+	assert.Equal(1, calls)
+	assert.Len(added, 4)
+
+	// Nothing new: no call
+	service.UpdateTwitterFile(false)
+	assert.Equal(1, calls)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Testing shutdown: updates in progress save what they have, and later
+// updates don't run
+
+type ClosingTwitterClient struct {
+	service *TwivilityService
+	calls   int
+}
+
+func (cli *ClosingTwitterClient) RetrieveHomeTimeline(count int, since int64, max int64) ([]twitter.Tweet, error) {
+	cli.calls++
+	atomic.StoreInt32(&cli.service.closing, 1) // Like Close without waiting on the lock
+	return (&TestTwitterClient{}).RetrieveHomeTimeline(count, since, max)
+}
+
+func TestTwitterServiceClose(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpfile, err := ioutil.TempFile("", "twivility")
+	pcheck(err)
+	defer os.Remove(tmpfile.Name())
+
+	client := &ClosingTwitterClient{}
+	service := NewTwivilityService(client, tmpfile.Name())
+	client.service = service
+
+	count, err := service.UpdateTwitterFile(false)
+	assert.NoError(err)
+	assert.Equal(4, count)
+	assert.Equal(1, client.calls)
+	assert.Len(ReadTwitterFile(tmpfile.Name()), 4)
+
+	_, err = os.Stat(tmpfile.Name() + ".tmp")
+	assert.True(os.IsNotExist(err))
+
+	service.Close()
+	count, err = service.UpdateTwitterFile(false)
+	assert.Equal(ErrServiceClosed, err)
+	assert.Equal(0, count)
+	assert.Equal(1, client.calls)
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output sinks for streamed mentions. The mention stream always writes to
+// stream.json; sinks are extra places that (some) mentions go. Sinks are
+// configured in a JSON file like:
+//
+//     {"Sinks": [
+//         {"Name": "tags", "Type": "hashtag", "Path": "./by-hashtag"},
+//         {"Type": "unix", "Path": "/tmp/twivility.sock"},
+//         {"Type": "stdout", "Filter": {"Retweets": "exclude"}},
+//         {"Type": "webhook", "URL": "http://localhost:9000/hook", "Timeout": "5s",
+//          "Failure": {"Retries": 2, "DisableAfter": 10, "DisableFor": "10m"}},
+//         {"Type": "csv", "Path": "mentions.csv", "Filter": {"Hashtags": ["#vote"]}}
+//     ]}
+//
+// Every sink has its own queue and goroutine, so a slow or broken sink can't
+// hold up the stream (or any other sink). When a sink's queue is full,
+// mentions for that sink are dropped (and counted).
+
+// Sink is something that accepts mention records. line is the JSON for the
+// record with a trailing newline (exactly what is written to stream.json)
+type Sink interface {
+	Write(rec TweetRecord, line []byte) error
+	Close() error
+}
+
+// SinkFilter decides which mentions go to a sink. Empty lists match
+// everything, and a mention must pass every non-empty list
+type SinkFilter struct {
+	Accts    []string // Mentions from or mentioning any of these accounts
+	Hashtags []string // Mentions using any of these hashtags
+	Terms    []string // Mentions that matched any of these track entries
+	Retweets string   // "" (or "include") for all, "exclude", or "only"
+}
+
+// Match returns true if the record should go to the sink
+func (f SinkFilter) Match(rec TweetRecord) bool {
+	switch strings.ToLower(f.Retweets) {
+	case "exclude":
+		if rec.IsRetweet {
+			return false
+		}
+	case "only":
+		if !rec.IsRetweet {
+			return false
+		}
+	}
+
+	if len(f.Accts) > 0 {
+		found := false
+		for _, acct := range f.Accts {
+			if (RecentQuery{Acct: acct}).Match(rec) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Hashtags) > 0 {
+		found := false
+		for _, tag := range f.Hashtags {
+			if matchAny(rec.Hashtags, "#"+strings.TrimPrefix(tag, "#")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Terms) > 0 {
+		found := false
+		for _, term := range f.Terms {
+			if matchAny(rec.MatchedTerms, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Duration is a time.Duration that reads from JSON strings like "5s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON accepts a Go duration string or a number of seconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var txt string
+	if err := json.Unmarshal(data, &txt); err != nil {
+		var secs float64
+		if err := json.Unmarshal(data, &secs); err != nil {
+			return errors.New("Durations must be strings (like \"5s\") or seconds")
+		}
+		d.Duration = time.Duration(secs * float64(time.Second))
+		return nil
+	}
+
+	val, err := time.ParseDuration(txt)
+	if err != nil {
+		return err
+	}
+	d.Duration = val
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Retry waits: the default wait before the first retry, and the most we'll
+// wait in all for a single mention (so a broken sink's queue keeps moving)
+const (
+	defaultRetryWait = time.Second
+	maxRetryWait     = 15 * time.Second
+)
+
+// FailurePolicy is what a sink does when a write fails
+type FailurePolicy struct {
+	Retries      int      // Extra attempts for each mention before giving up on it
+	RetryWait    Duration // Wait before the first retry, doubled for each retry after (default 1s)
+	DisableAfter int      // Disable the sink after this many mentions fail in a row (0 = never)
+	DisableFor   Duration // How long a disabled sink stays disabled (0 = until restart)
+}
+
+// SinkConfig is the configuration for a single sink
+type SinkConfig struct {
+	Name    string        // Used in logs and stats (defaults to Type:Path or Type:URL)
+	Type    string        // hashtag, unix, stdout, webhook, or csv
+	Path    string        // Directory for hashtag, socket for unix, file for csv
+	URL     string        // URL for webhook
+	Timeout Duration      // Timeout for unix and webhook (default 10s)
+	Queue   int           // Mentions waiting to be written before we drop (default 1000)
+	Filter  SinkFilter    // Which mentions go to this sink
+	Failure FailurePolicy // What to do on failure
+}
+
+// SinksConfig is the top level of a sink configuration file
+type SinksConfig struct {
+	Sinks []SinkConfig
+}
+
+// ReadSinksConfig reads the sink configuration file. An empty filename is
+// no sinks at all
+func ReadSinksConfig(filename string) (SinksConfig, error) {
+	config := SinksConfig{}
+	if filename == "" {
+		return config, nil
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return config, fmt.Errorf("Invalid sink config %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+// NewSink creates the sink described by the config
+func NewSink(config SinkConfig) (Sink, error) {
+	timeout := config.Timeout.Duration
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	switch strings.ToLower(config.Type) {
+	case "hashtag":
+		if config.Path == "" {
+			return nil, errors.New("hashtag sink requires a Path (directory)")
+		}
+		return NewHashtagSink(config.Path)
+	case "unix":
+		if config.Path == "" {
+			return nil, errors.New("unix sink requires a Path (socket)")
+		}
+		return NewUnixSink(config.Path, timeout), nil
+	case "stdout":
+		return NewWriterSink(os.Stdout), nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, errors.New("webhook sink requires a URL")
+		}
+		return NewWebhookSink(config.URL, timeout), nil
+	case "csv":
+		if config.Path == "" {
+			return nil, errors.New("csv sink requires a Path (file)")
+		}
+		return NewCSVSink(config.Path)
+	}
+
+	return nil, fmt.Errorf("Unknown sink type '%s'", config.Type)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Sink implementations
+
+// WriterSink writes JSON lines to an io.Writer (like stdout)
+type WriterSink struct {
+	target io.Writer
+}
+
+// NewWriterSink returns a sink writing to target
+func NewWriterSink(target io.Writer) *WriterSink {
+	return &WriterSink{target: target}
+}
+
+// Write implements Sink
+func (ws *WriterSink) Write(rec TweetRecord, line []byte) error {
+	_, err := ws.target.Write(line)
+	return err
+}
+
+// Close implements Sink - note that we do NOT close the writer
+func (ws *WriterSink) Close() error {
+	return nil
+}
+
+// HashtagSink writes each mention as a JSON line to a file per hashtag: a
+// mention with #Vote and #debate goes to vote.json and debate.json in the
+// sink's directory. Mentions without hashtags aren't written
+type HashtagSink struct {
+	dir   string
+	files map[string]*os.File
+}
+
+// NewHashtagSink returns a sink writing under dir (which is created if
+// necessary)
+func NewHashtagSink(dir string) (*HashtagSink, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &HashtagSink{dir: dir, files: make(map[string]*os.File)}, nil
+}
+
+// hashtagFileName returns the file name for the tag: lower case with
+// anything that isn't a word character replaced
+func hashtagFileName(tag string) string {
+	name := strings.Map(func(r rune) rune {
+		if isWordRune(r) {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(strings.TrimPrefix(tag, "#")))
+	return name + ".json"
+}
+
+// Write implements Sink
+func (hs *HashtagSink) Write(rec TweetRecord, line []byte) error {
+	seen := NewUniqueStrings()
+	for _, tag := range rec.Hashtags {
+		seen.Add(hashtagFileName(tag))
+	}
+
+	for _, name := range seen.Strings() {
+		output, inMap := hs.files[name]
+		if !inMap {
+			var err error
+			output, err = os.OpenFile(filepath.Join(hs.dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			hs.files[name] = output
+		}
+		if _, err := output.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements Sink
+func (hs *HashtagSink) Close() error {
+	for name, output := range hs.files {
+		SafeClose(output)
+		delete(hs.files, name)
+	}
+	return nil
+}
+
+// UnixSink writes JSON lines to a Unix domain socket. We connect when we
+// need to, and drop the connection on any error so the next write reconnects
+type UnixSink struct {
+	path    string
+	timeout time.Duration
+	conn    net.Conn
+}
+
+// NewUnixSink returns a sink for the socket at path
+func NewUnixSink(path string, timeout time.Duration) *UnixSink {
+	return &UnixSink{path: path, timeout: timeout}
+}
+
+// Write implements Sink
+func (us *UnixSink) Write(rec TweetRecord, line []byte) error {
+	if us.conn == nil {
+		conn, err := net.DialTimeout("unix", us.path, us.timeout)
+		if err != nil {
+			return err
+		}
+		us.conn = conn
+	}
+
+	us.conn.SetWriteDeadline(time.Now().Add(us.timeout))
+	if _, err := us.conn.Write(line); err != nil {
+		us.Close()
+		return err
+	}
+	return nil
+}
+
+// Close implements Sink
+func (us *UnixSink) Close() error {
+	if us.conn == nil {
+		return nil
+	}
+	err := us.conn.Close()
+	us.conn = nil
+	return err
+}
+
+// WebhookSink POSTs each mention as JSON to a URL. Any non-2xx response is
+// an error
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink returns a sink for the given URL
+func NewWebhookSink(url string, timeout time.Duration) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// Write implements Sink
+func (wh *WebhookSink) Write(rec TweetRecord, line []byte) error {
+	return postJSON(wh.client, wh.url, line)
+}
+
+// postJSON POSTs the JSON body to the URL. Any non-2xx response is an error
+func postJSON(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer SafeClose(resp.Body)
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Close implements Sink
+func (wh *WebhookSink) Close() error {
+	return nil
+}
+
+// csvHeader is the header row for CSVSink
+var csvHeader = []string{
+	"TweetID", "Timestamp", "UserID", "UserScreenName", "UserName", "Text",
+	"Hashtags", "Mentions", "MatchedTerms", "IsRetweet", "RetweetCount", "FavoriteCount",
+}
+
+// CSVSink appends mentions to a CSV file. The header is written when the
+// file is new (or empty). List fields are space-delimited
+type CSVSink struct {
+	output *os.File
+	writer *csv.Writer
+}
+
+// NewCSVSink returns a sink appending to filename
+func NewCSVSink(filename string) (*CSVSink, error) {
+	output, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &CSVSink{output: output, writer: csv.NewWriter(output)}
+
+	st, err := output.Stat()
+	if err != nil {
+		SafeClose(output)
+		return nil, err
+	}
+	if st.Size() == 0 {
+		sink.writer.Write(csvHeader)
+		sink.writer.Flush()
+		if err := sink.writer.Error(); err != nil {
+			SafeClose(output)
+			return nil, err
+		}
+	}
+
+	return sink, nil
+}
+
+// Write implements Sink
+func (cs *CSVSink) Write(rec TweetRecord, line []byte) error {
+	cs.writer.Write([]string{
+		strconv.FormatInt(rec.TweetID, 10),
+		rec.Timestamp,
+		strconv.FormatInt(rec.UserID, 10),
+		rec.UserScreenName,
+		rec.UserName,
+		rec.Text,
+		strings.Join(rec.Hashtags, " "),
+		strings.Join(rec.Mentions, " "),
+		strings.Join(rec.MatchedTerms, " "),
+		strconv.FormatBool(rec.IsRetweet),
+		strconv.Itoa(rec.RetweetCount),
+		strconv.Itoa(rec.FavoriteCount),
+	})
+	cs.writer.Flush()
+	return cs.writer.Error()
+}
+
+// Close implements Sink
+func (cs *CSVSink) Close() error {
+	cs.writer.Flush()
+	return cs.output.Close()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Routing mentions to sinks
+
+// SinkStats are the counts we report for a single sink
+type SinkStats struct {
+	Written       int64  // Mentions written
+	Filtered      int64  // Mentions that didn't pass the filter
+	Failed        int64  // Mentions that couldn't be written (after retries)
+	Dropped       int64  // Mentions dropped because the queue was full or the sink was disabled
+	Disabled      bool   // Sink is currently disabled by the failure policy
+	DisabledUntil string // When a disabled sink is re-enabled ("" is never)
+	LastError     string // Most recent error
+}
+
+// sinkEntry is a single running sink
+type sinkEntry struct {
+	name     string
+	sink     Sink
+	filter   SinkFilter
+	policy   FailurePolicy
+	queue    chan sinkItem
+	done     chan struct{}
+	stop     chan struct{} // Closed when the router closes: no more retries
+	failures int           // Consecutive failed mentions
+	stats    SinkStats
+	disabled time.Time // Zero if not disabled
+	mtx      sync.Mutex
+}
+
+type sinkItem struct {
+	rec  TweetRecord
+	line []byte
+}
+
+// SinkRouter sends mentions to all configured sinks
+type SinkRouter struct {
+	entries []*sinkEntry
+	closed  bool
+	mtx     sync.RWMutex
+}
+
+// NewSinkRouter creates (and starts) every sink in the config. If any sink
+// can't be created, the sinks already created are closed and an error is
+// returned
+func NewSinkRouter(config SinksConfig) (*SinkRouter, error) {
+	router := &SinkRouter{entries: make([]*sinkEntry, 0, len(config.Sinks))}
+	for _, sc := range config.Sinks {
+		sink, err := NewSink(sc)
+		if err != nil {
+			router.Close()
+			return nil, err
+		}
+
+		name := sc.Name
+		if name == "" {
+			name = sc.Type
+			if sc.Path != "" {
+				name += ":" + sc.Path
+			} else if sc.URL != "" {
+				name += ":" + sc.URL
+			}
+		}
+		if sc.Failure.RetryWait.Duration <= 0 {
+			sc.Failure.RetryWait.Duration = defaultRetryWait
+		}
+		router.Add(name, sink, sc.Filter, sc.Failure, sc.Queue)
+	}
+	return router, nil
+}
+
+// Add starts routing to the given sink
+func (sr *SinkRouter) Add(name string, sink Sink, filter SinkFilter, policy FailurePolicy, queueSize int) {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+
+	if queueSize < 1 {
+		queueSize = 1000
+	}
+	entry := &sinkEntry{
+		name:   name,
+		sink:   sink,
+		filter: filter,
+		policy: policy,
+		queue:  make(chan sinkItem, queueSize),
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	sr.entries = append(sr.entries, entry)
+	go entry.run()
+	log.Printf("Sinks: added %s\n", name)
+}
+
+// Route sends the mention to every sink whose filter it passes. We never
+// block: if a sink is behind, the mention is dropped for that sink
+func (sr *SinkRouter) Route(rec TweetRecord, line []byte) {
+	sr.mtx.RLock()
+	defer sr.mtx.RUnlock()
+	if sr.closed {
+		return
+	}
+
+	for _, entry := range sr.entries {
+		if !entry.filter.Match(rec) {
+			entry.mtx.Lock()
+			entry.stats.Filtered++
+			entry.mtx.Unlock()
+			continue
+		}
+
+		select {
+		case entry.queue <- sinkItem{rec: rec, line: line}:
+		default:
+			entry.mtx.Lock()
+			entry.stats.Dropped++
+			entry.mtx.Unlock()
+		}
+	}
+}
+
+// Stats returns the current stats for every sink by name
+func (sr *SinkRouter) Stats() map[string]SinkStats {
+	sr.mtx.RLock()
+	defer sr.mtx.RUnlock()
+
+	stats := make(map[string]SinkStats)
+	for _, entry := range sr.entries {
+		entry.mtx.Lock()
+		stats[entry.name] = entry.stats
+		entry.mtx.Unlock()
+	}
+	return stats
+}
+
+// Close stops accepting mentions, writes everything queued, and closes all
+// sinks. Stats are still available after Close
+func (sr *SinkRouter) Close() {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	if sr.closed {
+		return
+	}
+	sr.closed = true
+
+	for _, entry := range sr.entries {
+		close(entry.stop)
+		close(entry.queue)
+	}
+	for _, entry := range sr.entries {
+		<-entry.done
+		if err := entry.sink.Close(); err != nil {
+			log.Printf("Sinks: error closing %s: %v\n", entry.name, err)
+		}
+	}
+}
+
+// isDisabled checks (and possibly ends) the disabled state. Caller must hold
+// the entry lock
+func (entry *sinkEntry) isDisabled() bool {
+	if !entry.stats.Disabled {
+		return false
+	}
+	if !entry.disabled.IsZero() && time.Now().After(entry.disabled) {
+		log.Printf("Sinks: re-enabling %s\n", entry.name)
+		entry.stats.Disabled = false
+		entry.stats.DisabledUntil = ""
+		entry.failures = 0
+		return false
+	}
+	return true
+}
+
+// write writes a single mention, retrying as the policy says. The wait
+// before each retry doubles, but we never wait more than maxRetryWait in all
+// and stop retrying once the router is closing
+func (entry *sinkEntry) write(item sinkItem) error {
+	err := entry.sink.Write(item.rec, item.line)
+	wait, waited := entry.policy.RetryWait.Duration, time.Duration(0)
+	for attempt := 0; err != nil && attempt < entry.policy.Retries; attempt++ {
+		if wait > 0 {
+			if waited >= maxRetryWait {
+				break
+			}
+			if wait > maxRetryWait-waited {
+				wait = maxRetryWait - waited
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-entry.stop:
+				timer.Stop()
+				return err
+			}
+			waited += wait
+			wait *= 2
+		}
+		err = entry.sink.Write(item.rec, item.line)
+	}
+	return err
+}
+
+// run writes queued mentions until the queue is closed
+func (entry *sinkEntry) run() {
+	defer close(entry.done)
+
+	for item := range entry.queue {
+		entry.mtx.Lock()
+		disabled := entry.isDisabled()
+		if disabled {
+			entry.stats.Dropped++
+		}
+		entry.mtx.Unlock()
+		if disabled {
+			continue
+		}
+
+		err := entry.write(item)
+
+		entry.mtx.Lock()
+		if err == nil {
+			entry.stats.Written++
+			entry.failures = 0
+		} else {
+			log.Printf("Sinks: %s failed to write %d: %v\n", entry.name, item.rec.TweetID, err)
+			entry.stats.Failed++
+			entry.stats.LastError = err.Error()
+			entry.failures++
+			if entry.policy.DisableAfter > 0 && entry.failures >= entry.policy.DisableAfter {
+				entry.stats.Disabled = true
+				entry.disabled = time.Time{}
+				if entry.policy.DisableFor.Duration > 0 {
+					entry.disabled = time.Now().Add(entry.policy.DisableFor.Duration)
+					entry.stats.DisabledUntil = fmtTime(entry.disabled)
+				}
+				log.Printf("Sinks: disabling %s after %d failures\n", entry.name, entry.failures)
+			}
+		}
+		entry.mtx.Unlock()
+	}
+}
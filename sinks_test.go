@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sinkRecord(tid int64, hashtags []string, isRetweet bool) (TweetRecord, []byte) {
+	rec := TweetRecord{
+		TweetID:        tid,
+		UserScreenName: "alice",
+		Text:           "some, \"quoted\" text",
+		Hashtags:       hashtags,
+		Mentions:       []string{"@bob"},
+		MatchedTerms:   []string{"@bob"},
+		IsRetweet:      isRetweet,
+	}
+	txt, err := json.Marshal(rec)
+	pcheck(err)
+	return rec, append(txt, '\n')
+}
+
+func TestSinkFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	rec, _ := sinkRecord(1, []string{"#Vote"}, false)
+	rt, _ := sinkRecord(2, []string{"#debate"}, true)
+
+	assert.True(SinkFilter{}.Match(rec))
+	assert.True(SinkFilter{}.Match(rt))
+	assert.True(SinkFilter{Retweets: "exclude"}.Match(rec))
+	assert.False(SinkFilter{Retweets: "exclude"}.Match(rt))
+	assert.False(SinkFilter{Retweets: "only"}.Match(rec))
+	assert.True(SinkFilter{Hashtags: []string{"vote", "#other"}}.Match(rec))
+	assert.False(SinkFilter{Hashtags: []string{"vote"}}.Match(rt))
+	assert.True(SinkFilter{Accts: []string{"@BOB"}}.Match(rec))
+	assert.False(SinkFilter{Accts: []string{"carol"}}.Match(rec))
+	assert.True(SinkFilter{Terms: []string{"@bob"}}.Match(rec))
+	assert.False(SinkFilter{Terms: []string{"#vote"}, Accts: []string{"bob"}}.Match(rec))
+}
+
+func TestReadSinksConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := ReadSinksConfig("")
+	assert.Nil(err)
+	assert.Empty(config.Sinks)
+
+	tmpfile, err := ioutil.TempFile("", "twivility")
+	pcheck(err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.WriteString(`{"Sinks": [
+		{"Type": "stdout", "Filter": {"Retweets": "exclude"}},
+		{"type": "webhook", "url": "http://localhost/hook", "timeout": "5s",
+		 "failure": {"retries": 2, "disableAfter": 3, "disableFor": 60}}
+	]}`)
+	tmpfile.Close()
+
+	config, err = ReadSinksConfig(tmpfile.Name())
+	assert.Nil(err)
+	assert.Len(config.Sinks, 2)
+	assert.Equal("exclude", config.Sinks[0].Filter.Retweets)
+	assert.Equal("http://localhost/hook", config.Sinks[1].URL)
+	assert.Equal(5*time.Second, config.Sinks[1].Timeout.Duration)
+	assert.Equal(2, config.Sinks[1].Failure.Retries)
+	assert.Equal(3, config.Sinks[1].Failure.DisableAfter)
+	assert.Equal(time.Minute, config.Sinks[1].Failure.DisableFor.Duration)
+
+	_, err = NewSink(SinkConfig{Type: "carrier-pigeon"})
+	assert.NotNil(err)
+	_, err = NewSink(SinkConfig{Type: "csv"})
+	assert.NotNil(err)
+	_, err = NewSinkRouter(SinksConfig{Sinks: []SinkConfig{{Type: "stdout"}, {Type: "webhook"}}})
+	assert.NotNil(err)
+}
+
+func TestHashtagAndCSVSinks(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twivility")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+
+	tagDir := filepath.Join(dir, "tags")
+	csvFile := filepath.Join(dir, "mentions.csv")
+
+	router, err := NewSinkRouter(SinksConfig{Sinks: []SinkConfig{
+		{Type: "hashtag", Path: tagDir},
+		{Name: "votes", Type: "csv", Path: csvFile, Filter: SinkFilter{Hashtags: []string{"#vote"}}},
+	}})
+	assert.Nil(err)
+
+	router.Route(sinkRecord(1, []string{"#Vote", "#debate"}, false))
+	router.Route(sinkRecord(2, []string{"#vote"}, false))
+	router.Route(sinkRecord(3, []string{}, false))
+	router.Close()
+
+	lines, err := tailLines(filepath.Join(tagDir, "vote.json"), 10)
+	assert.Nil(err)
+	assert.Len(lines, 2)
+	lines, err = tailLines(filepath.Join(tagDir, "debate.json"), 10)
+	assert.Nil(err)
+	assert.Len(lines, 1)
+
+	input, err := os.Open(csvFile)
+	pcheck(err)
+	defer input.Close()
+	rows, err := csv.NewReader(input).ReadAll()
+	assert.Nil(err)
+	assert.Len(rows, 3)
+	assert.Equal(csvHeader, rows[0])
+	assert.Equal("1", rows[1][0])
+	assert.Equal("some, \"quoted\" text", rows[1][5])
+	assert.Equal("#Vote #debate", rows[1][6])
+
+	// Re-opening shouldn't write another header
+	sink, err := NewCSVSink(csvFile)
+	assert.Nil(err)
+	sink.Close()
+	lines, err = tailLines(csvFile, 10)
+	assert.Nil(err)
+	assert.Len(lines, 3)
+}
+
+func TestUnixSink(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twivility")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+	sockName := filepath.Join(dir, "sink.sock")
+
+	sink := NewUnixSink(sockName, time.Second)
+	rec, line := sinkRecord(1, nil, false)
+	assert.NotNil(sink.Write(rec, line)) // Nobody listening
+
+	listener, err := net.Listen("unix", sockName)
+	pcheck(err)
+	defer listener.Close()
+
+	received := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+	}()
+
+	assert.Nil(sink.Write(rec, line))
+	assert.Equal(string(line[:len(line)-1]), <-received)
+	assert.Nil(sink.Close())
+}
+
+func TestWebhookSink(t *testing.T) {
+	assert := assert.New(t)
+
+	var mtx sync.Mutex
+	bodies := make([]TweetRecord, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := TweetRecord{}
+		if err := json.NewDecoder(req.Body).Decode(&rec); err != nil || rec.TweetID == 13 {
+			http.Error(w, "bad", http.StatusBadRequest)
+			return
+		}
+		mtx.Lock()
+		bodies = append(bodies, rec)
+		mtx.Unlock()
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, time.Second)
+	assert.Nil(sink.Write(sinkRecord(1, nil, false)))
+	assert.NotNil(sink.Write(sinkRecord(13, nil, false)))
+	assert.Len(bodies, 1)
+	assert.Equal(int64(1), bodies[0].TweetID)
+}
+
+// failingSink fails every write until told otherwise
+type failingSink struct {
+	mtx    sync.Mutex
+	fail   bool
+	writes int
+}
+
+func (fs *failingSink) Write(rec TweetRecord, line []byte) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.writes++
+	if fs.fail {
+		return errors.New("I always fail")
+	}
+	return nil
+}
+
+func (fs *failingSink) Close() error { return nil }
+
+func TestSinkFailurePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	bad := &failingSink{fail: true}
+	good := &failingSink{}
+
+	router := &SinkRouter{}
+	router.Add("bad", bad, SinkFilter{}, FailurePolicy{Retries: 1, DisableAfter: 2}, 10)
+	router.Add("good", good, SinkFilter{Retweets: "exclude"}, FailurePolicy{}, 10)
+
+	for tid := int64(1); tid <= 5; tid++ {
+		router.Route(sinkRecord(tid, nil, tid == 5))
+	}
+	router.Close()
+	router.Route(sinkRecord(6, nil, false)) // Ignored after close
+	stats := router.Stats()
+
+	// Bad sink: 2 mentions with 2 attempts each, then disabled
+	assert.Equal(4, bad.writes)
+	assert.Equal(int64(2), stats["bad"].Failed)
+	assert.Equal(int64(3), stats["bad"].Dropped)
+	assert.True(stats["bad"].Disabled)
+	assert.Equal("I always fail", stats["bad"].LastError)
+
+	// Good sink doesn't care
+	assert.Equal(4, good.writes)
+	assert.Equal(int64(4), stats["good"].Written)
+	assert.Equal(int64(1), stats["good"].Filtered)
+}
+
+func TestSinkRetryWait(t *testing.T) {
+	assert := assert.New(t)
+
+	// Waits double between retries
+	bad := &failingSink{fail: true}
+	router := &SinkRouter{}
+	router.Add("bad", bad, SinkFilter{}, FailurePolicy{Retries: 3, RetryWait: Duration{10 * time.Millisecond}}, 10)
+	start := time.Now()
+	router.Route(sinkRecord(1, nil, false))
+	for router.Stats()["bad"].Failed < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(time.Since(start) >= 70*time.Millisecond)
+	router.Close()
+	assert.Equal(4, bad.writes)
+
+	// Closing the router ends any wait (and the retries)
+	slow := &failingSink{fail: true}
+	router = &SinkRouter{}
+	router.Add("slow", slow, SinkFilter{}, FailurePolicy{Retries: 5, RetryWait: Duration{time.Hour}}, 10)
+	router.Route(sinkRecord(1, nil, false))
+	time.Sleep(10 * time.Millisecond)
+	start = time.Now()
+	router.Close()
+	assert.True(time.Since(start) < time.Second)
+	assert.Equal(1, slow.writes)
+	assert.Equal(int64(1), router.Stats()["slow"].Failed)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseTimeParam parses a time given to the API. We accept RFC 3339
+// ("2016-10-09T15:04:05Z"), a date ("2016-10-09", which is UTC), Unix
+// seconds, or a duration before now ("24h" or "7d")
+func ParseTimeParam(txt string, now time.Time) (time.Time, error) {
+	txt = strings.TrimSpace(txt)
+	if t, err := time.Parse(time.RFC3339, txt); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse("2006-01-02", txt); err == nil {
+		return t.UTC(), nil
+	}
+	if secs, err := strconv.ParseInt(txt, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	if dur, err := parseDays(txt); err == nil && dur >= 0 {
+		return now.Add(-dur).UTC(), nil
+	}
+	return time.Time{}, errors.New("Invalid time '" + txt + "': use RFC 3339, YYYY-MM-DD, Unix seconds, or a duration like 24h")
+}
+
+// relativeTime returns true if ParseTimeParam treats the time as relative to
+// now (like "24h")
+func relativeTime(txt string) bool {
+	_, err := parseDays(strings.TrimSpace(txt))
+	return err == nil
+}
+
+// ParseTimeRange parses the optional from and to API query parameters (see
+// ParseTimeParam). Missing values are returned as zero times
+func ParseTimeRange(values url.Values, now time.Time) (from time.Time, to time.Time, err error) {
+	if txt := values.Get("from"); len(txt) > 0 {
+		if from, err = ParseTimeParam(txt, now); err != nil {
+			return
+		}
+	}
+	if txt := values.Get("to"); len(txt) > 0 {
+		if to, err = ParseTimeParam(txt, now); err != nil {
+			return
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !to.After(from) {
+		err = errors.New("to must be after from")
+	}
+	return
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTimeParam(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 10, 9, 12, 30, 0, 0, time.UTC)
+	parse := func(txt string) time.Time {
+		tm, err := ParseTimeParam(txt, now)
+		pcheck(err)
+		return tm
+	}
+
+	assert.Equal(time.Date(2016, 10, 9, 19, 0, 0, 0, time.UTC), parse("2016-10-09T15:00:00-04:00"))
+	assert.Equal(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC), parse("2016-10-01"))
+	assert.Equal(time.Unix(1476000000, 0).UTC(), parse("1476000000"))
+	assert.Equal(now.Add(-2*time.Hour), parse("2h"))
+	assert.Equal(now.Add(-7*24*time.Hour), parse("7d"))
+
+	_, err := ParseTimeParam("yesterday", now)
+	assert.NotNil(err)
+}
+
+func TestParseTimeRange(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 10, 9, 12, 30, 0, 0, time.UTC)
+	parse := func(raw string) (time.Time, time.Time, error) {
+		values, err := url.ParseQuery(raw)
+		pcheck(err)
+		return ParseTimeRange(values, now)
+	}
+
+	from, to, err := parse("")
+	assert.Nil(err)
+	assert.True(from.IsZero())
+	assert.True(to.IsZero())
+
+	from, to, err = parse("from=2016-10-01&to=1d")
+	assert.Nil(err)
+	assert.Equal(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC), from)
+	assert.Equal(now.Add(-24*time.Hour), to)
+
+	_, _, err = parse("from=2016-10-02&to=2016-10-01")
+	assert.NotNil(err)
+	_, _, err = parse("from=someday")
+	assert.NotNil(err)
+	_, _, err = parse("to=someday")
+	assert.NotNil(err)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Activity time series: tweet counts bucketed per minute, hour, and day.
+// Each tweet is counted for its author (acct), each hashtag it uses
+// (hashtag), and each account it mentions (mention), as well as for the
+// overall total. Every bucket also sums the tweets' Sentiment, so each series
+// doubles as a sentiment series. Minute and hour buckets are only kept for a
+// while; day buckets are kept forever. A tracked account's own tweets come
+// from both sources, so tweets are deduplicated per source and counted again
+// (once) for both sources.
+
+// Series kinds
+const (
+	SeriesTotal   = "total"
+	SeriesAcct    = "acct"
+	SeriesHashtag = "hashtag"
+	SeriesMention = "mention"
+)
+
+// seriesStep is a bucket size and how long we keep those buckets
+type seriesStep struct {
+	name      string
+	size      time.Duration
+	retention time.Duration // 0 is forever
+}
+
+var seriesSteps = []seriesStep{
+	{name: "minute", size: time.Minute, retention: 2 * 24 * time.Hour},
+	{name: "hour", size: time.Hour, retention: 60 * 24 * time.Hour},
+	{name: "day", size: 24 * time.Hour, retention: 0},
+}
+
+// maxSeriesPoints is the most points we return for a single series
+const maxSeriesPoints = 10000
+
+// seriesBucket is the count and sentiment total for a single bucket
+type seriesBucket struct {
+	count     int
+	sentiment float64
+}
+
+// seriesKey identifies a single series. An empty source is the series for
+// both sources
+type seriesKey struct {
+	kind   string
+	name   string
+	source string
+}
+
+// ActivitySeries is a thread-safe, incrementally updated set of time series
+type ActivitySeries struct {
+	counts []map[seriesKey]map[int64]seriesBucket // one per seriesSteps entry: key => bucket (unix secs) => bucket
+	seen   *seenTweets                            // Tweets already counted, by source
+	pruned []time.Time                            // one per seriesSteps entry: when we last pruned
+	now    func() time.Time
+	mtx    sync.RWMutex
+}
+
+// SeriesPoint is a single bucket of a series
+type SeriesPoint struct {
+	Time      string
+	Count     int
+	Sentiment float64 // Mean sentiment of the bucket's tweets (0 if none)
+}
+
+// Series is a single time series result
+type Series struct {
+	Kind      string  // total, acct, hashtag, or mention
+	Name      string  // The account or hashtag ("" for total)
+	Source    string  // timeline, mentions, or "" for both
+	Total     int     // Sum of all points
+	Sentiment float64 // Mean sentiment of all the series' tweets
+	Points    []SeriesPoint
+}
+
+// SeriesResult is the full result of a query
+type SeriesResult struct {
+	Step   string
+	From   string
+	To     string
+	Series []Series
+}
+
+// SeriesQuery selects what ActivitySeries.Query returns
+type SeriesQuery struct {
+	Step     string    // minute, hour, or day
+	From     time.Time // Start (inclusive)
+	To       time.Time // End (exclusive)
+	Source   string    // SourceTimeline, SourceMentions, or "" for both
+	Accts    []string  // Series by author
+	Hashtags []string  // Series by hashtag
+	Mentions []string  // Series by mentioned account
+}
+
+// NewActivitySeries returns an empty set of series
+func NewActivitySeries() *ActivitySeries {
+	as := &ActivitySeries{
+		counts: make([]map[seriesKey]map[int64]seriesBucket, len(seriesSteps)),
+		seen:   newSeenTweets(seenTweetWindow),
+		pruned: make([]time.Time, len(seriesSteps)),
+		now:    time.Now,
+	}
+	for i := range seriesSteps {
+		as.counts[i] = make(map[seriesKey]map[int64]seriesBucket)
+	}
+	return as
+}
+
+// normHashtag is the hashtag in our canonical form: lower case with the #
+func normHashtag(tag string) string {
+	return "#" + strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+// Add counts the given records from the given source. Records we've already
+// counted (for the source) are skipped (see seenTweets), as are records with
+// no created time
+func (as *ActivitySeries) Add(source string, tweets ...TweetRecord) {
+	as.mtx.Lock()
+	defer as.mtx.Unlock()
+
+	now := as.now()
+	for _, tweet := range tweets {
+		if tweet.Created().IsZero() {
+			continue // No time to bucket it in
+		}
+		sources := make([]string, 0, 2)
+		for _, one := range []string{source, ""} {
+			if as.seen.Add(one, tweet, now) {
+				sources = append(sources, one)
+			}
+		}
+		if len(sources) < 1 {
+			continue
+		}
+
+		names := []seriesKey{
+			{kind: SeriesTotal},
+			{kind: SeriesAcct, name: graphNodeID(tweet.UserScreenName)},
+		}
+		tags := NewUniqueStrings()
+		for _, tag := range tweet.Hashtags {
+			tags.Add(normHashtag(tag))
+		}
+		for _, tag := range tags.Strings() {
+			names = append(names, seriesKey{kind: SeriesHashtag, name: tag})
+		}
+		targets := NewUniqueStrings()
+		for _, mention := range tweet.Mentions {
+			targets.Add(graphNodeID(mention))
+		}
+		for _, target := range targets.Strings() {
+			names = append(names, seriesKey{kind: SeriesMention, name: target})
+		}
+
+		keys := make([]seriesKey, 0, len(names)*len(sources))
+		for _, one := range sources {
+			for _, key := range names {
+				key.source = one
+				keys = append(keys, key)
+			}
+		}
+
+		created := tweet.Created()
+		for i, step := range seriesSteps {
+			if step.retention > 0 && created.Before(now.Add(-step.retention)) {
+				continue
+			}
+			bucket := created.Truncate(step.size).Unix()
+			for _, key := range keys {
+				buckets, inMap := as.counts[i][key]
+				if !inMap {
+					buckets = make(map[int64]seriesBucket)
+					as.counts[i][key] = buckets
+				}
+				b := buckets[bucket]
+				b.count++
+				b.sentiment += tweet.Sentiment
+				buckets[bucket] = b
+			}
+		}
+	}
+
+	as.prune(now)
+}
+
+// prune drops buckets past their retention. Nothing new can expire until a
+// step has passed, so each step is only checked that often. Caller must hold
+// the write lock
+func (as *ActivitySeries) prune(now time.Time) {
+	for i, step := range seriesSteps {
+		if step.retention <= 0 || now.Sub(as.pruned[i]) < step.size {
+			continue
+		}
+		as.pruned[i] = now
+		oldest := now.Add(-step.retention).Truncate(step.size).Unix()
+		for key, buckets := range as.counts[i] {
+			for bucket := range buckets {
+				if bucket < oldest {
+					delete(buckets, bucket)
+				}
+			}
+			if len(buckets) < 1 {
+				delete(as.counts[i], key)
+			}
+		}
+	}
+}
+
+// findStep returns the index of the named step (or -1)
+func findStep(name string) int {
+	for i, step := range seriesSteps {
+		if step.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Query returns the requested series with a point for every bucket from
+// From to To (zero-filled)
+func (as *ActivitySeries) Query(q SeriesQuery) (SeriesResult, error) {
+	idx := findStep(q.Step)
+	if idx < 0 {
+		return SeriesResult{}, errors.New("step must be minute, hour, or day")
+	}
+	step := seriesSteps[idx]
+
+	from := q.From.UTC().Truncate(step.size)
+	to := q.To.UTC()
+	if !to.After(from) {
+		return SeriesResult{}, errors.New("to must be after from")
+	}
+	if to.Sub(from)/step.size > maxSeriesPoints {
+		return SeriesResult{}, errors.New("Too many points: use a larger step or a shorter range")
+	}
+
+	keys := make([]seriesKey, 0, 1+len(q.Accts)+len(q.Hashtags)+len(q.Mentions))
+	for _, acct := range q.Accts {
+		keys = append(keys, seriesKey{kind: SeriesAcct, name: graphNodeID(acct)})
+	}
+	for _, tag := range q.Hashtags {
+		keys = append(keys, seriesKey{kind: SeriesHashtag, name: normHashtag(tag)})
+	}
+	for _, mention := range q.Mentions {
+		keys = append(keys, seriesKey{kind: SeriesMention, name: graphNodeID(mention)})
+	}
+	if len(keys) < 1 {
+		keys = append(keys, seriesKey{kind: SeriesTotal})
+	}
+
+	as.mtx.RLock()
+	defer as.mtx.RUnlock()
+
+	result := SeriesResult{
+		Step:   step.name,
+		From:   from.Format(time.RFC3339),
+		To:     to.Format(time.RFC3339),
+		Series: make([]Series, 0, len(keys)),
+	}
+
+	for _, key := range keys {
+		key.source = q.Source
+		series := Series{Kind: key.kind, Name: key.name, Source: q.Source, Points: make([]SeriesPoint, 0, 64)}
+		sentiment := 0.0
+		for t := from; t.Before(to); t = t.Add(step.size) {
+			total := as.counts[idx][key][t.Unix()]
+			series.Total += total.count
+			sentiment += total.sentiment
+			series.Points = append(series.Points, SeriesPoint{
+				Time:      t.Format(time.RFC3339),
+				Count:     total.count,
+				Sentiment: meanSentiment(total.sentiment, total.count),
+			})
+		}
+		series.Sentiment = meanSentiment(sentiment, series.Total)
+		result.Series = append(result.Series, series)
+	}
+
+	return result, nil
+}
+
+// meanSentiment is the (rounded) mean of count tweets with the total
+// sentiment, or 0 if there are no tweets
+func meanSentiment(total float64, count int) float64 {
+	if count < 1 {
+		return 0
+	}
+	return math.Floor(total/float64(count)*1000+0.5) / 1000
+}
+
+// defaultSeriesRange is how far back we go by default for each step
+var defaultSeriesRange = map[string]time.Duration{
+	"minute": time.Hour,
+	"hour":   24 * time.Hour,
+	"day":    30 * 24 * time.Hour,
+}
+
+// ParseSeriesQuery builds a query from the API query parameters step
+// (default hour), from, to (default now), source, and acct, hashtag, and
+// mention (each may be repeated or comma-delimited)
+func ParseSeriesQuery(values url.Values, now time.Time) (SeriesQuery, error) {
+	q := SeriesQuery{
+		Step:   strings.ToLower(strings.TrimSpace(values.Get("step"))),
+		To:     now.UTC(),
+		Source: strings.ToLower(strings.TrimSpace(values.Get("source"))),
+	}
+	if q.Step == "" {
+		q.Step = "hour"
+	}
+	defRange, inMap := defaultSeriesRange[q.Step]
+	if !inMap {
+		return q, errors.New("step must be minute, hour, or day")
+	}
+
+	var err error
+	if txt := values.Get("to"); len(txt) > 0 {
+		if q.To, err = ParseTimeParam(txt, now); err != nil {
+			return q, err
+		}
+	}
+	q.From = q.To.Add(-defRange)
+	if txt := values.Get("from"); len(txt) > 0 {
+		if q.From, err = ParseTimeParam(txt, now); err != nil {
+			return q, err
+		}
+	}
+
+	if q.Source == "all" {
+		q.Source = ""
+	}
+	if q.Source != "" && q.Source != SourceTimeline && q.Source != SourceMentions {
+		return q, errors.New("source must be timeline, mentions, or all")
+	}
+
+	list := func(name string) []string {
+		found := make([]string, 0)
+		for _, one := range values[name] {
+			found = append(found, allNonBlank(strings.Split(one, ","))...)
+		}
+		return found
+	}
+	q.Accts = list("acct")
+	q.Hashtags = list("hashtag")
+	q.Mentions = list("mention")
+
+	return q, nil
+}
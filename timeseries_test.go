@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivitySeries(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 10, 9, 12, 30, 0, 0, time.UTC)
+	activity := NewActivitySeries()
+	activity.now = func() time.Time { return now }
+
+	activity.Add(SourceTimeline,
+		trendRecord(1, now, 10*time.Minute, "alice", []string{"#Vote"}, []string{"@bob"}),
+		trendRecord(2, now, 12*time.Minute, "alice", []string{"#vote", "#debate"}, nil),
+		trendRecord(3, now, 70*time.Minute, "bob", []string{"#debate"}, []string{"@Alice"}),
+		trendRecord(4, now, 10*24*time.Hour, "bob", nil, nil),
+	)
+	activity.Add(SourceMentions,
+		trendRecord(10, now, 5*time.Minute, "carol", []string{"#vote"}, []string{"@bob"}),
+		trendRecord(1, now, 10*time.Minute, "alice", []string{"#vote"}, nil), // Also in the timeline
+	)
+	activity.Add(SourceMentions, trendRecord(10, now, 5*time.Minute, "carol", nil, nil)) // Duplicate
+	activity.Add(SourceMentions, TweetRecord{TweetID: 12, UserScreenName: "erin"})       // No created time
+
+	query := func(q SeriesQuery) SeriesResult {
+		result, err := activity.Query(q)
+		pcheck(err)
+		return result
+	}
+
+	// Total by hour for the last 3 hours
+	result := query(SeriesQuery{Step: "hour", From: now.Add(-3 * time.Hour), To: now})
+	assert.Equal("hour", result.Step)
+	assert.Len(result.Series, 1)
+	total := result.Series[0]
+	assert.Equal(SeriesTotal, total.Kind)
+	assert.Equal(4, total.Total)
+	assert.Len(total.Points, 4) // 09:00, 10:00, 11:00, 12:00
+	assert.Equal(0, total.Points[0].Count)
+	assert.Equal(1, total.Points[2].Count)
+	assert.Equal(3, total.Points[3].Count)
+	assert.Equal("2016-10-09T12:00:00Z", total.Points[3].Time)
+
+	// By key and source
+	result = query(SeriesQuery{
+		Step:     "minute",
+		From:     now.Add(-15 * time.Minute),
+		To:       now,
+		Source:   SourceTimeline,
+		Accts:    []string{"@ALICE"},
+		Hashtags: []string{"vote"},
+		Mentions: []string{"bob"},
+	})
+	assert.Len(result.Series, 3)
+	assert.Equal(SeriesAcct, result.Series[0].Kind)
+	assert.Equal("@alice", result.Series[0].Name)
+	assert.Equal(2, result.Series[0].Total)
+	assert.Equal("#vote", result.Series[1].Name)
+	assert.Equal(2, result.Series[1].Total)
+	assert.Equal(1, result.Series[2].Total)
+	assert.Len(result.Series[0].Points, 15)
+
+	// Each source counts a tweet from both, but both sources count it once
+	mentioned := func(source string) int {
+		return query(SeriesQuery{Step: "hour", From: now.Add(-time.Hour), To: now, Source: source, Accts: []string{"alice"}}).Series[0].Total
+	}
+	assert.Equal(2, mentioned(SourceTimeline))
+	assert.Equal(1, mentioned(SourceMentions))
+	assert.Equal(2, mentioned(""))
+
+	// Old tweets are forgotten (but their counts are kept)
+	assert.Len(activity.seen.ids, 11)
+	forgetful := NewActivitySeries()
+	forgetful.now = activity.now
+	forgetful.Add(SourceTimeline, trendRecord(1, now, time.Minute, "alice", nil, nil))
+	later := now.Add(seenTweetWindow + time.Hour)
+	forgetful.now = func() time.Time { return later }
+	forgetful.Add(SourceTimeline, trendRecord(2, later, time.Minute, "alice", nil, nil))
+	assert.Len(forgetful.seen.ids, 2)
+	alice := seriesKey{kind: SeriesAcct, name: "@alice"}
+	assert.Len(forgetful.counts[0][alice], 1) // The first minute is past retention
+	assert.Equal(later, forgetful.pruned[0])
+	soon := later.Add(30 * time.Second) // Less than a step: no pruning
+	forgetful.now = func() time.Time { return soon }
+	forgetful.Add(SourceTimeline, trendRecord(3, soon, 0, "alice", nil, nil))
+	assert.Equal(later, forgetful.pruned[0])
+	assert.Equal(later, forgetful.pruned[1])
+	result, err := forgetful.Query(SeriesQuery{Step: "day", From: now.Add(-24 * time.Hour), To: later, Accts: []string{"alice"}})
+	assert.NoError(err)
+	assert.Equal(3, result.Series[0].Total)
+
+	// Sentiment is averaged per point and per series
+	scored := func(tid int64, ago time.Duration, sentiment float64) TweetRecord {
+		rec := trendRecord(tid, now, ago, "dave", nil, nil)
+		rec.Sentiment = sentiment
+		return rec
+	}
+	activity.Add(SourceMentions, scored(20, 2*time.Minute, 0.5), scored(21, 3*time.Minute, -0.2), scored(22, 20*time.Minute, 0.3))
+	result = query(SeriesQuery{Step: "hour", From: now.Add(-time.Hour), To: now, Accts: []string{"dave"}})
+	dave := result.Series[0]
+	assert.Equal(3, dave.Total)
+	assert.Equal(0.2, dave.Sentiment)
+	assert.Equal(0.0, dave.Points[0].Sentiment) // 11:00 has no tweets
+	assert.Equal(0.2, dave.Points[1].Sentiment)
+	result = query(SeriesQuery{Step: "minute", From: now.Add(-3 * time.Minute), To: now, Accts: []string{"dave"}})
+	assert.Equal(-0.2, result.Series[0].Points[0].Sentiment)
+	assert.Equal(0.5, result.Series[0].Points[1].Sentiment)
+	assert.Equal(0.15, result.Series[0].Sentiment)
+
+	// Day buckets are kept forever, minutes aren't
+	result = query(SeriesQuery{Step: "day", From: now.Add(-30 * 24 * time.Hour), To: now})
+	assert.Equal(8, result.Series[0].Total)
+	result = query(SeriesQuery{Step: "minute", From: now.Add(-10*24*time.Hour - time.Hour), To: now.Add(-9 * 24 * time.Hour)})
+	assert.Equal(0, result.Series[0].Total)
+
+	// Errors
+	_, err = activity.Query(SeriesQuery{Step: "fortnight", From: now.Add(-time.Hour), To: now})
+	assert.NotNil(err)
+	_, err = activity.Query(SeriesQuery{Step: "hour", From: now, To: now.Add(-time.Hour)})
+	assert.NotNil(err)
+	_, err = activity.Query(SeriesQuery{Step: "minute", From: now.Add(-365 * 24 * time.Hour), To: now})
+	assert.NotNil(err)
+}
+
+func TestParseSeriesQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 10, 9, 12, 30, 0, 0, time.UTC)
+	parse := func(raw string) (SeriesQuery, error) {
+		values, err := url.ParseQuery(raw)
+		pcheck(err)
+		return ParseSeriesQuery(values, now)
+	}
+
+	q, err := parse("")
+	assert.Nil(err)
+	assert.Equal("hour", q.Step)
+	assert.Equal(now, q.To)
+	assert.Equal(now.Add(-24*time.Hour), q.From)
+
+	q, err = parse("step=day&from=2016-09-01&to=2016-10-01&acct=bob,carol&hashtag=vote&mention=dave&source=mentions")
+	assert.Nil(err)
+	assert.Equal("day", q.Step)
+	assert.Equal(time.Date(2016, 9, 1, 0, 0, 0, 0, time.UTC), q.From)
+	assert.Equal(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC), q.To)
+	assert.Equal([]string{"bob", "carol"}, q.Accts)
+	assert.Equal([]string{"vote"}, q.Hashtags)
+	assert.Equal([]string{"dave"}, q.Mentions)
+	assert.Equal(SourceMentions, q.Source)
+
+	_, err = parse("step=week")
+	assert.NotNil(err)
+	_, err = parse("from=whenever")
+	assert.NotNil(err)
+	_, err = parse("source=rumor")
+	assert.NotNil(err)
+}
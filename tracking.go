@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Track settings are the extra track terms for the mention stream and the
+// accounts we don't track (muted) even though they're in the tweet store.
+// They're changed through the admin API and saved as JSON, so changes
+// survive a restart. Until the file is first written, the terms come from
+// the hashtag file
+
+// TrackLists is the saved form of the track settings (and what the admin
+// API returns)
+type TrackLists struct {
+	Terms []string // Hashtags and @mentions (always with the prefix)
+	Muted []string // Screen names (lower case, no @)
+}
+
+// TrackSettings are the current track settings and the file they're saved in
+type TrackSettings struct {
+	filename string
+	terms    *UniqueStrings
+	muted    *UniqueStrings
+	mtx      sync.RWMutex
+}
+
+// normTrackTerm returns the term as we track it: a term that doesn't begin
+// with # or @ is a hashtag
+func normTrackTerm(term string) string {
+	if !strings.HasPrefix(term, "#") && !strings.HasPrefix(term, "@") {
+		term = "#" + term
+	}
+	return term
+}
+
+// singleWord returns the single word in txt (or an error if there isn't
+// exactly one)
+func singleWord(what string, txt string) (string, error) {
+	words := strings.Fields(txt)
+	if len(words) != 1 {
+		return "", fmt.Errorf("%s must be a single word: '%s'", what, txt)
+	}
+	return words[0], nil
+}
+
+// ParseTrackTerm returns the track term in txt as we store it (see
+// normTrackTerm)
+func ParseTrackTerm(txt string) (string, error) {
+	term, err := singleWord("Track term", txt)
+	if err != nil {
+		return "", err
+	}
+	term = normTrackTerm(term)
+	if len(term) < 2 {
+		return "", errors.New("Track term is empty")
+	}
+	return term, nil
+}
+
+// ParseMutedAccount returns the account in txt as we store it (see
+// normScreenName)
+func ParseMutedAccount(txt string) (string, error) {
+	acct, err := singleWord("Account", txt)
+	if err != nil {
+		return "", err
+	}
+	acct = normScreenName(acct)
+	if acct == "" {
+		return "", errors.New("Account is empty")
+	}
+	return acct, nil
+}
+
+// LoadTrackSettings reads the settings saved in filename. If the file
+// doesn't exist yet, we start with defaultTerms and nothing muted
+func LoadTrackSettings(filename string, defaultTerms []string) (*TrackSettings, error) {
+	lists := TrackLists{Terms: defaultTerms}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err == nil {
+		if err := json.Unmarshal(buf, &lists); err != nil {
+			return nil, fmt.Errorf("Invalid track settings %s: %v", filename, err)
+		}
+		log.Printf("Using track settings from %s\n", filename)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	settings := &TrackSettings{
+		filename: filename,
+		terms:    NewUniqueStrings(),
+		muted:    NewUniqueStrings(),
+	}
+	for _, term := range lists.Terms {
+		settings.terms.Add(normTrackTerm(term))
+	}
+	for _, acct := range lists.Muted {
+		settings.muted.Add(normScreenName(acct))
+	}
+	return settings, nil
+}
+
+// Lists returns the current settings
+func (settings *TrackSettings) Lists() TrackLists {
+	settings.mtx.RLock()
+	defer settings.mtx.RUnlock()
+	return TrackLists{
+		Terms: settings.terms.Strings(),
+		Muted: settings.muted.Strings(),
+	}
+}
+
+// Terms returns the current track terms
+func (settings *TrackSettings) Terms() []string {
+	return settings.Lists().Terms
+}
+
+// Accounts returns the accounts that aren't muted
+func (settings *TrackSettings) Accounts(accts []string) []string {
+	settings.mtx.RLock()
+	defer settings.mtx.RUnlock()
+
+	keep := make([]string, 0, len(accts))
+	for _, acct := range accts {
+		if !settings.muted.Seen[normScreenName(acct)] {
+			keep = append(keep, acct)
+		}
+	}
+	return keep
+}
+
+// change applies the change to the list and saves the settings if anything
+// changed. Returns true if something changed
+func (settings *TrackSettings) change(list *UniqueStrings, entry string, add bool) (bool, error) {
+	settings.mtx.Lock()
+	defer settings.mtx.Unlock()
+
+	if list.Seen[entry] == add {
+		return false, nil
+	}
+	apply := func(add bool) {
+		if add {
+			list.Add(entry)
+		} else {
+			delete(list.Seen, entry)
+		}
+	}
+
+	apply(add)
+	if err := settings.save(); err != nil {
+		apply(!add) // Keep what we have in sync with the file
+		return false, err
+	}
+	return true, nil
+}
+
+// The changes below take values from ParseTrackTerm and ParseMutedAccount.
+// They return true if anything changed, and only fail if the settings
+// couldn't be saved
+
+// AddTerm adds a track term
+func (settings *TrackSettings) AddTerm(term string) (bool, error) {
+	return settings.change(settings.terms, term, true)
+}
+
+// RemoveTerm removes a track term
+func (settings *TrackSettings) RemoveTerm(term string) (bool, error) {
+	return settings.change(settings.terms, term, false)
+}
+
+// Mute stops tracking an account
+func (settings *TrackSettings) Mute(acct string) (bool, error) {
+	return settings.change(settings.muted, acct, true)
+}
+
+// Unmute tracks an account again
+func (settings *TrackSettings) Unmute(acct string) (bool, error) {
+	return settings.change(settings.muted, acct, false)
+}
+
+// save writes the settings file (via a temporary file, so it's never half
+// written). Caller must hold the lock
+func (settings *TrackSettings) save() error {
+	buf, err := json.MarshalIndent(TrackLists{
+		Terms: settings.terms.Strings(),
+		Muted: settings.muted.Strings(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempName := settings.filename + ".tmp"
+	if err := ioutil.WriteFile(tempName, append(buf, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempName, settings.filename)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrackEntries(t *testing.T) {
+	assert := assert.New(t)
+
+	for txt, expected := range map[string]string{
+		"vote":      "#vote",
+		" #debate ": "#debate",
+		"@TimKaine": "@TimKaine",
+	} {
+		term, err := ParseTrackTerm(txt)
+		assert.NoError(err)
+		assert.Equal(expected, term)
+	}
+	for _, txt := range []string{"", " ", "#", "two words"} {
+		_, err := ParseTrackTerm(txt)
+		assert.Error(err)
+	}
+
+	acct, err := ParseMutedAccount("@TimKaine")
+	assert.NoError(err)
+	assert.Equal("timkaine", acct)
+	for _, txt := range []string{"", "@", "two words"} {
+		_, err := ParseMutedAccount(txt)
+		assert.Error(err)
+	}
+}
+
+func TestTrackSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twivility-track")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tracking.json")
+
+	// No file yet: the default terms
+	settings, err := LoadTrackSettings(filename, []string{"#vote", "debate"})
+	assert.NoError(err)
+	assert.Equal(TrackLists{Terms: []string{"#debate", "#vote"}, Muted: []string{}}, settings.Lists())
+	_, err = os.Stat(filename)
+	assert.True(os.IsNotExist(err))
+
+	changed, err := settings.AddTerm("#maga")
+	assert.NoError(err)
+	assert.True(changed)
+	changed, err = settings.AddTerm("#maga")
+	assert.NoError(err)
+	assert.False(changed)
+	changed, err = settings.RemoveTerm("#vote")
+	assert.NoError(err)
+	assert.True(changed)
+	changed, err = settings.RemoveTerm("#nope")
+	assert.NoError(err)
+	assert.False(changed)
+
+	changed, err = settings.Mute("timkaine")
+	assert.NoError(err)
+	assert.True(changed)
+	assert.Equal([]string{"realDonaldTrump"}, settings.Accounts([]string{"TimKaine", "realDonaldTrump"}))
+
+	// Saved: the file wins over the defaults
+	expected := TrackLists{Terms: []string{"#debate", "#maga"}, Muted: []string{"timkaine"}}
+	assert.Equal(expected, settings.Lists())
+	reloaded, err := LoadTrackSettings(filename, []string{"#ignored"})
+	assert.NoError(err)
+	assert.Equal(expected, reloaded.Lists())
+
+	changed, err = reloaded.Unmute("timkaine")
+	assert.NoError(err)
+	assert.True(changed)
+	assert.Len(reloaded.Accounts([]string{"TimKaine"}), 1)
+
+	// A failed save changes nothing
+	broken, err := LoadTrackSettings(filepath.Join(dir, "missing", "tracking.json"), nil)
+	assert.NoError(err)
+	changed, err = broken.AddTerm("#vote")
+	assert.Error(err)
+	assert.False(changed)
+	assert.Empty(broken.Terms())
+
+	// Bad files are an error
+	pcheck(ioutil.WriteFile(filename, []byte("not json"), 0600))
+	_, err = LoadTrackSettings(filename, nil)
+	assert.Error(err)
+}
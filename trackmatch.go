@@ -0,0 +1,246 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// Matching tweets against track terms - we want to know which entry (or
+// entries) in the track query caused Twitter to send us a mention. We follow
+// the rules in Twitter's track documentation:
+//
+// - A track entry is a phrase of one or more space-separated terms. A tweet
+//   matches the entry if it contains ALL of the terms (in any order)
+// - Matching is case-insensitive
+// - Punctuation in the tweet is ignored, so "vote" matches "vote!", "#vote",
+//   "@vote", and "http://vote.example.com". However a term that starts with
+//   # or @ only matches a hashtag or mention
+// - The full width ＃ and ＠ are equivalent to # and @ (which is the same
+//   rule Twitter uses when finding hashtags and mentions)
+// - Besides the text, URLs and the screen names of the author, the replied
+//   to user, and the retweeted user are matched. That last part is how we
+//   credit tweets delivered by following a user ID to the @account
+
+// TrackMatcher finds the track entries matched by a tweet
+type TrackMatcher struct {
+	entries []trackEntry
+}
+
+type trackEntry struct {
+	entry string   // The original track entry
+	terms []string // The normalized terms (see foldTerm)
+}
+
+// foldTerm normalizes a term (or tweet token) for matching
+func foldTerm(s string) string {
+	s = strings.Replace(s, "＃", "#", -1)
+	s = strings.Replace(s, "＠", "@", -1)
+	return strings.ToLower(s)
+}
+
+// isWordRune is true for characters that can be part of a term
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// NewTrackMatcher creates a matcher for the given track entries
+func NewTrackMatcher(trackQuery []string) *TrackMatcher {
+	matcher := &TrackMatcher{entries: make([]trackEntry, 0, len(trackQuery))}
+	for _, entry := range trackQuery {
+		terms := strings.Fields(foldTerm(entry))
+		if len(terms) > 0 {
+			matcher.entries = append(matcher.entries, trackEntry{entry: entry, terms: terms})
+		}
+	}
+	return matcher
+}
+
+// addTokens adds all the tokens we can match in txt. Each run of word
+// characters is a token, and if the run is preceded by # or @ then the
+// prefixed version is a token as well
+func addTokens(tokens map[string]bool, txt string) {
+	runes := []rune(foldTerm(txt))
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(runes) && isWordRune(runes[i]) {
+			i++
+		}
+		word := string(runes[start:i])
+		tokens[word] = true
+		if start > 0 && (runes[start-1] == '#' || runes[start-1] == '@') {
+			tokens[string(runes[start-1])+word] = true
+		}
+	}
+}
+
+// addScreenName adds the @name token for a screen name
+func addScreenName(tokens map[string]bool, name string) {
+	if len(name) > 0 {
+		addTokens(tokens, "@"+strings.TrimPrefix(name, "@"))
+	}
+}
+
+// tweetTokens returns the set of tokens in the tweet that can be matched
+func tweetTokens(tweet *twitter.Tweet) map[string]bool {
+	tokens := make(map[string]bool)
+
+	var addTweet func(tw *twitter.Tweet, depth int)
+	addTweet = func(tw *twitter.Tweet, depth int) {
+		if tw == nil || depth > 2 {
+			return
+		}
+		addTokens(tokens, tw.Text)
+		addTokens(tokens, tw.FullText)
+		if tw.ExtendedTweet != nil {
+			addTokens(tokens, tw.ExtendedTweet.FullText)
+		}
+		if tw.User != nil {
+			addScreenName(tokens, tw.User.ScreenName)
+		}
+		addScreenName(tokens, tw.InReplyToScreenName)
+		if tw.Entities != nil {
+			for _, u := range tw.Entities.Urls {
+				addTokens(tokens, u.ExpandedURL)
+				addTokens(tokens, u.DisplayURL)
+			}
+			for _, m := range tw.Entities.UserMentions {
+				addScreenName(tokens, m.ScreenName)
+			}
+			for _, h := range tw.Entities.Hashtags {
+				addTokens(tokens, "#"+h.Text)
+			}
+		}
+		addTweet(tw.RetweetedStatus, depth+1)
+		addTweet(tw.QuotedStatus, depth+1)
+	}
+	addTweet(tweet, 0)
+
+	return tokens
+}
+
+// Match returns the (sorted) track entries matched by the tweet
+func (tm *TrackMatcher) Match(tweet *twitter.Tweet) []string {
+	return tm.matchTokens(tweetTokens(tweet))
+}
+
+// matchTokens returns the (sorted) track entries matched by the tokens (see
+// addTokens)
+func (tm *TrackMatcher) matchTokens(tokens map[string]bool) []string {
+	matched := make([]string, 0, 2)
+	for _, entry := range tm.entries {
+		all := true
+		for _, term := range entry.terms {
+			if !tokens[term] {
+				all = false
+				break
+			}
+		}
+		if all {
+			matched = append(matched, entry.entry)
+		}
+	}
+
+	sort.Strings(matched)
+	return matched
+}
+
+// TermStats are the match statistics for a single track entry
+type TermStats struct {
+	Count   int64   // Mentions matching the entry
+	PerHour float64 // Count per hour since counting started
+	Share   float64 // Fraction of all mentions matching the entry
+}
+
+// TrackStats are the match statistics for all track entries
+type TrackStats struct {
+	Since     string // When counting started
+	Mentions  int64  // Total mentions counted
+	Unmatched int64  // Mentions that matched no entries (location matches, etc)
+	Terms     map[string]TermStats
+}
+
+// TermCounter keeps thread-safe match counts for track entries
+type TermCounter struct {
+	since     time.Time
+	total     int64
+	unmatched int64
+	counts    map[string]int64
+	mtx       sync.RWMutex
+}
+
+// NewTermCounter returns a counter with all counts at zero
+func NewTermCounter() *TermCounter {
+	return &TermCounter{
+		since:  time.Now(),
+		counts: make(map[string]int64),
+	}
+}
+
+// Track insures that every entry appears in the stats, even if it never
+// matches anything. Entries we were already counting are left alone
+func (tc *TermCounter) Track(entries []string) {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	for _, entry := range entries {
+		if _, inMap := tc.counts[entry]; !inMap {
+			tc.counts[entry] = 0
+		}
+	}
+}
+
+// Add counts a single mention that matched the given entries
+func (tc *TermCounter) Add(matched []string) {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	tc.total++
+	if len(matched) < 1 {
+		tc.unmatched++
+	}
+	for _, entry := range matched {
+		tc.counts[entry]++
+	}
+}
+
+// Count returns the number of mentions matching the given entry
+func (tc *TermCounter) Count(entry string) int64 {
+	tc.mtx.RLock()
+	defer tc.mtx.RUnlock()
+	return tc.counts[entry]
+}
+
+// Stats returns the counts and rates for every entry
+func (tc *TermCounter) Stats() TrackStats {
+	tc.mtx.RLock()
+	defer tc.mtx.RUnlock()
+
+	// Don't let rates explode right after startup
+	hours := time.Since(tc.since).Hours()
+	if hours < 1.0/60.0 {
+		hours = 1.0 / 60.0
+	}
+
+	stats := TrackStats{
+		Since:     tc.since.Format(time.RFC1123Z),
+		Mentions:  tc.total,
+		Unmatched: tc.unmatched,
+		Terms:     make(map[string]TermStats),
+	}
+	for entry, count := range tc.counts {
+		ts := TermStats{Count: count, PerHour: float64(count) / hours}
+		if tc.total > 0 {
+			ts.Share = float64(count) / float64(tc.total)
+		}
+		stats.Terms[entry] = ts
+	}
+	return stats
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/stretchr/testify/assert"
+)
+
+func matchTweet(text string, screenName string) *twitter.Tweet {
+	return &twitter.Tweet{
+		ID:   1,
+		Text: text,
+		User: &twitter.User{ID: 1, ScreenName: screenName},
+	}
+}
+
+func TestTrackMatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	matcher := NewTrackMatcher([]string{"#vote", "@Bob", "debate", "big news", " "})
+
+	match := func(text string) []string {
+		return matcher.Match(matchTweet(text, "someone"))
+	}
+
+	assert.Equal([]string{}, match("nothing to see here"))
+	assert.Equal([]string{"#vote"}, match("Go #VOTE!"))
+	assert.Equal([]string{"#vote"}, match("Go ＃vote"))
+	assert.Equal([]string{}, match("Go vote"))
+	assert.Equal([]string{"@Bob"}, match("(@bob's) idea"))
+	assert.Equal([]string{"@Bob"}, match("hey ＠BOB"))
+	assert.Equal([]string{}, match("bob is here"))
+	assert.Equal([]string{"debate"}, match("#Debate tonight"))
+	assert.Equal([]string{"debate"}, match("see http://debate.example.com"))
+	assert.Equal([]string{}, match("debates tonight"))
+	assert.Equal([]string{"big news"}, match("News: it's BIG"))
+	assert.Equal([]string{}, match("big day"))
+	assert.Equal([]string{"#vote", "@Bob", "debate"}, match("@bob #vote debate"))
+
+	// Unicode case
+	accented := NewTrackMatcher([]string{"#ÉLECTION"})
+	assert.Equal([]string{"#ÉLECTION"}, accented.Match(matchTweet("Vive #élection", "someone")))
+}
+
+func TestTrackMatcherUsers(t *testing.T) {
+	assert := assert.New(t)
+
+	matcher := NewTrackMatcher([]string{"@bob", "@carol", "@dave", "#tag"})
+
+	// Tweets from a followed user credit that user
+	assert.Equal([]string{"@bob"}, matcher.Match(matchTweet("hello world", "Bob")))
+
+	// Replies
+	reply := matchTweet("hello world", "someone")
+	reply.InReplyToScreenName = "carol"
+	assert.Equal([]string{"@carol"}, matcher.Match(reply))
+
+	// Retweets (and the entities in the retweet)
+	rt := matchTweet("RT hello", "someone")
+	rt.RetweetedStatus = matchTweet("hello", "dave")
+	rt.RetweetedStatus.Entities = &twitter.Entities{
+		Hashtags: []twitter.HashtagEntity{{Text: "Tag"}},
+	}
+	assert.Equal([]string{"#tag", "@dave"}, matcher.Match(rt))
+}
+
+func TestTermCounter(t *testing.T) {
+	assert := assert.New(t)
+
+	tc := NewTermCounter()
+	tc.Track([]string{"#a", "#b", "#c"})
+	tc.Add([]string{"#a"})
+	tc.Add([]string{"#a", "#b"})
+	tc.Add([]string{})
+	tc.Add([]string{"#a", "#z"})
+
+	assert.Equal(int64(3), tc.Count("#a"))
+	assert.Equal(int64(0), tc.Count("#c"))
+
+	stats := tc.Stats()
+	assert.Equal(int64(4), stats.Mentions)
+	assert.Equal(int64(1), stats.Unmatched)
+	assert.Len(stats.Terms, 4)
+	assert.Equal(int64(3), stats.Terms["#a"].Count)
+	assert.Equal(0.75, stats.Terms["#a"].Share)
+	assert.True(stats.Terms["#a"].PerHour > 0.0)
+	assert.Equal(int64(0), stats.Terms["#c"].Count)
+	assert.Equal(0.0, stats.Terms["#c"].PerHour)
+
+	// Re-tracking doesn't reset anything
+	tc.Track([]string{"#a"})
+	assert.Equal(int64(3), tc.Count("#a"))
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hashtag trends: we keep hashtag counts in 5 minute buckets for long enough
+// to compare our longest window with the window before it. Counts are kept
+// by source (timeline or mentions) and by account, where a tweet counts for
+// its author and for every account it mentions. A tracked account's own
+// tweets come from both sources, so tweets are deduplicated per source and
+// counted again (once) for all sources.
+
+// Record sources
+const (
+	SourceTimeline = "timeline"
+	SourceMentions = "mentions"
+)
+
+const (
+	trendBucket    = 5 * time.Minute
+	trendMaxWindow = 7 * 24 * time.Hour
+)
+
+// DefaultTrendWindows are the windows returned when none are requested
+var DefaultTrendWindows = []string{"1h", "24h", "7d"}
+
+// trendKey is what we count in a bucket. An empty acct is the count for all
+// accounts, and an empty source is the count for all sources
+type trendKey struct {
+	source string
+	acct   string
+	tag    string
+}
+
+// HashtagTrends keeps thread-safe, incrementally updated hashtag counts
+type HashtagTrends struct {
+	buckets map[int64]map[trendKey]int // bucket start (unix secs) => counts
+	seen    *seenTweets                // Tweets already counted, by source
+	pruned  int64                      // Oldest bucket start we've kept since the last prune
+	now     func() time.Time
+	mtx     sync.RWMutex
+}
+
+// HashtagTrend is the count for a single hashtag in a window
+type HashtagTrend struct {
+	Hashtag   string
+	Count     int
+	PrevCount int     // Count in the previous window of the same length
+	Growth    float64 // (Count - PrevCount) / PrevCount (0 if PrevCount is 0)
+	New       bool    // True if the hashtag wasn't seen in the previous window
+}
+
+// TrendWindow is the result for a single window
+type TrendWindow struct {
+	Window   string
+	Start    string
+	End      string
+	Total    int // Hashtag uses in the window
+	Hashtags []HashtagTrend
+}
+
+// TrendQuery selects what HashtagTrends.Top returns
+type TrendQuery struct {
+	Windows []string // Windows like "1h" or "7d" (DefaultTrendWindows if empty)
+	Acct    string   // Only tweets from or mentioning this account
+	Source  string   // SourceTimeline, SourceMentions, or "" for both
+	Limit   int      // Max hashtags per window
+}
+
+// NewHashtagTrends returns an empty set of trends
+func NewHashtagTrends() *HashtagTrends {
+	return &HashtagTrends{
+		buckets: make(map[int64]map[trendKey]int),
+		seen:    newSeenTweets(2 * trendMaxWindow),
+		now:     time.Now,
+	}
+}
+
+// normAcct returns the account in our canonical form for matching: lower
+// case without the @
+func normAcct(acct string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(acct), "@"))
+}
+
+// Add counts the hashtags in the records from the given source. Records
+// we've already counted (for the source) and records too old to matter are
+// skipped
+func (ht *HashtagTrends) Add(source string, tweets ...TweetRecord) {
+	ht.mtx.Lock()
+	defer ht.mtx.Unlock()
+
+	now := ht.now()
+	oldest := now.Add(-2 * trendMaxWindow).Truncate(trendBucket).Unix()
+	for _, tweet := range tweets {
+		if len(tweet.Hashtags) < 1 {
+			continue
+		}
+		bucket := tweet.Created().Truncate(trendBucket).Unix()
+		if bucket < oldest {
+			continue
+		}
+
+		sources := make([]string, 0, 2)
+		for _, one := range []string{source, ""} {
+			if ht.seen.Add(one, tweet, now) {
+				sources = append(sources, one)
+			}
+		}
+		if len(sources) < 1 {
+			continue
+		}
+
+		counts, inMap := ht.buckets[bucket]
+		if !inMap {
+			counts = make(map[trendKey]int)
+			ht.buckets[bucket] = counts
+		}
+
+		accts := NewUniqueStrings()
+		accts.Add("")
+		accts.Add(normAcct(tweet.UserScreenName))
+		for _, mention := range tweet.Mentions {
+			accts.Add(normAcct(mention))
+		}
+
+		tags := NewUniqueStrings()
+		for _, tag := range tweet.Hashtags {
+			tags.Add(strings.ToLower(tag))
+		}
+
+		for _, tag := range tags.Strings() {
+			for _, acct := range accts.Strings() {
+				for _, one := range sources {
+					counts[trendKey{source: one, acct: acct, tag: tag}]++
+				}
+			}
+		}
+	}
+
+	if oldest > ht.pruned {
+		ht.prune(oldest)
+	}
+}
+
+// prune drops buckets older than oldest. Since oldest only moves a bucket at
+// a time, Add only calls us when it has. Caller must hold the write lock
+func (ht *HashtagTrends) prune(oldest int64) {
+	for bucket := range ht.buckets {
+		if bucket < oldest {
+			delete(ht.buckets, bucket)
+		}
+	}
+	ht.pruned = oldest
+}
+
+// parseDays parses a Go duration ("90m", "24h") or a number of days ("7d")
+func parseDays(window string) (time.Duration, error) {
+	if strings.HasSuffix(window, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(window, "d"))
+		if err != nil {
+			return 0, errors.New("Invalid window '" + window + "'")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	dur, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, errors.New("Invalid window '" + window + "'")
+	}
+	return dur, nil
+}
+
+// ParseWindow parses a trend window (see parseDays). Windows must be at
+// least one bucket and no more than 7 days
+func ParseWindow(window string) (time.Duration, error) {
+	dur, err := parseDays(window)
+	if err != nil {
+		return 0, err
+	}
+	if dur < trendBucket || dur > trendMaxWindow {
+		return 0, errors.New("Window '" + window + "' must be between 5m and 7d")
+	}
+	return dur, nil
+}
+
+// count sums the tag counts for buckets in [start, end). Caller must hold the
+// read lock
+func (ht *HashtagTrends) count(q TrendQuery, start int64, end int64) map[string]int {
+	acct := normAcct(q.Acct)
+	counts := make(map[string]int)
+	for bucket, bucketCounts := range ht.buckets {
+		if bucket < start || bucket >= end {
+			continue
+		}
+		for key, cnt := range bucketCounts {
+			if key.acct != acct || key.source != q.Source {
+				continue
+			}
+			counts[key.tag] += cnt
+		}
+	}
+	return counts
+}
+
+// Top returns the top hashtags for each requested window
+func (ht *HashtagTrends) Top(q TrendQuery) ([]TrendWindow, error) {
+	windows := q.Windows
+	if len(windows) < 1 {
+		windows = DefaultTrendWindows
+	}
+
+	ht.mtx.RLock()
+	defer ht.mtx.RUnlock()
+
+	// Our window end is the end of the current bucket
+	end := ht.now().Truncate(trendBucket).Add(trendBucket)
+
+	results := make([]TrendWindow, 0, len(windows))
+	for _, window := range windows {
+		dur, err := ParseWindow(window)
+		if err != nil {
+			return nil, err
+		}
+
+		start := end.Add(-dur)
+		prevStart := start.Add(-dur)
+		curr := ht.count(q, start.Unix(), end.Unix())
+		prev := ht.count(q, prevStart.Unix(), start.Unix())
+
+		result := TrendWindow{
+			Window:   window,
+			Start:    start.Format(time.RFC1123Z),
+			End:      end.Format(time.RFC1123Z),
+			Hashtags: make([]HashtagTrend, 0, len(curr)),
+		}
+		for tag, cnt := range curr {
+			trend := HashtagTrend{Hashtag: tag, Count: cnt, PrevCount: prev[tag]}
+			if trend.PrevCount > 0 {
+				trend.Growth = float64(cnt-trend.PrevCount) / float64(trend.PrevCount)
+			} else {
+				trend.New = true
+			}
+			result.Total += cnt
+			result.Hashtags = append(result.Hashtags, trend)
+		}
+
+		sort.Slice(result.Hashtags, func(i, j int) bool {
+			lhs, rhs := result.Hashtags[i], result.Hashtags[j]
+			if lhs.Count != rhs.Count {
+				return lhs.Count > rhs.Count
+			}
+			return lhs.Hashtag < rhs.Hashtag
+		})
+		if q.Limit > 0 && len(result.Hashtags) > q.Limit {
+			result.Hashtags = result.Hashtags[:q.Limit]
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// ParseTrendQuery builds a query from the API query parameters window (may
+// be repeated or comma-delimited), acct, source, and limit (default 20)
+func ParseTrendQuery(values url.Values) (TrendQuery, error) {
+	q := TrendQuery{
+		Windows: make([]string, 0, 3),
+		Acct:    strings.TrimSpace(values.Get("acct")),
+		Source:  strings.ToLower(strings.TrimSpace(values.Get("source"))),
+		Limit:   20,
+	}
+
+	for _, one := range values["window"] {
+		q.Windows = append(q.Windows, allNonBlank(strings.Split(one, ","))...)
+	}
+	for _, window := range q.Windows {
+		if _, err := ParseWindow(window); err != nil {
+			return q, err
+		}
+	}
+
+	if q.Source == "all" {
+		q.Source = ""
+	}
+	if q.Source != "" && q.Source != SourceTimeline && q.Source != SourceMentions {
+		return q, errors.New("source must be timeline, mentions, or all")
+	}
+
+	if txt := values.Get("limit"); len(txt) > 0 {
+		limit, err := strconv.Atoi(txt)
+		if err != nil || limit < 0 {
+			return q, errors.New("limit must be a non-negative integer")
+		}
+		q.Limit = limit
+	}
+
+	return q, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// trendRecord returns a record created the given time before now
+func trendRecord(tid int64, now time.Time, ago time.Duration, user string, hashtags []string, mentions []string) TweetRecord {
+	return TweetRecord{
+		TweetID:        tid,
+		UserScreenName: user,
+		Timestamp:      now.Add(-ago).Format(time.RubyDate),
+		Hashtags:       hashtags,
+		Mentions:       mentions,
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	dur, err := ParseWindow("1h")
+	assert.Nil(err)
+	assert.Equal(time.Hour, dur)
+
+	dur, err = ParseWindow("7d")
+	assert.Nil(err)
+	assert.Equal(7*24*time.Hour, dur)
+
+	_, err = ParseWindow("8d")
+	assert.NotNil(err)
+	_, err = ParseWindow("1m")
+	assert.NotNil(err)
+	_, err = ParseWindow("soon")
+	assert.NotNil(err)
+	_, err = ParseWindow("xd")
+	assert.NotNil(err)
+}
+
+func TestHashtagTrends(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 10, 9, 12, 2, 0, 0, time.UTC)
+	trends := NewHashtagTrends()
+	trends.now = func() time.Time { return now }
+
+	trends.Add(SourceTimeline,
+		trendRecord(1, now, 10*time.Minute, "alice", []string{"#Vote", "#vote"}, nil),
+		trendRecord(2, now, 20*time.Minute, "bob", []string{"#vote", "#debate"}, nil),
+		trendRecord(3, now, 90*time.Minute, "bob", []string{"#debate"}, nil),
+		trendRecord(4, now, 100*time.Minute, "bob", []string{"#debate"}, nil),
+		trendRecord(5, now, 30*24*time.Hour, "bob", []string{"#ancient"}, nil),
+		trendRecord(6, now, 5*time.Minute, "bob", nil, nil),
+	)
+	trends.Add(SourceMentions,
+		trendRecord(10, now, 5*time.Minute, "carol", []string{"#vote"}, []string{"@Alice"}),
+		trendRecord(11, now, 3*time.Hour, "dave", []string{"#vote"}, nil),
+	)
+
+	// Duplicates are ignored
+	trends.Add(SourceTimeline, trendRecord(1, now, 10*time.Minute, "alice", []string{"#vote"}, nil))
+
+	top := func(q TrendQuery) []TrendWindow {
+		windows, err := trends.Top(q)
+		pcheck(err)
+		return windows
+	}
+
+	windows := top(TrendQuery{})
+	assert.Len(windows, 3)
+	assert.Equal("1h", windows[0].Window)
+	assert.Equal("7d", windows[2].Window)
+
+	hour := windows[0]
+	assert.Equal(4, hour.Total)
+	assert.Len(hour.Hashtags, 2)
+	assert.Equal(HashtagTrend{Hashtag: "#vote", Count: 3, PrevCount: 0, New: true}, hour.Hashtags[0])
+	assert.Equal(HashtagTrend{Hashtag: "#debate", Count: 1, PrevCount: 2, Growth: -0.5}, hour.Hashtags[1])
+
+	week := windows[2]
+	assert.Equal(7, week.Total)
+	assert.Equal("#vote", week.Hashtags[0].Hashtag)
+	assert.Equal(4, week.Hashtags[0].Count)
+
+	// Filters
+	windows = top(TrendQuery{Windows: []string{"1h"}, Source: SourceMentions})
+	assert.Equal(1, windows[0].Total)
+
+	windows = top(TrendQuery{Windows: []string{"24h"}, Acct: "@ALICE"})
+	assert.Equal(2, windows[0].Total)
+	assert.Equal(2, windows[0].Hashtags[0].Count)
+
+	windows = top(TrendQuery{Windows: []string{"24h"}, Limit: 1})
+	assert.Len(windows[0].Hashtags, 1)
+
+	// A tweet from both sources counts once for each (in either order), and
+	// once for both
+	for _, first := range []string{SourceTimeline, SourceMentions} {
+		both := NewHashtagTrends()
+		both.now = trends.now
+		rec := trendRecord(30, now, time.Minute, "alice", []string{"#both"}, nil)
+		both.Add(first, rec)
+		both.Add(SourceTimeline, rec)
+		both.Add(SourceMentions, rec)
+		for _, source := range []string{SourceTimeline, SourceMentions, ""} {
+			windows, err := both.Top(TrendQuery{Windows: []string{"1h"}, Source: source})
+			pcheck(err)
+			assert.Equal(1, windows[0].Total, first+" then "+source)
+		}
+	}
+
+	// Old buckets are dropped once the oldest bucket we keep moves, and old
+	// tweets are forgotten (at most once an hour)
+	assert.Equal(now.Add(-2*trendMaxWindow).Truncate(trendBucket).Unix(), trends.pruned)
+	pruned := trends.pruned
+	now = now.Add(time.Minute)
+	trends.Add(SourceTimeline, trendRecord(40, now, 0, "bob", []string{"#later"}, nil))
+	assert.Equal(pruned, trends.pruned)
+	now = now.Add(2*trendMaxWindow + time.Hour)
+	trends.Add(SourceTimeline, trendRecord(41, now, 0, "bob", []string{"#muchlater"}, nil))
+	assert.True(trends.pruned > pruned)
+	assert.Len(trends.buckets, 1)
+	assert.Len(trends.seen.ids, 2)
+
+	_, err := trends.Top(TrendQuery{Windows: []string{"1y"}})
+	assert.NotNil(err)
+}
+
+func TestParseTrendQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	parse := func(raw string) (TrendQuery, error) {
+		values, err := url.ParseQuery(raw)
+		pcheck(err)
+		return ParseTrendQuery(values)
+	}
+
+	q, err := parse("")
+	assert.Nil(err)
+	assert.Empty(q.Windows)
+	assert.Equal(20, q.Limit)
+
+	q, err = parse("window=1h,24h&window=2d&acct=bob&source=Mentions&limit=5")
+	assert.Nil(err)
+	assert.Equal([]string{"1h", "24h", "2d"}, q.Windows)
+	assert.Equal("bob", q.Acct)
+	assert.Equal(SourceMentions, q.Source)
+	assert.Equal(5, q.Limit)
+
+	q, err = parse("source=all")
+	assert.Nil(err)
+	assert.Equal("", q.Source)
+
+	_, err = parse("source=carrier-pigeon")
+	assert.NotNil(err)
+	_, err = parse("window=forever")
+	assert.NotNil(err)
+	_, err = parse("limit=x")
+	assert.NotNil(err)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filtering and cursor pagination for an account's timeline. Pages are
+// newest first like the Twitter API: ask for the first page with no cursor,
+// then pass the returned NextMaxID as max_id to get the next (older) page.
+// Use since_id to only get tweets newer than the ones you already have
+
+// Limits on tweets per page
+const (
+	defaultTweetsLimit = 200
+	maxTweetsLimit     = 1000
+)
+
+// Tweet type filters for TweetsQuery.Type
+const (
+	TweetTypeRetweet  = "retweet"
+	TweetTypeOriginal = "original"
+)
+
+// TweetsQuery is a filter and page request for TweetsQuery.Page. Zero values
+// mean "don't filter on this"
+type TweetsQuery struct {
+	MaxID   int64     // Only tweets with an ID less than or equal to this
+	SinceID int64     // Only tweets with an ID greater than this
+	Limit   int       // Max number of tweets returned (default 200)
+	Hashtag string    // Only tweets using this hashtag
+	Mention string    // Only tweets mentioning this account
+	Type    string    // Only retweets (TweetTypeRetweet) or non-retweets (TweetTypeOriginal)
+	Text    string    // Only tweets containing this text (ignoring case)
+	From    time.Time // Only tweets created at or after this
+	To      time.Time // Only tweets created before this
+}
+
+// TweetsPage is a single page of tweets matching a TweetsQuery
+type TweetsPage struct {
+	Total     int   // Tweets matching the filters (ignoring max_id, since_id, and limit)
+	NextMaxID int64 // max_id for the next page (0 if this is the last page)
+	Tweets    TweetRecordList
+}
+
+// Match returns true if the given tweet passes the query filters (ignoring
+// the cursors and Limit)
+func (q TweetsQuery) Match(tweet TweetRecord) bool {
+	if !tweet.CreatedIn(q.From, q.To) {
+		return false
+	}
+	if len(q.Hashtag) > 0 && !matchAny(tweet.Hashtags, "#"+strings.TrimPrefix(q.Hashtag, "#")) {
+		return false
+	}
+	if len(q.Mention) > 0 && !matchAny(tweet.Mentions, "@"+strings.TrimPrefix(q.Mention, "@")) {
+		return false
+	}
+	if q.Type == TweetTypeRetweet && !tweet.IsRetweet {
+		return false
+	}
+	if q.Type == TweetTypeOriginal && tweet.IsRetweet {
+		return false
+	}
+	if len(q.Text) > 0 && !strings.Contains(strings.ToLower(tweet.Text), strings.ToLower(q.Text)) {
+		return false
+	}
+	return true
+}
+
+// inPage returns true if the tweet is within the query's cursors
+func (q TweetsQuery) inPage(tweet TweetRecord) bool {
+	if q.MaxID > 0 && tweet.TweetID > q.MaxID {
+		return false
+	}
+	return tweet.TweetID > q.SinceID
+}
+
+// Page returns the page of matching tweets in our canonical sort order
+// (newest first). The given list isn't modified
+func (q TweetsQuery) Page(tweets TweetRecordList) TweetsPage {
+	limit := q.Limit
+	if limit < 1 {
+		limit = defaultTweetsLimit
+	}
+
+	page := TweetsPage{}
+	matched := make(TweetRecordList, 0, limit)
+	for _, tweet := range tweets {
+		if !q.Match(tweet) {
+			continue
+		}
+		page.Total++
+		if q.inPage(tweet) {
+			matched = append(matched, tweet)
+		}
+	}
+
+	SortTwitterRecords(matched)
+	if len(matched) > limit {
+		matched = matched[:limit]
+		page.NextMaxID = matched[limit-1].TweetID - 1
+	}
+	page.Tweets = matched
+	return page
+}
+
+// ParseTweetsQuery builds a query from the API query parameters max_id,
+// since_id, limit, hashtag, mention, type, text, from, and to
+func ParseTweetsQuery(values url.Values, now time.Time) (TweetsQuery, error) {
+	q := TweetsQuery{
+		Limit:   defaultTweetsLimit,
+		Hashtag: strings.TrimSpace(values.Get("hashtag")),
+		Mention: strings.TrimSpace(values.Get("mention")),
+		Type:    strings.ToLower(strings.TrimSpace(values.Get("type"))),
+		Text:    strings.TrimSpace(values.Get("text")),
+	}
+
+	var err error
+	if q.From, q.To, err = ParseTimeRange(values, now); err != nil {
+		return q, err
+	}
+
+	if txt := values.Get("max_id"); len(txt) > 0 {
+		maxID, err := strconv.ParseInt(txt, 10, 64)
+		if err != nil || maxID < 1 {
+			return q, errors.New("max_id must be a positive tweet ID")
+		}
+		q.MaxID = maxID
+	}
+
+	if txt := values.Get("since_id"); len(txt) > 0 {
+		since, err := strconv.ParseInt(txt, 10, 64)
+		if err != nil || since < 0 {
+			return q, errors.New("since_id must be a non-negative tweet ID")
+		}
+		q.SinceID = since
+	}
+
+	if txt := values.Get("limit"); len(txt) > 0 {
+		limit, err := strconv.Atoi(txt)
+		if err != nil || limit < 1 || limit > maxTweetsLimit {
+			return q, errors.New("limit must be an integer from 1 to " + strconv.Itoa(maxTweetsLimit))
+		}
+		q.Limit = limit
+	}
+
+	if q.Type != "" && q.Type != TweetTypeRetweet && q.Type != TweetTypeOriginal {
+		return q, errors.New("type must be " + TweetTypeRetweet + " or " + TweetTypeOriginal)
+	}
+
+	return q, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTweetsTimeline() TweetRecordList {
+	day := func(d int) time.Time {
+		return time.Date(2016, 10, d, 12, 0, 0, 0, time.UTC)
+	}
+	// Not sorted to make sure we sort
+	return TweetRecordList{
+		{TweetID: 3, Text: "Vote early", Hashtags: []string{"#Vote"}, CreatedAt: day(3)},
+		{TweetID: 1, Text: "Watch the #debate tonight", Hashtags: []string{"#debate"}, CreatedAt: day(1)},
+		{TweetID: 5, Text: "RT @timkaine: Vote!", Mentions: []string{"@timkaine"}, IsRetweet: true, CreatedAt: day(5)},
+		{TweetID: 2, Text: "Thanks @TimKaine", Mentions: []string{"@TimKaine"}, CreatedAt: day(2)},
+		{TweetID: 4, Text: "Debate recap", CreatedAt: day(4)},
+	}
+}
+
+func TestTweetsQueryPage(t *testing.T) {
+	assert := assert.New(t)
+	tweets := testTweetsTimeline()
+
+	ids := func(page TweetsPage) []int64 {
+		found := make([]int64, 0, len(page.Tweets))
+		for _, tweet := range page.Tweets {
+			found = append(found, tweet.TweetID)
+		}
+		return found
+	}
+
+	// Everything
+	page := TweetsQuery{}.Page(tweets)
+	assert.Equal(5, page.Total)
+	assert.Equal(int64(0), page.NextMaxID)
+	assert.Equal([]int64{5, 4, 3, 2, 1}, ids(page))
+	assert.Equal(int64(3), tweets[0].TweetID) // Unchanged
+
+	// Paging through with max_id
+	page = TweetsQuery{Limit: 2}.Page(tweets)
+	assert.Equal(5, page.Total)
+	assert.Equal([]int64{5, 4}, ids(page))
+	assert.Equal(int64(3), page.NextMaxID)
+	page = TweetsQuery{Limit: 2, MaxID: page.NextMaxID}.Page(tweets)
+	assert.Equal([]int64{3, 2}, ids(page))
+	page = TweetsQuery{Limit: 2, MaxID: page.NextMaxID}.Page(tweets)
+	assert.Equal([]int64{1}, ids(page))
+	assert.Equal(int64(0), page.NextMaxID)
+
+	// Only newer
+	page = TweetsQuery{SinceID: 3}.Page(tweets)
+	assert.Equal(5, page.Total)
+	assert.Equal([]int64{5, 4}, ids(page))
+
+	// Filters
+	assert.Equal([]int64{3}, ids(TweetsQuery{Hashtag: "vote"}.Page(tweets)))
+	assert.Equal([]int64{1}, ids(TweetsQuery{Hashtag: "#DEBATE"}.Page(tweets)))
+	assert.Equal([]int64{5, 2}, ids(TweetsQuery{Mention: "timkaine"}.Page(tweets)))
+	assert.Equal([]int64{5}, ids(TweetsQuery{Type: TweetTypeRetweet}.Page(tweets)))
+	assert.Equal([]int64{4, 3, 2, 1}, ids(TweetsQuery{Type: TweetTypeOriginal}.Page(tweets)))
+	assert.Equal([]int64{4, 1}, ids(TweetsQuery{Text: "DEBATE"}.Page(tweets)))
+	page = TweetsQuery{
+		From: time.Date(2016, 10, 2, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2016, 10, 4, 0, 0, 0, 0, time.UTC),
+	}.Page(tweets)
+	assert.Equal(2, page.Total)
+	assert.Equal([]int64{3, 2}, ids(page))
+
+	// Filters and paging together
+	page = TweetsQuery{Type: TweetTypeOriginal, Limit: 1, MaxID: 3}.Page(tweets)
+	assert.Equal(4, page.Total)
+	assert.Equal([]int64{3}, ids(page))
+	assert.Equal(int64(2), page.NextMaxID)
+
+	page = TweetsQuery{Text: "nothing"}.Page(tweets)
+	assert.Equal(0, page.Total)
+	assert.Len(page.Tweets, 0)
+}
+
+func TestParseTweetsQuery(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2016, 10, 9, 12, 0, 0, 0, time.UTC)
+
+	parse := func(query string) (TweetsQuery, error) {
+		values, err := url.ParseQuery(query)
+		pcheck(err)
+		return ParseTweetsQuery(values, now)
+	}
+
+	q, err := parse("")
+	assert.NoError(err)
+	assert.Equal(TweetsQuery{Limit: defaultTweetsLimit}, q)
+
+	q, err = parse("max_id=100&since_id=10&limit=5&hashtag=%23vote&mention=@timkaine&type=Original&text=+debate+&from=24h")
+	assert.NoError(err)
+	assert.Equal(int64(100), q.MaxID)
+	assert.Equal(int64(10), q.SinceID)
+	assert.Equal(5, q.Limit)
+	assert.Equal("#vote", q.Hashtag)
+	assert.Equal("@timkaine", q.Mention)
+	assert.Equal(TweetTypeOriginal, q.Type)
+	assert.Equal("debate", q.Text)
+	assert.Equal(now.Add(-24*time.Hour), q.From)
+
+	for _, bad := range []string{"max_id=0", "max_id=x", "since_id=-1", "limit=0", "limit=1001", "type=reply", "from=garbage"} {
+		_, err := parse(bad)
+		assert.Error(err, bad)
+	}
+}
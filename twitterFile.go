@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"sort"
+	"time"
 
 	"github.com/dghubble/go-twitter/twitter"
 )
@@ -16,12 +17,17 @@ type TweetRecord struct {
 	UserScreenName string
 	UserName       string
 	Text           string
-	Timestamp      string
+	Timestamp      string    // Twitter's created_at, exactly as we got it
+	CreatedAt      time.Time // Timestamp parsed (UTC) - see Created
 	FavoriteCount  int
 	RetweetCount   int
 	Hashtags       []string
 	Mentions       []string
 	IsRetweet      bool
+	MatchedTerms   []string `json:",omitempty"` // Stream track entries matched (mentions only)
+	Categories     []string // Classifier categories (see Classifier)
+	Sentiment      float64  // -1 (negative) to +1 (positive) - see ScoreSentiment
+	Fingerprint    string   `json:",omitempty"` // Near-duplicate SimHash (mentions only) - see MentionFingerprint
 }
 
 // NewTweetRecord builds our nice record from the 'actual' API record
@@ -43,11 +49,54 @@ func NewTweetRecord(tweet *twitter.Tweet) TweetRecord {
 		UserScreenName: tweet.User.ScreenName,
 		Text:           txt,
 		Timestamp:      tweet.CreatedAt,
+		CreatedAt:      ParseTweetTime(tweet.CreatedAt, tweet.ID),
 		FavoriteCount:  tweet.FavoriteCount,
 		RetweetCount:   tweet.RetweetCount,
 		Hashtags:       allNonBlank(hashtagMatch.FindAllString(txt, -1)),
 		Mentions:       allNonBlank(userMatch.FindAllString(txt, -1)),
 		IsRetweet:      isRetweet,
+		Sentiment:      ScoreSentiment(txt),
+	}
+}
+
+// Twitter snowflake IDs: the epoch in milliseconds and the first snowflake
+// tweet ID. IDs before that were sequential, so they don't hold a time
+const (
+	twitterEpochMS   = 1288834974657
+	firstSnowflakeID = 29700859247
+)
+
+// ParseTweetTime returns the UTC time for a tweet's created_at string. If the
+// string can't be parsed, the time is recovered from the (snowflake) tweet ID.
+// If the ID isn't a snowflake either, it returns the zero time
+func ParseTweetTime(createdAt string, tweetID int64) time.Time {
+	if t, err := time.Parse(time.RubyDate, createdAt); err == nil {
+		return t.UTC()
+	}
+	if tweetID < firstSnowflakeID {
+		return time.Time{}
+	}
+	ms := (tweetID >> 22) + twitterEpochMS
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC()
+}
+
+// Created returns the UTC time the tweet was created. Records stored before
+// we parsed timestamps won't have CreatedAt set, so we parse on the fly
+func (rec TweetRecord) Created() time.Time {
+	if rec.CreatedAt.IsZero() {
+		return ParseTweetTime(rec.Timestamp, rec.TweetID)
+	}
+	return rec.CreatedAt
+}
+
+// backfill sets the fields that records stored by older versions are
+// missing: CreatedAt and Sentiment (re-scoring a neutral tweet is harmless)
+func (rec *TweetRecord) backfill() {
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = ParseTweetTime(rec.Timestamp, rec.TweetID)
+	}
+	if rec.Sentiment == 0 {
+		rec.Sentiment = ScoreSentiment(rec.Text)
 	}
 }
 
@@ -77,16 +126,44 @@ func (frs TweetRecordList) Seen() map[int64]bool {
 	return seen
 }
 
+// Between returns the records created in [from, to). A zero from or to
+// means no limit on that side. The order of the records is unchanged
+func (frs TweetRecordList) Between(from time.Time, to time.Time) TweetRecordList {
+	if from.IsZero() && to.IsZero() {
+		return frs
+	}
+
+	found := make(TweetRecordList, 0, len(frs))
+	for _, rec := range frs {
+		if rec.CreatedIn(from, to) {
+			found = append(found, rec)
+		}
+	}
+	return found
+}
+
+// CreatedIn returns true if the record was created in [from, to). A zero
+// from or to means no limit on that side
+func (rec TweetRecord) CreatedIn(from time.Time, to time.Time) bool {
+	created := rec.Created()
+	if !from.IsZero() && created.Before(from) {
+		return false
+	}
+	return to.IsZero() || created.Before(to)
+}
+
 // SortTwitterRecords sorts the given TweetFileRecordSlice INPLACE in our "canonical" order
 func SortTwitterRecords(frs TweetRecordList) {
 	sort.Sort(sort.Reverse(frs))
 }
 
-// WriteTwitterFile writes the file - note that the slice is sorted (and therefore mutated)
+// WriteTwitterFile writes the file - note that the slice is sorted (and therefore mutated).
+// We write to a temporary file and rename it over the original, so the file
+// is never left half written if we're interrupted
 func (frs TweetRecordList) WriteTwitterFile(filename string) {
-	output, err := os.Create(filename)
+	tempName := filename + ".tmp"
+	output, err := os.Create(tempName)
 	pcheck(err)
-	defer SafeClose(output)
 
 	SortTwitterRecords(frs)
 
@@ -95,6 +172,10 @@ func (frs TweetRecordList) WriteTwitterFile(filename string) {
 		err := enc.Encode(obj)
 		pcheck(err)
 	}
+
+	pcheck(output.Sync())
+	pcheck(output.Close())
+	pcheck(os.Rename(tempName, filename))
 }
 
 // ReadTwitterFile reads the specified file name for our twitter records
@@ -117,6 +198,7 @@ func ReadTwitterFile(filename string) TweetRecordList {
 			}
 		}
 
+		rec.backfill()
 		records = append(records, rec)
 	}
 
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -92,3 +93,61 @@ func TestInvalidTwitterFile(t *testing.T) {
 		ReadTwitterFile(tmpfile.Name())
 	})
 }
+
+func TestParseTweetTime(t *testing.T) {
+	assert := assert.New(t)
+
+	expected := time.Date(2016, 10, 9, 19, 30, 5, 0, time.UTC)
+	assert.Equal(expected, ParseTweetTime("Sun Oct 09 15:30:05 -0400 2016", 0))
+
+	// Fall back to the snowflake ID
+	assert.Equal(
+		time.Date(2016, 10, 10, 0, 27, 7, 442000000, time.UTC),
+		ParseTweetTime("testTime+1", 785275432357216256),
+	)
+
+	// Pre-snowflake IDs (and no ID at all) have no time
+	assert.True(ParseTweetTime("testTime+1", 0).IsZero())
+	assert.True(ParseTweetTime("testTime+1", 1<<22).IsZero())
+	assert.True(ParseTweetTime("testTime+1", firstSnowflakeID-1).IsZero())
+	assert.False(ParseTweetTime("testTime+1", firstSnowflakeID).IsZero())
+}
+
+func TestTweetRecordCreated(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpfile, err := ioutil.TempFile("", "twivility")
+	pcheck(err)
+	defer os.Remove(tmpfile.Name())
+
+	day := func(d int) time.Time {
+		return time.Date(2016, 10, d, 12, 0, 0, 0, time.UTC)
+	}
+
+	// Records stored before CreatedAt existed get it when read
+	input := TweetRecordList{
+		{TweetID: 1, Timestamp: day(1).Format(time.RubyDate)},
+		{TweetID: 785275432357216256, Timestamp: "garbage"},
+		{TweetID: 3, Timestamp: "garbage", CreatedAt: day(3)},
+	}
+	assert.Equal(day(1), input[0].Created())
+	assert.True(input[0].CreatedAt.IsZero())
+	input.WriteTwitterFile(tmpfile.Name())
+
+	output := ReadTwitterFile(tmpfile.Name())
+	assert.Len(output, 3)
+	byID := make(map[int64]TweetRecord)
+	for _, rec := range output {
+		byID[rec.TweetID] = rec
+	}
+	assert.Equal(day(1), byID[1].CreatedAt)
+	assert.Equal(day(10), byID[785275432357216256].CreatedAt.Truncate(24*time.Hour).Add(12*time.Hour))
+	assert.Equal(day(3), byID[3].CreatedAt)
+
+	// Date ranges
+	assert.Len(output.Between(time.Time{}, time.Time{}), 3)
+	assert.Len(output.Between(day(2), time.Time{}), 2)
+	assert.Len(output.Between(time.Time{}, day(3)), 1)
+	assert.Len(output.Between(day(3), day(4)), 1)
+	assert.Empty(output.Between(day(4), day(9)))
+}
@@ -7,6 +7,8 @@ import (
 	"log"
 	"os"
 	"sort"
+	"strings"
+	"time"
 )
 
 // pcheck logs a detailed error and then panics with the same msg
@@ -76,6 +78,70 @@ func lineCounter(filename string) (int, error) {
 	}
 }
 
+// tailLines returns (up to) the last n non-blank lines of the specified file
+// in file order. We read backwards in 32Kb chunks so that we don't have to
+// read a large file just to get at the end of it. A missing file has no lines.
+func tailLines(filename string, n int) ([]string, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return []string{}, err
+	}
+	defer SafeClose(fd)
+
+	stat, err := fd.Stat()
+	if err != nil {
+		return []string{}, err
+	}
+	if stat.IsDir() {
+		return []string{}, errors.New("No lines in a directory, genius")
+	}
+
+	// Keep reading chunks from the end until we have more than n non-blank
+	// lines (or we hit the start of the file). Blank lines don't count, so
+	// a file with lots of them still gets n records
+	const chunkSize = 32 * 1024
+	pos := stat.Size()
+	var data []byte
+	lines := []string{}
+	for pos > 0 && len(lines) <= n {
+		readSize := int64(chunkSize)
+		if readSize > pos {
+			readSize = pos
+		}
+		pos -= readSize
+
+		buf := make([]byte, readSize)
+		if _, err := fd.ReadAt(buf, pos); err != nil && err != io.EOF {
+			return []string{}, err
+		}
+		data = append(buf, data...)
+		lines = nonBlankLines(data)
+	}
+
+	// If we stopped in the middle of the file, the first line is partial -
+	// but we only care if we'd be returning it
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// nonBlankLines returns the lines in data that aren't just white space
+// (trimmed)
+func nonBlankLines(data []byte) []string {
+	lines := make([]string, 0, 64)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 // UniqueStrings implementation
 
 // UniqueStrings is a simple type around a map for a (sometimes sorted)
@@ -105,3 +171,60 @@ func (u *UniqueStrings) Strings() []string {
 	sort.Strings(strings)
 	return strings
 }
+
+// seenTweets implementation
+
+// How long seenTweets remembers a tweet (by its created time), and how often
+// it forgets old ones
+const (
+	seenTweetWindow = 2 * 24 * time.Hour
+	seenPruneEvery  = time.Hour
+)
+
+// seenTweet is a tweet from a source ("" when the source doesn't matter)
+type seenTweet struct {
+	source  string
+	tweetID int64
+}
+
+// seenTweets remembers the tweets already counted so that repeats can be
+// skipped, without keeping every tweet ID forever: tweets created more than
+// window ago are forgotten. Repeats of tweets that old only come from our
+// files, which are read all at once on startup, so we prune at most every
+// seenPruneEvery. Not thread-safe: callers use their own locks
+type seenTweets struct {
+	window time.Duration
+	ids    map[seenTweet]int64 // => created (unix secs)
+	pruned time.Time
+}
+
+// newSeenTweets returns an empty set remembering tweets for window
+func newSeenTweets(window time.Duration) *seenTweets {
+	return &seenTweets{window: window, ids: make(map[seenTweet]int64)}
+}
+
+// Add remembers the tweet for the source. It returns false if the tweet was
+// already seen for the source
+func (st *seenTweets) Add(source string, tweet TweetRecord, now time.Time) bool {
+	if now.Sub(st.pruned) >= seenPruneEvery {
+		st.prune(now)
+	}
+
+	key := seenTweet{source: source, tweetID: tweet.TweetID}
+	if _, inMap := st.ids[key]; inMap {
+		return false
+	}
+	st.ids[key] = tweet.Created().Unix()
+	return true
+}
+
+// prune forgets tweets created before the window
+func (st *seenTweets) prune(now time.Time) {
+	oldest := now.Add(-st.window).Unix()
+	for key, created := range st.ids {
+		if created < oldest {
+			delete(st.ids, key)
+		}
+	}
+	st.pruned = now
+}
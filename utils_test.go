@@ -2,7 +2,12 @@ package main
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -37,3 +42,73 @@ func TestUniqueStrings(t *testing.T) {
 	assert.Equal([]string{"a", "b"}, us.Strings())
 	assert.Equal([]string{"a", "b"}, us.Strings())
 }
+
+func TestSeenTweets(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 10, 9, 12, 0, 0, 0, time.UTC)
+	recent := TweetRecord{TweetID: 1, CreatedAt: now.Add(-time.Hour)}
+	old := TweetRecord{TweetID: 2, CreatedAt: now.Add(-3 * 24 * time.Hour)}
+
+	seen := newSeenTweets(seenTweetWindow)
+	assert.True(seen.Add(SourceTimeline, recent, now))
+	assert.True(seen.Add(SourceMentions, recent, now))
+	assert.False(seen.Add(SourceTimeline, recent, now))
+	assert.True(seen.Add("", old, now))
+	assert.False(seen.Add("", old, now))
+	assert.Len(seen.ids, 3)
+
+	// Old tweets are forgotten, but not until it's time to prune
+	assert.False(seen.Add("", old, now.Add(time.Minute)))
+	assert.True(seen.Add("", TweetRecord{TweetID: 3, CreatedAt: now}, now.Add(seenPruneEvery)))
+	assert.Len(seen.ids, 3)
+	assert.True(seen.Add("", old, now.Add(seenPruneEvery)))
+}
+
+func TestTailLines(t *testing.T) {
+	assert := assert.New(t)
+
+	lines, err := tailLines("/this/file/should/not/exist", 10)
+	assert.Nil(err)
+	assert.Empty(lines)
+
+	tmpfile, err := ioutil.TempFile("", "twivility")
+	pcheck(err)
+	defer os.Remove(tmpfile.Name())
+
+	// Make sure we cross a few of our 32Kb chunks
+	padding := strings.Repeat("x", 1000)
+	for i := 1; i <= 200; i++ {
+		tmpfile.WriteString(strconv.Itoa(i) + padding + "\n")
+	}
+	tmpfile.Close()
+
+	lines, err = tailLines(tmpfile.Name(), 3)
+	assert.Nil(err)
+	assert.Equal([]string{"198" + padding, "199" + padding, "200" + padding}, lines)
+
+	lines, err = tailLines(tmpfile.Name(), 100)
+	assert.Nil(err)
+	assert.Len(lines, 100)
+	assert.Equal("101"+padding, lines[0])
+
+	lines, err = tailLines(tmpfile.Name(), 500)
+	assert.Nil(err)
+	assert.Len(lines, 200)
+	assert.Equal("1"+padding, lines[0])
+
+	// Blank lines aren't records, even when there are lots of them
+	blanks, err := ioutil.TempFile("", "twivility")
+	pcheck(err)
+	defer os.Remove(blanks.Name())
+	for i := 1; i <= 200; i++ {
+		blanks.WriteString(strconv.Itoa(i) + padding + "\n" + strings.Repeat(" \n", 100))
+	}
+	blanks.Close()
+
+	lines, err = tailLines(blanks.Name(), 100)
+	assert.Nil(err)
+	assert.Len(lines, 100)
+	assert.Equal("101"+padding, lines[0])
+	assert.Equal("200"+padding, lines[99])
+}